@@ -1,9 +1,12 @@
 package cache
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"net/url"
+	"sort"
 	"sync"
 	"time"
 
@@ -14,9 +17,30 @@ import (
 )
 
 const (
-	APP_BUCKET = "AppBucket"
+	APP_BUCKET  = "AppBucket"
+	META_BUCKET = "MetaBucket"
+
+	fetchSettingsKey = "FetchSettings"
+	syncWatermarkKey = "SyncWatermark"
+	listedAtKey      = "ListedAt"
 )
 
+// syncOverlap is how long before the sync watermark incremental refreshes
+// look for changes, so that changes committed late are not missed.
+const syncOverlap = time.Minute
+
+// fetchSettingsVersion is bumped when what is read per app changes, so that
+// apps stored by an older nozzle are fetched again.
+const fetchSettingsVersion = 2
+
+// DefaultPopulateRetryInterval is how often caches that could not be filled
+// retry when BoltdbConfig.PopulateRetryInterval is not set.
+const DefaultPopulateRetryInterval = 30 * time.Second
+
+// DefaultResyncInterval is how often a cache refreshed with app changes
+// fetches every app again when OrgSpaceCacheTTL is not set.
+const DefaultResyncInterval = 24 * time.Hour
+
 var (
 	MissingAndIgnoredErr = errors.New("App was missed and ignored")
 )
@@ -28,6 +52,33 @@ type BoltdbConfig struct {
 	AppCacheTTL        time.Duration
 	OrgSpaceCacheTTL   time.Duration
 	AppLimits          int
+	OptOut             OptOutPolicy
+	// AppMetadata reads the v3 metadata labels of every app, even when the
+	// opt-out policy does not need them.
+	AppMetadata bool
+	// MaxApps bounds the in-memory cache; Boltdb does not use it.
+	MaxApps int
+	// APIVersion is the Cloud Controller API version apps are read with;
+	// see NewAppClient.
+	APIVersion string
+	// PopulateRetryInterval is how often a cache that could not be filled
+	// retries; defaults to DefaultPopulateRetryInterval.
+	PopulateRetryInterval time.Duration
+}
+
+// ChangesClient is implemented by AppClients that can list what changed
+// since a time, letting Boltdb refresh incrementally.
+type ChangesClient interface {
+	// AppsUpdatedSince lists the apps created or updated after since.
+	AppsUpdatedSince(since time.Time) ([]cfclient.App, error)
+	// AppsDeletedSince lists the apps deleted after since.
+	AppsDeletedSince(since time.Time) ([]AppDeletion, error)
+}
+
+// AppDeletion is an app deleted at a time.
+type AppDeletion struct {
+	Guid string
+	At   time.Time
 }
 
 // Org is a CAPI org
@@ -44,34 +95,31 @@ type Space struct {
 }
 
 type Boltdb struct {
-	appClient AppClient
-	appdb     *bolt.DB
+	*resolver
+	appdb *bolt.DB
 
 	lock        sync.RWMutex
 	cache       map[string]*App
 	missingApps map[string]struct{}
+	populated   bool
 
-	orgNameCache   map[string]Org   // caches org guid->org name mapping
-	spaceNameCache map[string]Space // caches space guid->space name mapping
-
-	closing chan struct{}
-	wg      sync.WaitGroup
-	config  *BoltdbConfig
+	closing  chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
 }
 
 func NewBoltdb(client AppClient, config *BoltdbConfig) (*Boltdb, error) {
 	return &Boltdb{
-		appClient:      client,
-		cache:          make(map[string]*App),
-		missingApps:    make(map[string]struct{}),
-		orgNameCache:   make(map[string]Org),
-		spaceNameCache: make(map[string]Space),
-		closing:        make(chan struct{}),
-		config:         config,
+		resolver:    newResolver(client, config),
+		cache:       make(map[string]*App),
+		missingApps: make(map[string]struct{}),
+		closing:     make(chan struct{}),
 	}, nil
 }
 
-func (c *Boltdb) Open() error {
+// Start opens the Bolt DB, fills the cache and starts refreshing it until
+// ctx is done or Stop is called.
+func (c *Boltdb) Start(ctx context.Context) error {
 	// Open bolt db
 	db, err := bolt.Open(c.config.Path, 0600, &bolt.Options{Timeout: 5 * time.Second})
 	if err != nil {
@@ -85,15 +133,18 @@ func (c *Boltdb) Open() error {
 		return err
 	}
 
-	if c.config.AppCacheTTL != time.Duration(0) {
-		c.invalidateCache()
+	if err := c.populateCache(); err != nil {
+		log.Error("Unable to populate app cache, will retry: ", err)
+		c.retryPopulate(ctx)
+	} else if c.config.AppCacheTTL != time.Duration(0) {
+		c.invalidateCache(ctx)
 	}
 
 	if c.config.MissingAppCacheTTL != time.Duration(0) {
-		c.invalidateMissingAppCache()
+		c.invalidateMissingAppCache(ctx)
 	}
 
-	return c.populateCache()
+	return nil
 }
 
 func (c *Boltdb) populateCache() error {
@@ -102,26 +153,208 @@ func (c *Boltdb) populateCache() error {
 		return err
 	}
 
-	if len(apps) == 0 {
+	// Stored apps carry the opt-out decisions and labels of the settings
+	// and API version they were fetched with.
+	settings := []byte(fmt.Sprintf("%d %#v %t %s", fetchSettingsVersion, c.config.OptOut, c.config.AppMetadata, c.config.APIVersion))
+	if len(apps) == 0 || !c.storedSettingsAre(settings) {
 		// populate from remote
 		apps, err = c.getAllAppsFromRemote()
 		if err != nil {
 			return err
 		}
+		if err := c.storeSettings(settings); err != nil {
+			return err
+		}
+		c.setPopulated(apps)
+		return nil
 	}
 
+	c.setPopulated(apps)
+
+	// Catch up with the changes made while the nozzle was down.
+	if changes, since, ok := c.incremental(); ok {
+		if err := c.syncChanges(changes, since); err != nil {
+			log.Error("Unable to fetch app changes from remote: ", err)
+		}
+	}
+
+	return nil
+}
+
+// setPopulated replaces the in-memory cache with apps, keeping the apps
+// fetched one by one meanwhile that apps does not hold.
+func (c *Boltdb) setPopulated(apps map[string]*App) {
+	c.lock.Lock()
+	for guid, app := range c.cache {
+		if _, ok := apps[guid]; !ok {
+			apps[guid] = app
+		}
+	}
 	c.cache = apps
+	c.populated = true
+	c.lock.Unlock()
+}
+
+// Populated reports whether the cache was filled from the Bolt DB or the
+// Cloud Controller.
+func (c *Boltdb) Populated() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.populated
+}
+
+// retryPopulate retries filling the cache until it succeeds, then starts
+// refreshing it.
+func (c *Boltdb) retryPopulate(ctx context.Context) {
+	ticker := time.NewTicker(c.populateRetryInterval())
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := c.populateCache(); err != nil {
+					log.Error("Unable to populate app cache, will retry: ", err)
+					continue
+				}
+				if c.config.AppCacheTTL != time.Duration(0) {
+					c.invalidateCache(ctx)
+				}
+				return
+			case <-ctx.Done():
+				return
+			case <-c.closing:
+				return
+			}
+		}
+	}()
+}
+
+// incremental returns the ChangesClient and the time to refresh from when
+// the cache can be refreshed incrementally.
+func (c *Boltdb) incremental() (ChangesClient, time.Time, bool) {
+	changes, ok := c.appClient.(ChangesClient)
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	since, ok := c.watermark()
+	return changes, since, ok
+}
+
+// refresh brings the cache up to date: incrementally when the client can
+// list changes and a sync watermark is stored, by fetching every app
+// otherwise.
+func (c *Boltdb) refresh() error {
+	if changes, since, ok := c.incremental(); ok {
+		return c.syncChanges(changes, since)
+	}
+	return c.resync()
+}
 
+// resync fetches every app again. Renaming a space or org does not update
+// its apps, so caches refreshed with app changes resync once per
+// resyncInterval, with fresh names.
+func (c *Boltdb) resync() error {
+	apps, err := c.getAllAppsFromRemote()
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	c.cache = apps
+	c.lock.Unlock()
 	return nil
 }
 
-func (c *Boltdb) Close() error {
-	close(c.closing)
+// resyncInterval is how often a cache refreshed with app changes fetches
+// every app again.
+func (c *Boltdb) resyncInterval() time.Duration {
+	if c.config.OrgSpaceCacheTTL > 0 {
+		return c.config.OrgSpaceCacheTTL
+	}
+	return DefaultResyncInterval
+}
 
-	// Wait for background goroutine exit
-	c.wg.Wait()
+// syncChanges fetches the apps updated and deleted since the watermark
+// since and applies them to the Bolt DB and in-memory cache.
+func (c *Boltdb) syncChanges(changes ChangesClient, since time.Time) error {
+	log.Info("Retrieving app changes from remote")
 
-	return c.appdb.Close()
+	from := since.Add(-syncOverlap)
+	cfApps, err := changes.AppsUpdatedSince(from)
+	if observeCFAPI("list_updated_apps", err) != nil {
+		return err
+	}
+	// Deletions are listed last so that apps deleted right after they
+	// were updated are deleted too.
+	deletions, err := changes.AppsDeletedSince(from)
+	if observeCFAPI("list_deleted_apps", err) != nil {
+		return err
+	}
+
+	watermark := later(since, latestUpdate(cfApps))
+	var forgotten []string
+	if limit := c.config.AppLimits; limit > 0 && len(cfApps) > limit {
+		// Keep the latest updated apps only, as a full listing does; the
+		// others are read again when they are looked up.
+		sort.SliceStable(cfApps, func(i, j int) bool { return cfApps[i].UpdatedAt > cfApps[j].UpdatedAt })
+		for _, app := range cfApps[limit:] {
+			forgotten = append(forgotten, app.Guid)
+		}
+		cfApps = cfApps[:limit]
+	}
+	apps := make(map[string]*App, len(cfApps))
+	for i := range cfApps {
+		app, err := c.fromPCFApp(&cfApps[i])
+		if err != nil {
+			return err
+		}
+		apps[app.Guid] = app
+	}
+	deleted := make([]string, 0, len(deletions))
+	for _, d := range deletions {
+		deleted = append(deleted, d.Guid)
+		watermark = later(watermark, d.At)
+	}
+
+	removed := append(deleted, forgotten...)
+	c.fillDatabase(apps)
+	if err := c.deleteFromDatabase(removed); err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	for guid, app := range apps {
+		c.cache[guid] = app
+		delete(c.missingApps, guid)
+	}
+	for _, guid := range removed {
+		delete(c.cache, guid)
+	}
+	c.lock.Unlock()
+
+	log.Info(fmt.Sprintf("Found %d updated and %d deleted apps", len(apps), len(deleted)))
+
+	return c.storeWatermark(watermark)
+}
+
+// Stop stops refreshing the cache and closes the Bolt DB. It may be called
+// more than once.
+func (c *Boltdb) Stop() error {
+	var err error
+	c.stopOnce.Do(func() {
+		close(c.closing)
+
+		// Wait for background goroutine exit
+		c.wg.Wait()
+
+		if c.appdb != nil {
+			err = c.appdb.Close()
+		}
+	})
+	return err
 }
 
 // GetApp tries first get app info from cache. If caches doesn't have this
@@ -134,14 +367,29 @@ func (c *Boltdb) Close() error {
 func (c *Boltdb) GetApp(appGuid string) (*App, error) {
 	app, err := c.getAppFromCache(appGuid)
 	if err != nil {
+		appLookups.WithLabelValues("ignored").Inc()
 		return nil, err
 	}
 
 	// Find in cache
 	if app != nil {
-		c.fillOrgAndSpace(app)
-		return app, nil
+		appLookups.WithLabelValues("hit").Inc()
+		// Cached apps are shared with concurrent lookups: refresh the org
+		// and space names of a copy and store it in their place.
+		dup := *app
+		if err := c.fillOrgAndSpace(&dup); err != nil {
+			dup = *app
+		} else {
+			c.lock.Lock()
+			if c.cache[appGuid] == app {
+				stored := dup
+				c.cache[appGuid] = &stored
+			}
+			c.lock.Unlock()
+		}
+		return &dup, nil
 	}
+	appLookups.WithLabelValues("miss").Inc()
 
 	// First time seeing app
 	app, err = c.getAppFromRemote(appGuid)
@@ -163,6 +411,21 @@ func (c *Boltdb) GetApp(appGuid string) (*App, error) {
 	return app, nil
 }
 
+// CachedApp returns the app when it is in the in-memory cache.
+func (c *Boltdb) CachedApp(appGuid string) (*App, bool) {
+	app, err := c.getAppFromCache(appGuid)
+	if err != nil {
+		appLookups.WithLabelValues("ignored").Inc()
+		return nil, true
+	}
+	if app == nil {
+		return nil, false
+	}
+	appLookups.WithLabelValues("hit").Inc()
+	dup := *app
+	return &dup, true
+}
+
 // GetAllApps returns all apps info
 func (c *Boltdb) GetAllApps() (map[string]*App, error) {
 	c.lock.RLock()
@@ -177,10 +440,7 @@ func (c *Boltdb) GetAllApps() (map[string]*App, error) {
 }
 
 func (c *Boltdb) ManuallyInvalidateCaches() error {
-	c.lock.Lock()
-	c.orgNameCache = make(map[string]Org)
-	c.spaceNameCache = make(map[string]Space)
-	c.lock.Unlock()
+	c.resetOrgsAndSpaces()
 
 	apps, err := c.getAllAppsFromRemote()
 	if err != nil {
@@ -250,17 +510,31 @@ func (c *Boltdb) getAllAppsFromRemote() (map[string]*App, error) {
 	}
 
 	cfApps, err := c.appClient.ListAppsByQueryWithLimits(q, totalPages)
-	if err != nil {
+	if observeCFAPI("list_apps", err) != nil {
 		return nil, err
 	}
 
 	apps := make(map[string]*App, len(cfApps))
 	for i := range cfApps {
-		app := c.fromPCFApp(&cfApps[i])
+		app, err := c.fromPCFApp(&cfApps[i])
+		if err != nil {
+			return nil, err
+		}
 		apps[app.Guid] = app
 	}
 
 	c.fillDatabase(apps)
+	// The apps not listed were deleted or, with AppLimits, are read again
+	// when they are looked up.
+	if err := c.pruneDatabase(apps); err != nil {
+		return nil, err
+	}
+	if err := c.storeWatermark(latestUpdate(cfApps)); err != nil {
+		return nil, err
+	}
+	if err := c.storeListedAt(time.Now()); err != nil {
+		return nil, err
+	}
 
 	log.Info(fmt.Sprintf("Found %d apps", len(apps)))
 
@@ -269,23 +543,105 @@ func (c *Boltdb) getAllAppsFromRemote() (map[string]*App, error) {
 
 func (c *Boltdb) createBucket() error {
 	return c.appdb.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(APP_BUCKET))
-		if err != nil {
-			return fmt.Errorf("create bucket: %s", err)
+		for _, name := range []string{APP_BUCKET, META_BUCKET} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return fmt.Errorf("create bucket: %s", err)
+			}
 		}
 		return nil
 	})
 }
 
+func (c *Boltdb) storedSettingsAre(settings []byte) bool {
+	var same bool
+	c.appdb.View(func(tx *bolt.Tx) error {
+		same = bytes.Equal(tx.Bucket([]byte(META_BUCKET)).Get([]byte(fetchSettingsKey)), settings)
+		return nil
+	})
+	return same
+}
+
+func (c *Boltdb) storeSettings(settings []byte) error {
+	return c.appdb.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(META_BUCKET)).Put([]byte(fetchSettingsKey), settings)
+	})
+}
+
+// watermark returns the time the apps in the Bolt DB are up to date with,
+// in Cloud Controller time.
+func (c *Boltdb) watermark() (time.Time, bool) {
+	var watermark time.Time
+	c.appdb.View(func(tx *bolt.Tx) error {
+		return watermark.UnmarshalText(tx.Bucket([]byte(META_BUCKET)).Get([]byte(syncWatermarkKey)))
+	})
+	return watermark, !watermark.IsZero()
+}
+
+// storeWatermark records watermark, or forgets the stored one when it is
+// zero so that the next refresh fetches every app.
+func (c *Boltdb) storeWatermark(watermark time.Time) error {
+	return c.appdb.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(META_BUCKET))
+		if watermark.IsZero() {
+			return b.Delete([]byte(syncWatermarkKey))
+		}
+		text, err := watermark.MarshalText()
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(syncWatermarkKey), text)
+	})
+}
+
+// listedAt returns when every app was last fetched, in local time, or zero
+// when it is not known.
+func (c *Boltdb) listedAt() time.Time {
+	var listedAt time.Time
+	c.appdb.View(func(tx *bolt.Tx) error {
+		return listedAt.UnmarshalText(tx.Bucket([]byte(META_BUCKET)).Get([]byte(listedAtKey)))
+	})
+	return listedAt
+}
+
+func (c *Boltdb) storeListedAt(listedAt time.Time) error {
+	text, err := listedAt.MarshalText()
+	if err != nil {
+		return err
+	}
+	return c.appdb.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(META_BUCKET)).Put([]byte(listedAtKey), text)
+	})
+}
+
+// latestUpdate returns the latest update time of apps, or zero when none
+// is known.
+func latestUpdate(apps []cfclient.App) time.Time {
+	var latest time.Time
+	for _, app := range apps {
+		if t, err := time.Parse(time.RFC3339, app.UpdatedAt); err == nil {
+			latest = later(latest, t)
+		}
+	}
+	return latest
+}
+
+func later(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
+
 // invalidateMissingAppCache perodically cleanup inmemory house keeping for
 // not found apps. When the this cache is cleaned up, end clients have chance
 // to retry missing apps
-func (c *Boltdb) invalidateMissingAppCache() {
+func (c *Boltdb) invalidateMissingAppCache(ctx context.Context) {
 	ticker := time.NewTicker(c.config.MissingAppCacheTTL)
 
 	c.wg.Add(1)
 	go func() {
 		defer c.wg.Done()
+		defer ticker.Stop()
 
 		for {
 			select {
@@ -293,6 +649,8 @@ func (c *Boltdb) invalidateMissingAppCache() {
 				c.lock.Lock()
 				c.missingApps = make(map[string]struct{})
 				c.lock.Unlock()
+			case <-ctx.Done():
+				return
 			case <-c.closing:
 				return
 			}
@@ -302,30 +660,46 @@ func (c *Boltdb) invalidateMissingAppCache() {
 
 // invalidateCache perodically fetches a full copy apps info from remote
 // and update boltdb and in-memory cache
-func (c *Boltdb) invalidateCache() {
+func (c *Boltdb) invalidateCache(ctx context.Context) {
 	ticker := time.NewTicker(c.config.AppCacheTTL)
-	orgSpaceTicker := time.NewTicker(c.config.OrgSpaceCacheTTL)
+	orgSpaceTicker := time.NewTicker(c.orgSpaceInterval())
+	// Without changes every refresh fetches every app. Otherwise the first
+	// resync is due one interval after the last full listing, which may
+	// predate a restart.
+	var resyncTimer *time.Timer
+	var resync <-chan time.Time
+	if _, ok := c.appClient.(ChangesClient); ok {
+		resyncTimer = time.NewTimer(c.resyncInterval() - time.Since(c.listedAt()))
+		resync = resyncTimer.C
+	}
 
 	c.wg.Add(1)
 	go func() {
 		defer c.wg.Done()
+		defer ticker.Stop()
+		defer orgSpaceTicker.Stop()
+		if resyncTimer != nil {
+			defer resyncTimer.Stop()
+		}
 
 		for {
 			select {
 			case <-ticker.C:
-				apps, err := c.getAllAppsFromRemote()
-				if err == nil {
-					c.lock.Lock()
-					c.cache = apps
-					c.lock.Unlock()
-				} else {
-					log.Error("Unable to fetch copy of cache from remote", err)
+				if err := c.refresh(); err != nil {
+					log.Error("Unable to refresh app cache from remote: ", err)
+				}
+			case <-resync:
+				c.resetOrgsAndSpaces()
+				if err := c.resync(); err != nil {
+					log.Error("Unable to resync app cache from remote, will retry: ", err)
+					resyncTimer.Reset(c.config.AppCacheTTL)
+					continue
 				}
+				resyncTimer.Reset(c.resyncInterval())
 			case <-orgSpaceTicker.C:
-				c.lock.Lock()
-				c.orgNameCache = make(map[string]Org)
-				c.spaceNameCache = make(map[string]Space)
-				c.lock.Unlock()
+				c.resetOrgsAndSpaces()
+			case <-ctx.Done():
+				return
 			case <-c.closing:
 				return
 			}
@@ -350,85 +724,46 @@ func (c *Boltdb) fillDatabase(apps map[string]*App) {
 	}
 }
 
-func (c *Boltdb) fromPCFApp(app *cfclient.App) *App {
-	cachedApp := &App{
-		Name:       app.Name,
-		Guid:       app.Guid,
-		SpaceGuid:  app.SpaceGuid,
-		IgnoredApp: c.isOptOut(app.Environment),
-	}
-
-	c.fillOrgAndSpace(cachedApp)
-
-	return cachedApp
-}
-
-func (c *Boltdb) fillOrgAndSpace(app *App) error {
-	now := time.Now()
-
-	c.lock.RLock()
-	space, ok := c.spaceNameCache[app.SpaceGuid]
-	c.lock.RUnlock()
-
-	if !ok || now.Sub(space.LastUpdated) > c.config.OrgSpaceCacheTTL {
-		cfspace, err := c.appClient.GetSpaceByGuid(app.SpaceGuid)
-		if err != nil {
-			return err
-		}
-
-		space = Space{
-			Name:        cfspace.Name,
-			OrgGUID:     cfspace.OrganizationGuid,
-			LastUpdated: now,
-		}
-
-		c.lock.Lock()
-		c.spaceNameCache[app.SpaceGuid] = space
-		c.lock.Unlock()
+// deleteFromDatabase removes the apps with the given GUIDs.
+func (c *Boltdb) deleteFromDatabase(guids []string) error {
+	if len(guids) == 0 {
+		return nil
 	}
-
-	app.SpaceName = space.Name
-	app.OrgGuid = space.OrgGUID
-
-	c.lock.RLock()
-	org, ok := c.orgNameCache[space.OrgGUID]
-	c.lock.RUnlock()
-	if !ok || now.Sub(org.LastUpdated) > c.config.OrgSpaceCacheTTL {
-		cforg, err := c.appClient.GetOrgByGuid(space.OrgGUID)
-		if err != nil {
-			return err
-		}
-
-		org = Org{
-			Name:        cforg.Name,
-			LastUpdated: now,
+	return c.appdb.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(APP_BUCKET))
+		for _, guid := range guids {
+			if err := b.Delete([]byte(guid)); err != nil {
+				return fmt.Errorf("Error deleting data: %s", err)
+			}
 		}
+		return nil
+	})
+}
 
-		c.lock.Lock()
-		c.orgNameCache[space.OrgGUID] = org
-		c.lock.Unlock()
-	}
-
-	app.OrgGuid = space.OrgGUID
-	app.OrgName = org.Name
-
-	return nil
+// pruneDatabase removes the apps that are not in keep.
+func (c *Boltdb) pruneDatabase(keep map[string]*App) error {
+	var stale []string
+	c.appdb.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(APP_BUCKET)).ForEach(func(guid, _ []byte) error {
+			if _, ok := keep[string(guid)]; !ok {
+				stale = append(stale, string(guid))
+			}
+			return nil
+		})
+	})
+	return c.deleteFromDatabase(stale)
 }
 
 func (c *Boltdb) getAppFromRemote(appGuid string) (*App, error) {
 	cfApp, err := c.appClient.AppByGuid(appGuid)
+	if observeCFAPI("get_app", err) != nil {
+		return nil, err
+	}
+	app, err := c.fromPCFApp(&cfApp)
 	if err != nil {
 		return nil, err
 	}
-	app := c.fromPCFApp(&cfApp)
 	c.fillDatabase(map[string]*App{app.Guid: app})
 
 	return app, nil
 }
-
-func (c *Boltdb) isOptOut(envVar map[string]interface{}) bool {
-	if val, ok := envVar["F2S_DISABLE_LOGGING"]; ok && val == "true" {
-		return true
-	}
-	return false
-}
@@ -0,0 +1,287 @@
+package cache_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "github.com/bosh-loki/loki-firehose-nozzle/cache"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Boltdb lifecycle", func() {
+	var (
+		dir    string
+		path   string
+		client *fakeAppClient
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "cache")
+		Expect(err).ToNot(HaveOccurred())
+		path = filepath.Join(dir, "cache.db")
+		client = newFakeAppClient()
+		client.addApp("app", nil)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	start := func(ctx context.Context, config BoltdbConfig) *Boltdb {
+		config.Path = path
+		c, err := NewBoltdb(client, &config)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(c.Start(ctx)).To(Succeed())
+		return c
+	}
+
+	appName := func(c *Boltdb) string {
+		apps, err := c.GetAllApps()
+		Expect(err).ToNot(HaveOccurred())
+		return apps["app"].Name
+	}
+
+	It("keeps refreshing apps after it started", func() {
+		c := start(context.Background(), BoltdbConfig{AppCacheTTL: 20 * time.Millisecond})
+		defer c.Stop()
+		Expect(appName(c)).To(Equal("app"))
+
+		client.renameApp("app", "renamed")
+		Eventually(func() string { return appName(c) }).Should(Equal("renamed"))
+	})
+
+	It("keeps the Bolt DB open for apps fetched after it started", func() {
+		c := start(context.Background(), BoltdbConfig{})
+		client.addApp("late", nil)
+
+		app, err := c.GetApp("late")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(app.SpaceName).To(Equal("dev"))
+		Expect(c.Stop()).To(Succeed())
+
+		calls := client.Calls("AppByGuid")
+		c = start(context.Background(), BoltdbConfig{})
+		defer c.Stop()
+		_, err = c.GetApp("late")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(client.Calls("AppByGuid")).To(Equal(calls))
+	})
+
+	It("stops refreshing once its context is done", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		c := start(ctx, BoltdbConfig{AppCacheTTL: 10 * time.Millisecond})
+		defer c.Stop()
+		cancel()
+
+		time.Sleep(30 * time.Millisecond)
+		listed := client.Calls("ListApps")
+		Consistently(func() int { return client.Calls("ListApps") }, 50*time.Millisecond).Should(Equal(listed))
+	})
+
+	It("refreshes without an org and space TTL", func() {
+		c := start(context.Background(), BoltdbConfig{AppCacheTTL: 10 * time.Millisecond, MissingAppCacheTTL: 10 * time.Millisecond})
+		defer c.Stop()
+		Eventually(func() int { return client.Calls("ListApps") }).Should(BeNumerically(">", 1))
+	})
+
+	It("may be stopped more than once", func() {
+		c := start(context.Background(), BoltdbConfig{AppCacheTTL: time.Minute})
+		Expect(c.Stop()).To(Succeed())
+		Expect(c.Stop()).To(Succeed())
+	})
+
+	It("may be stopped when it failed to start", func() {
+		c, err := NewBoltdb(client, &BoltdbConfig{Path: filepath.Join(dir, "missing", "cache.db")})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(c.Start(context.Background())).ToNot(Succeed())
+		Expect(c.Stop()).To(Succeed())
+	})
+
+	It("keeps retrying to fill itself when the first listing fails", func() {
+		client.failListing(errors.New("cloud controller unavailable"))
+		c := start(context.Background(), BoltdbConfig{AppCacheTTL: 20 * time.Millisecond, PopulateRetryInterval: 10 * time.Millisecond})
+		defer c.Stop()
+		Expect(c.Populated()).To(BeFalse())
+
+		app, err := c.GetApp("app")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(app.SpaceName).To(Equal("dev"))
+
+		client.failListing(nil)
+		Eventually(c.Populated).Should(BeTrue())
+
+		By("refreshing once it is filled")
+		client.renameApp("app", "renamed")
+		Eventually(func() string { return appName(c) }).Should(Equal("renamed"))
+	})
+
+	It("refreshes the org and space names of cached apps while they are read", func() {
+		c := start(context.Background(), BoltdbConfig{OrgSpaceCacheTTL: time.Nanosecond})
+		defer c.Stop()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				for j := 0; j < 20; j++ {
+					app, err := c.GetApp("app")
+					Expect(err).ToNot(HaveOccurred())
+					Expect(app.SpaceName).To(Equal("dev"))
+					cached, _ := c.CachedApp("app")
+					Expect(cached.OrgName).To(Equal("acme"))
+				}
+			}()
+		}
+		wg.Wait()
+	})
+
+	It("answers cached lookups without asking the Cloud Controller", func() {
+		c := start(context.Background(), BoltdbConfig{})
+		defer c.Stop()
+		client.addApp("late", nil)
+
+		app, known := c.CachedApp("app")
+		Expect(known).To(BeTrue())
+		Expect(app.SpaceName).To(Equal("dev"))
+		_, known = c.CachedApp("late")
+		Expect(known).To(BeFalse())
+		Expect(client.Calls("AppByGuid")).To(Equal(0))
+
+		_, err := c.GetApp("late")
+		Expect(err).ToNot(HaveOccurred())
+		_, known = c.CachedApp("late")
+		Expect(known).To(BeTrue())
+	})
+})
+
+var _ = Describe("Boltdb refresh", func() {
+	var (
+		dir    string
+		path   string
+		client *fakeAppClient
+		base   = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "cache")
+		Expect(err).ToNot(HaveOccurred())
+		path = filepath.Join(dir, "cache.db")
+		client = newFakeAppClient()
+		for _, guid := range []string{"web", "gone"} {
+			client.addApp(guid, nil)
+			client.updateApp(guid, guid, base)
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	start := func(appClient AppClient, config BoltdbConfig) *Boltdb {
+		config.Path = path
+		c, err := NewBoltdb(appClient, &config)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(c.Start(context.Background())).To(Succeed())
+		return c
+	}
+
+	names := func(c *Boltdb) map[string]string {
+		apps, err := c.GetAllApps()
+		Expect(err).ToNot(HaveOccurred())
+		names := map[string]string{}
+		for guid, app := range apps {
+			names[guid] = app.Name
+		}
+		return names
+	}
+
+	It("fetches only the apps changed since the last sync", func() {
+		c := start(fakeChangesClient{client}, BoltdbConfig{AppCacheTTL: 20 * time.Millisecond, OrgSpaceCacheTTL: time.Hour})
+		client.updateApp("web", "renamed", base.Add(time.Hour))
+		client.deleteApp("gone", base.Add(time.Hour))
+
+		Eventually(func() map[string]string { return names(c) }).Should(Equal(map[string]string{"web": "renamed"}))
+		Expect(client.Calls("ListApps")).To(Equal(1))
+		Expect(client.Calls("AppsUpdatedSince")).To(BeNumerically(">", 0))
+		Expect(c.Stop()).To(Succeed())
+
+		By("catching up from the stored watermark when it starts again")
+		client.updateApp("web", "again", base.Add(2*time.Hour))
+		c = start(fakeChangesClient{client}, BoltdbConfig{})
+		defer c.Stop()
+		Expect(names(c)).To(Equal(map[string]string{"web": "again"}))
+		Expect(client.Calls("ListApps")).To(Equal(1))
+	})
+
+	It("fetches every app again once per org and space TTL to pick up renamed orgs", func() {
+		c := start(fakeChangesClient{client}, BoltdbConfig{AppCacheTTL: 10 * time.Millisecond, OrgSpaceCacheTTL: 100 * time.Millisecond})
+		defer c.Stop()
+		orgName := func() string {
+			apps, err := c.GetAllApps()
+			Expect(err).ToNot(HaveOccurred())
+			return apps["web"].OrgName
+		}
+		Expect(orgName()).To(Equal("acme"))
+
+		client.renameOrg("org-guid", "renamed")
+		Eventually(orgName).Should(Equal("renamed"))
+		Expect(client.Calls("AppsUpdatedSince")).To(BeNumerically(">", 0))
+		Expect(client.Calls("ListApps")).To(BeNumerically(">", 1))
+	})
+
+	It("fetches only the changes with the default org and space TTL", func() {
+		c := start(fakeChangesClient{client}, BoltdbConfig{AppCacheTTL: 10 * time.Millisecond})
+		defer c.Stop()
+
+		Eventually(func() int { return client.Calls("AppsUpdatedSince") }).Should(BeNumerically(">", 3))
+		Expect(client.Calls("ListApps")).To(Equal(1))
+	})
+
+	It("keeps only the latest updated apps of a sync with an app limit", func() {
+		c := start(fakeChangesClient{client}, BoltdbConfig{AppCacheTTL: 10 * time.Millisecond, OrgSpaceCacheTTL: time.Hour, AppLimits: 1})
+		client.updateApp("web", "web", base.Add(time.Hour))
+		client.updateApp("gone", "latest", base.Add(2*time.Hour))
+
+		Eventually(func() map[string]string { return names(c) }).Should(Equal(map[string]string{"gone": "latest"}))
+		Expect(c.Stop()).To(Succeed())
+
+		By("forgetting the others in the Bolt DB too")
+		c = start(fakeChangesClient{client}, BoltdbConfig{OrgSpaceCacheTTL: time.Hour, AppLimits: 1})
+		defer c.Stop()
+		Expect(names(c)).To(Equal(map[string]string{"gone": "latest"}))
+	})
+
+	It("fetches every app without a watermark", func() {
+		client = newFakeAppClient()
+		client.addApp("web", nil)
+		c := start(fakeChangesClient{client}, BoltdbConfig{AppCacheTTL: 10 * time.Millisecond})
+		defer c.Stop()
+
+		Eventually(func() int { return client.Calls("ListApps") }).Should(BeNumerically(">", 1))
+		Expect(client.Calls("AppsUpdatedSince")).To(Equal(0))
+	})
+
+	It("deletes apps missing from a full listing from the Bolt DB", func() {
+		c := start(client, BoltdbConfig{AppCacheTTL: 10 * time.Millisecond})
+		client.deleteApp("gone", base.Add(time.Hour))
+
+		Eventually(func() map[string]string { return names(c) }).Should(Equal(map[string]string{"web": "web"}))
+		Expect(c.Stop()).To(Succeed())
+
+		listed := client.Calls("ListApps")
+		c = start(client, BoltdbConfig{})
+		defer c.Stop()
+		Expect(names(c)).To(Equal(map[string]string{"web": "web"}))
+		Expect(client.Calls("ListApps")).To(Equal(listed))
+	})
+})
@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"context"
 	"net/url"
 
 	cfclient "github.com/cloudfoundry-community/go-cfclient"
@@ -14,14 +15,28 @@ type App struct {
 	OrgName    string
 	OrgGuid    string
 	CfAppEnv   map[string]interface{}
+	Labels     map[string]string
 	IgnoredApp bool
 }
 
+// Cache holds the metadata of apps. Its owner calls Start before the first
+// lookup and Stop when it is done with it.
 type Cache interface {
-	Open() error
-	Close() error
+	// Start fills the cache and keeps it fresh until ctx is done or Stop
+	// is called. When the Cloud Controller cannot be listed, Start does not
+	// fail: the cache answers lookups app by app and keeps retrying to fill
+	// itself.
+	Start(ctx context.Context) error
+	// Populated reports whether the cache was filled.
+	Populated() bool
+	// Stop releases the cache's resources. It may be called more than once.
+	Stop() error
 	GetAllApps() (map[string]*App, error)
 	GetApp(string) (*App, error)
+	// CachedApp returns the app without asking the Cloud Controller. known
+	// is false when only GetApp can tell; a nil app that is known is a
+	// missing app being ignored.
+	CachedApp(appGuid string) (app *App, known bool)
 }
 
 type AppClient interface {
@@ -75,6 +75,26 @@ func easyjsonA591d1bcDecodeGithubComBoshLokiLokiFirehoseNozzleCaching(in *jlexer
 				}
 				in.Delim('}')
 			}
+		case "Labels":
+			if in.IsNull() {
+				in.Skip()
+			} else {
+				in.Delim('{')
+				if !in.IsDelim('}') {
+					out.Labels = make(map[string]string)
+				} else {
+					out.Labels = nil
+				}
+				for !in.IsDelim('}') {
+					key := string(in.String())
+					in.WantColon()
+					var v2 string
+					v2 = string(in.String())
+					(out.Labels)[key] = v2
+					in.WantComma()
+				}
+				in.Delim('}')
+			}
 		case "IgnoredApp":
 			out.IgnoredApp = bool(in.Bool())
 		default:
@@ -163,22 +183,48 @@ func easyjsonA591d1bcEncodeGithubComBoshLokiLokiFirehoseNozzleCaching(out *jwrit
 			out.RawString(`null`)
 		} else {
 			out.RawByte('{')
-			v2First := true
-			for v2Name, v2Value := range in.CfAppEnv {
-				if v2First {
-					v2First = false
+			v3First := true
+			for v3Name, v3Value := range in.CfAppEnv {
+				if v3First {
+					v3First = false
 				} else {
 					out.RawByte(',')
 				}
-				out.String(string(v2Name))
+				out.String(string(v3Name))
 				out.RawByte(':')
-				if m, ok := v2Value.(easyjson.Marshaler); ok {
+				if m, ok := v3Value.(easyjson.Marshaler); ok {
 					m.MarshalEasyJSON(out)
-				} else if m, ok := v2Value.(json.Marshaler); ok {
+				} else if m, ok := v3Value.(json.Marshaler); ok {
 					out.Raw(m.MarshalJSON())
 				} else {
-					out.Raw(json.Marshal(v2Value))
+					out.Raw(json.Marshal(v3Value))
+				}
+			}
+			out.RawByte('}')
+		}
+	}
+	{
+		const prefix string = ",\"Labels\":"
+		if first {
+			first = false
+			out.RawString(prefix[1:])
+		} else {
+			out.RawString(prefix)
+		}
+		if in.Labels == nil && (out.Flags&jwriter.NilMapAsEmpty) == 0 {
+			out.RawString(`null`)
+		} else {
+			out.RawByte('{')
+			v4First := true
+			for v4Name, v4Value := range in.Labels {
+				if v4First {
+					v4First = false
+				} else {
+					out.RawByte(',')
 				}
+				out.String(string(v4Name))
+				out.RawByte(':')
+				out.String(string(v4Value))
 			}
 			out.RawByte('}')
 		}
@@ -0,0 +1,172 @@
+package cache_test
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	. "github.com/bosh-loki/loki-firehose-nozzle/cache"
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+)
+
+// fakeAppClient serves apps, spaces and orgs from memory and counts calls.
+type fakeAppClient struct {
+	lock     sync.Mutex
+	apps     map[string]cfclient.App
+	spaces   map[string]cfclient.Space
+	orgs     map[string]cfclient.Org
+	metadata map[string]Metadata
+	calls    map[string]int
+
+	metadataErr error
+	listErr     error
+
+	deletions []AppDeletion
+}
+
+func newFakeAppClient() *fakeAppClient {
+	return &fakeAppClient{
+		apps:     map[string]cfclient.App{},
+		spaces:   map[string]cfclient.Space{"space-guid": {Name: "dev", OrganizationGuid: "org-guid"}},
+		orgs:     map[string]cfclient.Org{"org-guid": {Name: "acme"}},
+		metadata: map[string]Metadata{},
+		calls:    map[string]int{},
+	}
+}
+
+func (f *fakeAppClient) addApp(guid string, env map[string]interface{}) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.apps[guid] = cfclient.App{Guid: guid, Name: guid, SpaceGuid: "space-guid", Environment: env}
+}
+
+func (f *fakeAppClient) renameApp(guid, name string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	app := f.apps[guid]
+	app.Name = name
+	f.apps[guid] = app
+}
+
+// renameOrg renames the org; its apps are not updated.
+func (f *fakeAppClient) renameOrg(guid, name string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	org := f.orgs[guid]
+	org.Name = name
+	f.orgs[guid] = org
+}
+
+// updateApp renames the app as of at.
+func (f *fakeAppClient) updateApp(guid, name string, at time.Time) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	app := f.apps[guid]
+	app.Name = name
+	app.UpdatedAt = at.UTC().Format(time.RFC3339)
+	f.apps[guid] = app
+}
+
+// deleteApp deletes the app as of at.
+func (f *fakeAppClient) deleteApp(guid string, at time.Time) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	delete(f.apps, guid)
+	f.deletions = append(f.deletions, AppDeletion{Guid: guid, At: at})
+}
+
+// failListing makes app listings fail with err, or succeed again when it
+// is nil.
+func (f *fakeAppClient) failListing(err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.listErr = err
+}
+
+func (f *fakeAppClient) Calls(call string) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.calls[call]
+}
+
+func (f *fakeAppClient) AppByGuid(guid string) (cfclient.App, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.calls["AppByGuid"]++
+	app, ok := f.apps[guid]
+	if !ok {
+		return cfclient.App{}, fmt.Errorf("app %s not found", guid)
+	}
+	return app, nil
+}
+
+func (f *fakeAppClient) ListApps() ([]cfclient.App, error) {
+	return f.ListAppsByQueryWithLimits(nil, 0)
+}
+
+func (f *fakeAppClient) ListAppsByQueryWithLimits(url.Values, int) ([]cfclient.App, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.calls["ListApps"]++
+	if f.listErr != nil {
+		return nil, f.listErr
+	}
+	var apps []cfclient.App
+	for _, app := range f.apps {
+		apps = append(apps, app)
+	}
+	return apps, nil
+}
+
+func (f *fakeAppClient) GetSpaceByGuid(guid string) (cfclient.Space, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.spaces[guid], nil
+}
+
+func (f *fakeAppClient) GetOrgByGuid(guid string) (cfclient.Org, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.orgs[guid], nil
+}
+
+func (f *fakeAppClient) AppMetadata(guid string) (Metadata, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.metadataErr != nil {
+		return Metadata{}, f.metadataErr
+	}
+	return f.metadata[guid], nil
+}
+
+// fakeChangesClient is a fakeAppClient that lists changes too.
+type fakeChangesClient struct {
+	*fakeAppClient
+}
+
+func (f fakeChangesClient) AppsUpdatedSince(since time.Time) ([]cfclient.App, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.calls["AppsUpdatedSince"]++
+	var apps []cfclient.App
+	for _, app := range f.apps {
+		if at, err := time.Parse(time.RFC3339, app.UpdatedAt); err == nil && at.After(since) {
+			apps = append(apps, app)
+		}
+	}
+	return apps, nil
+}
+
+func (f fakeChangesClient) AppsDeletedSince(since time.Time) ([]AppDeletion, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.calls["AppsDeletedSince"]++
+	var deletions []AppDeletion
+	for _, d := range f.deletions {
+		if d.At.After(since) {
+			deletions = append(deletions, d)
+		}
+	}
+	return deletions, nil
+}
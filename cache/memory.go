@@ -0,0 +1,292 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// Defaults of the in-memory cache.
+const (
+	DefaultMemoryCacheSize    = 10000
+	DefaultMissingAppCacheTTL = time.Minute
+)
+
+// Memory is a size-bounded, least recently used app cache for deployments
+// without a persistent disk. Apps expire after AppCacheTTL and are then
+// fetched again on their next lookup; every AppCacheTTL the cached apps are
+// also refreshed from a single listing. Apps that could not be fetched are
+// not asked for again for MissingAppCacheTTL. A zero AppCacheTTL disables
+// expiry and refresh, like for Boltdb.
+type Memory struct {
+	*resolver
+
+	size       int
+	missingTTL time.Duration
+
+	lock      sync.Mutex
+	lru       *list.List               // of *memoryEntry, most recent first
+	entries   map[string]*list.Element // by app GUID
+	missing   map[string]time.Time     // app GUID -> when it was found missing
+	populated bool
+
+	closing  chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+type memoryEntry struct {
+	app     *App
+	fetched time.Time
+}
+
+// NewMemory returns an in-memory cache reading apps with client. The Path of
+// config is not used; MaxApps bounds the cache and defaults to
+// DefaultMemoryCacheSize.
+func NewMemory(client AppClient, config *BoltdbConfig) *Memory {
+	size := config.MaxApps
+	if size <= 0 {
+		size = DefaultMemoryCacheSize
+	}
+	missingTTL := config.MissingAppCacheTTL
+	if missingTTL <= 0 {
+		missingTTL = DefaultMissingAppCacheTTL
+	}
+	return &Memory{
+		resolver:   newResolver(client, config),
+		size:       size,
+		missingTTL: missingTTL,
+		lru:        list.New(),
+		entries:    map[string]*list.Element{},
+		missing:    map[string]time.Time{},
+		closing:    make(chan struct{}),
+	}
+}
+
+// Start fills the cache with the most recently updated apps and refreshes
+// it until ctx is done or Stop is called.
+func (c *Memory) Start(ctx context.Context) error {
+	if err := c.refresh(); err != nil {
+		log.Error("Unable to populate app cache, will retry: ", err)
+		c.wg.Add(1)
+		go c.retryPopulate(ctx)
+	} else if c.config.AppCacheTTL > 0 {
+		c.wg.Add(1)
+		go c.refreshEvery(ctx, c.config.AppCacheTTL)
+	}
+	return nil
+}
+
+// Populated reports whether a listing filled the cache.
+func (c *Memory) Populated() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.populated
+}
+
+// retryPopulate retries filling the cache until it succeeds, then starts
+// refreshing it.
+func (c *Memory) retryPopulate(ctx context.Context) {
+	defer c.wg.Done()
+	ticker := time.NewTicker(c.populateRetryInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.refresh(); err != nil {
+				log.Error("Unable to populate app cache, will retry: ", err)
+				continue
+			}
+			if c.config.AppCacheTTL > 0 {
+				c.wg.Add(1)
+				go c.refreshEvery(ctx, c.config.AppCacheTTL)
+			}
+			return
+		case <-ctx.Done():
+			return
+		case <-c.closing:
+			return
+		}
+	}
+}
+
+// Stop stops refreshing the cache. It may be called more than once.
+func (c *Memory) Stop() error {
+	c.stopOnce.Do(func() {
+		close(c.closing)
+		c.wg.Wait()
+	})
+	return nil
+}
+
+// GetApp returns the cached app, fetching it when it is not cached or
+// expired. Apps that could not be fetched recently return
+// MissingAndIgnoredErr.
+func (c *Memory) GetApp(appGuid string) (*App, error) {
+	now := time.Now()
+	c.lock.Lock()
+	app, known := c.cached(appGuid, now)
+	c.lock.Unlock()
+	if known {
+		if app == nil {
+			return nil, MissingAndIgnoredErr
+		}
+		return app, nil
+	}
+	appLookups.WithLabelValues("miss").Inc()
+
+	cfApp, err := c.appClient.AppByGuid(appGuid)
+	if observeCFAPI("get_app", err) == nil {
+		app, err = c.fromPCFApp(&cfApp)
+	}
+	if err != nil {
+		c.lock.Lock()
+		if len(c.missing) >= c.size {
+			c.missing = map[string]time.Time{}
+		}
+		c.missing[appGuid] = now
+		c.lock.Unlock()
+		return nil, err
+	}
+
+	c.lock.Lock()
+	c.add(app, now)
+	c.lock.Unlock()
+	dup := *app
+	return &dup, nil
+}
+
+// CachedApp returns the app when it is cached and not expired, or a nil app
+// when it could not be fetched recently.
+func (c *Memory) CachedApp(appGuid string) (*App, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.cached(appGuid, time.Now())
+}
+
+// cached returns a copy of the cached app; a nil app that is known could
+// not be fetched recently. c.lock must be held.
+func (c *Memory) cached(appGuid string, now time.Time) (*App, bool) {
+	if el, ok := c.entries[appGuid]; ok {
+		entry := el.Value.(*memoryEntry)
+		if c.config.AppCacheTTL <= 0 || now.Sub(entry.fetched) < c.config.AppCacheTTL {
+			c.lru.MoveToFront(el)
+			app := *entry.app
+			appLookups.WithLabelValues("hit").Inc()
+			return &app, true
+		}
+	}
+	if at, ok := c.missing[appGuid]; ok {
+		if now.Sub(at) < c.missingTTL {
+			appLookups.WithLabelValues("ignored").Inc()
+			return nil, true
+		}
+		delete(c.missing, appGuid)
+	}
+	return nil, false
+}
+
+// GetAllApps returns every cached app.
+func (c *Memory) GetAllApps() (map[string]*App, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	apps := make(map[string]*App, len(c.entries))
+	for guid, el := range c.entries {
+		dup := *el.Value.(*memoryEntry).app
+		apps[guid] = &dup
+	}
+	return apps, nil
+}
+
+// add caches app, evicting the least recently used apps beyond the size.
+// c.lock must be held.
+func (c *Memory) add(app *App, fetched time.Time) {
+	delete(c.missing, app.Guid)
+	if el, ok := c.entries[app.Guid]; ok {
+		el.Value = &memoryEntry{app: app, fetched: fetched}
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[app.Guid] = c.lru.PushFront(&memoryEntry{app: app, fetched: fetched})
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*memoryEntry).app.Guid)
+	}
+}
+
+func (c *Memory) refreshEvery(ctx context.Context, interval time.Duration) {
+	defer c.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	orgSpaceTicker := time.NewTicker(c.orgSpaceInterval())
+	defer orgSpaceTicker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.refresh(); err != nil {
+				log.Error("Unable to refresh app cache from remote: ", err)
+			}
+		case <-orgSpaceTicker.C:
+			c.resetOrgsAndSpaces()
+		case <-ctx.Done():
+			return
+		case <-c.closing:
+			return
+		}
+	}
+}
+
+// refresh lists the most recently updated apps, up to the cache size, and
+// caches them. Apps that are cached already stay where they are in the LRU
+// order; new ones are added behind them.
+func (c *Memory) refresh() error {
+	log.Info("Retrieving apps from remote")
+	q := url.Values{}
+	q.Set("inline-relations-depth", "0")
+	q.Set("order-direction", "desc")
+	q.Set("results-per-page", "100")
+	limit := c.size
+	if c.config.AppLimits > 0 && c.config.AppLimits < limit {
+		limit = c.config.AppLimits
+	}
+	cfApps, err := c.appClient.ListAppsByQueryWithLimits(q, limit/100+1)
+	if observeCFAPI("list_apps", err) != nil {
+		return err
+	}
+	if len(cfApps) > limit {
+		cfApps = cfApps[:limit]
+	}
+
+	now := time.Now()
+	apps := make([]*App, 0, len(cfApps))
+	for i := range cfApps {
+		app, err := c.fromPCFApp(&cfApps[i])
+		if err != nil {
+			return err
+		}
+		apps = append(apps, app)
+	}
+
+	c.lock.Lock()
+	for _, app := range apps {
+		delete(c.missing, app.Guid)
+		if el, ok := c.entries[app.Guid]; ok {
+			el.Value = &memoryEntry{app: app, fetched: now}
+			continue
+		}
+		if c.lru.Len() < c.size {
+			c.entries[app.Guid] = c.lru.PushBack(&memoryEntry{app: app, fetched: now})
+		}
+	}
+	c.populated = true
+	c.lock.Unlock()
+
+	log.Info(fmt.Sprintf("Found %d apps", len(apps)))
+	return nil
+}
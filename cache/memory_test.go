@@ -0,0 +1,172 @@
+package cache_test
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	. "github.com/bosh-loki/loki-firehose-nozzle/cache"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Memory", func() {
+	var client *fakeAppClient
+
+	BeforeEach(func() {
+		client = newFakeAppClient()
+	})
+
+	open := func(config BoltdbConfig) *Memory {
+		c := NewMemory(client, &config)
+		Expect(c.Start(context.Background())).To(Succeed())
+		return c
+	}
+
+	It("fills org and space names from the initial listing", func() {
+		client.addApp("app", nil)
+		c := open(BoltdbConfig{})
+		defer c.Stop()
+
+		app, err := c.GetApp("app")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(app.Name).To(Equal("app"))
+		Expect(app.SpaceName).To(Equal("dev"))
+		Expect(app.OrgName).To(Equal("acme"))
+		Expect(client.Calls("AppByGuid")).To(Equal(0))
+	})
+
+	It("keeps retrying to fill itself when the first listing fails", func() {
+		client.addApp("app", nil)
+		client.failListing(errors.New("cloud controller unavailable"))
+		c := open(BoltdbConfig{PopulateRetryInterval: 10 * time.Millisecond})
+		defer c.Stop()
+		Expect(c.Populated()).To(BeFalse())
+
+		app, err := c.GetApp("app")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(app.OrgName).To(Equal("acme"))
+
+		client.failListing(nil)
+		Eventually(c.Populated).Should(BeTrue())
+	})
+
+	It("fetches apps it has not seen and caches them", func() {
+		c := open(BoltdbConfig{})
+		defer c.Stop()
+		client.addApp("late", nil)
+
+		for i := 0; i < 3; i++ {
+			app, err := c.GetApp("late")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(app.OrgName).To(Equal("acme"))
+		}
+		Expect(client.Calls("AppByGuid")).To(Equal(1))
+	})
+
+	It("remembers missing apps for the missing app TTL", func() {
+		c := open(BoltdbConfig{MissingAppCacheTTL: 50 * time.Millisecond})
+		defer c.Stop()
+
+		_, err := c.GetApp("ghost")
+		Expect(err).To(HaveOccurred())
+		_, err = c.GetApp("ghost")
+		Expect(err).To(Equal(MissingAndIgnoredErr))
+		Expect(client.Calls("AppByGuid")).To(Equal(1))
+
+		client.addApp("ghost", nil)
+		Eventually(func() error {
+			_, err := c.GetApp("ghost")
+			return err
+		}).Should(Succeed())
+		Expect(client.Calls("AppByGuid")).To(Equal(2))
+	})
+
+	It("evicts the least recently used apps beyond its size", func() {
+		c := open(BoltdbConfig{MaxApps: 2})
+		defer c.Stop()
+		for _, guid := range []string{"a", "b", "c"} {
+			client.addApp(guid, nil)
+		}
+
+		for _, guid := range []string{"a", "b", "a", "c"} {
+			_, err := c.GetApp(guid)
+			Expect(err).ToNot(HaveOccurred())
+		}
+		apps, err := c.GetAllApps()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(apps).To(HaveLen(2))
+		Expect(apps).To(HaveKey("a"))
+		Expect(apps).To(HaveKey("c"))
+	})
+
+	It("fetches expired apps again", func() {
+		client.addApp("app", nil)
+		c := NewMemory(client, &BoltdbConfig{AppCacheTTL: 20 * time.Millisecond})
+		Expect(c.Start(context.Background())).To(Succeed())
+		defer c.Stop()
+
+		client.renameApp("app", "renamed")
+		Eventually(func() string {
+			app, err := c.GetApp("app")
+			Expect(err).ToNot(HaveOccurred())
+			return app.Name
+		}).Should(Equal("renamed"))
+	})
+
+	It("refreshes cached apps periodically", func() {
+		client.addApp("app", nil)
+		c := open(BoltdbConfig{AppCacheTTL: 20 * time.Millisecond})
+		defer c.Stop()
+
+		client.renameApp("app", "renamed")
+		Eventually(func() string {
+			apps, _ := c.GetAllApps()
+			return apps["app"].Name
+		}).Should(Equal("renamed"))
+		Expect(client.Calls("ListApps")).To(BeNumerically(">", 1))
+	})
+
+	It("applies the opt-out policy", func() {
+		client.addApp("quiet", map[string]interface{}{"F2S_DISABLE_LOGGING": "true"})
+		c := open(BoltdbConfig{})
+		defer c.Stop()
+
+		app, err := c.GetApp("quiet")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(app.IgnoredApp).To(BeTrue())
+	})
+
+	It("stops refreshing once its context is done", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		c := NewMemory(client, &BoltdbConfig{AppCacheTTL: 10 * time.Millisecond})
+		Expect(c.Start(ctx)).To(Succeed())
+		cancel()
+
+		time.Sleep(30 * time.Millisecond)
+		listed := client.Calls("ListApps")
+		Consistently(func() int { return client.Calls("ListApps") }, 50*time.Millisecond).Should(Equal(listed))
+		Expect(c.Stop()).To(Succeed())
+		Expect(c.Stop()).To(Succeed())
+	})
+
+	It("answers cached lookups without asking the Cloud Controller", func() {
+		client.addApp("app", nil)
+		c := open(BoltdbConfig{})
+		defer c.Stop()
+		client.addApp("late", nil)
+
+		app, known := c.CachedApp("app")
+		Expect(known).To(BeTrue())
+		Expect(app.OrgName).To(Equal("acme"))
+		_, known = c.CachedApp("late")
+		Expect(known).To(BeFalse())
+		Expect(client.Calls("AppByGuid")).To(Equal(0))
+
+		_, err := c.GetApp("ghost")
+		Expect(err).To(HaveOccurred())
+		app, known = c.CachedApp("ghost")
+		Expect(known).To(BeTrue())
+		Expect(app).To(BeNil())
+	})
+})
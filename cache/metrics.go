@@ -0,0 +1,30 @@
+package cache
+
+import (
+	"github.com/bosh-loki/loki-firehose-nozzle/metrics"
+)
+
+var (
+	appLookups = metrics.NewCounterVec(
+		"loki_nozzle_app_cache_lookups_total",
+		"App metadata lookups by result: hit, miss or ignored (a known missing app).",
+		"result")
+	cfAPIRequests = metrics.NewCounterVec(
+		"loki_nozzle_cf_api_requests_total",
+		"Cloud Controller requests made to fill the app cache, by call and outcome.",
+		"call", "outcome")
+)
+
+func init() {
+	metrics.MustRegister(appLookups, cfAPIRequests)
+}
+
+// observeCFAPI counts a Cloud Controller call and passes err through.
+func observeCFAPI(call string, err error) error {
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+	cfAPIRequests.WithLabelValues(call, outcome).Inc()
+	return err
+}
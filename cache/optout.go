@@ -0,0 +1,75 @@
+package cache
+
+import (
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+)
+
+// DefaultOptOutEnvVar is the app environment variable that opts an app out
+// of logging when set to "true" and no other name is configured.
+const DefaultOptOutEnvVar = "F2S_DISABLE_LOGGING"
+
+// OptOutPolicy decides which apps have their logs dropped by the nozzle.
+// An app opts out when any of the following holds:
+//   - its environment variable EnvVar is "true";
+//   - its CF v3 metadata label Label is "true";
+//   - its org or space is listed, by name or GUID, in Orgs or Spaces.
+type OptOutPolicy struct {
+	// EnvVar defaults to DefaultOptOutEnvVar.
+	EnvVar string
+	// Label is only read when set, and only when the AppClient is also a
+	// MetadataClient such as V3Client.
+	Label  string
+	Orgs   []string
+	Spaces []string
+}
+
+func (p OptOutPolicy) envVar() string {
+	if p.EnvVar == "" {
+		return DefaultOptOutEnvVar
+	}
+	return p.EnvVar
+}
+
+// OptedOut reports whether app, running with the environment env, opts out.
+func (p OptOutPolicy) OptedOut(app *App, env map[string]interface{}) bool {
+	if val, ok := env[p.envVar()]; ok && val == "true" {
+		return true
+	}
+	if p.Label != "" && app.Labels[p.Label] == "true" {
+		return true
+	}
+	return listed(p.Orgs, app.OrgName, app.OrgGuid) || listed(p.Spaces, app.SpaceName, app.SpaceGuid)
+}
+
+func listed(list []string, name, guid string) bool {
+	for _, l := range list {
+		if l != "" && (l == name || l == guid) {
+			return true
+		}
+	}
+	return false
+}
+
+// Metadata is the CF v3 metadata of a resource.
+type Metadata struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// MetadataClient is implemented by AppClients that can read CF v3 metadata.
+type MetadataClient interface {
+	AppMetadata(appGuid string) (Metadata, error)
+}
+
+// EnvironmentClient is implemented by AppClients whose apps do not carry
+// their environment variables.
+type EnvironmentClient interface {
+	AppEnvironment(app cfclient.App) (map[string]interface{}, error)
+}
+
+// CFClient is the AppClient backed by the v2 Cloud Controller API. It does
+// not read metadata, which would take a request per app; apps are read with
+// V3Client when their labels are needed.
+type CFClient struct {
+	*cfclient.Client
+}
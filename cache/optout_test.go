@@ -0,0 +1,108 @@
+package cache_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/bosh-loki/loki-firehose-nozzle/cache"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("OptOutPolicy", func() {
+	var (
+		dir    string
+		client *fakeAppClient
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "cache")
+		Expect(err).ToNot(HaveOccurred())
+		client = newFakeAppClient()
+		client.addApp("seed", nil)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	ignored := func(policy OptOutPolicy, guid string) bool {
+		c, err := NewBoltdb(client, &BoltdbConfig{Path: filepath.Join(dir, "cache.db"), OptOut: policy})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(c.Start(context.Background())).To(Succeed())
+		defer c.Stop()
+		app, err := c.GetApp(guid)
+		Expect(err).ToNot(HaveOccurred())
+		return app.IgnoredApp
+	}
+
+	It("honors the default environment variable", func() {
+		client.addApp("quiet", map[string]interface{}{"F2S_DISABLE_LOGGING": "true"})
+		client.addApp("loud", map[string]interface{}{"F2S_DISABLE_LOGGING": "false"})
+		Expect(ignored(OptOutPolicy{}, "quiet")).To(BeTrue())
+		Expect(ignored(OptOutPolicy{}, "loud")).To(BeFalse())
+	})
+
+	It("honors a configured environment variable instead of the default", func() {
+		client.addApp("quiet", map[string]interface{}{"NO_LOGS": "true"})
+		client.addApp("default", map[string]interface{}{"F2S_DISABLE_LOGGING": "true"})
+		policy := OptOutPolicy{EnvVar: "NO_LOGS"}
+		Expect(ignored(policy, "quiet")).To(BeTrue())
+		Expect(ignored(policy, "default")).To(BeFalse())
+	})
+
+	It("honors a metadata label when configured", func() {
+		client.addApp("quiet", nil)
+		client.metadata["quiet"] = Metadata{Labels: map[string]string{"no-logs": "true"}}
+		Expect(ignored(OptOutPolicy{}, "quiet")).To(BeFalse())
+		Expect(ignored(OptOutPolicy{Label: "no-logs"}, "quiet")).To(BeTrue())
+	})
+
+	It("does not cache apps whose opt-out label could not be read", func() {
+		c, err := NewBoltdb(client, &BoltdbConfig{Path: filepath.Join(dir, "cache.db"), OptOut: OptOutPolicy{Label: "no-logs"}})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(c.Start(context.Background())).To(Succeed())
+		defer c.Stop()
+
+		client.addApp("quiet", nil)
+		client.metadataErr = errors.New("metadata unavailable")
+		_, err = c.GetApp("quiet")
+		Expect(err).To(MatchError("metadata unavailable"))
+		_, known := c.CachedApp("quiet")
+		Expect(known).To(BeFalse())
+	})
+
+	It("opts out every app of a listed org or space", func() {
+		client.addApp("app", nil)
+		Expect(ignored(OptOutPolicy{Orgs: []string{"acme"}}, "app")).To(BeTrue())
+		Expect(ignored(OptOutPolicy{Orgs: []string{"org-guid"}}, "app")).To(BeTrue())
+		Expect(ignored(OptOutPolicy{Spaces: []string{"dev"}}, "app")).To(BeTrue())
+		Expect(ignored(OptOutPolicy{Spaces: []string{"prod"}, Orgs: []string{""}}, "app")).To(BeFalse())
+	})
+})
+
+var _ = Describe("Boltdb app metadata", func() {
+	It("reads app labels when asked to", func() {
+		dir, err := ioutil.TempDir("", "cache")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		client := newFakeAppClient()
+		client.addApp("app", nil)
+		client.metadata["app"] = Metadata{Labels: map[string]string{"team": "payments"}}
+
+		c, err := NewBoltdb(client, &BoltdbConfig{Path: filepath.Join(dir, "cache.db"), AppMetadata: true})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(c.Start(context.Background())).To(Succeed())
+		defer c.Stop()
+
+		app, err := c.GetApp("app")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(app.Labels).To(Equal(map[string]string{"team": "payments"}))
+		Expect(app.IgnoredApp).To(BeFalse())
+	})
+})
@@ -0,0 +1,160 @@
+package cache
+
+import (
+	"sync"
+	"time"
+
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+	"github.com/prometheus/common/log"
+)
+
+// resolver turns CAPI apps into cached Apps, caching the names of their
+// spaces and orgs. It is shared by the cache implementations.
+type resolver struct {
+	appClient AppClient
+	config    *BoltdbConfig
+
+	orgSpaceLock   sync.RWMutex
+	orgNameCache   map[string]Org   // caches org guid->org name mapping
+	spaceNameCache map[string]Space // caches space guid->space name mapping
+}
+
+func newResolver(client AppClient, config *BoltdbConfig) *resolver {
+	return &resolver{
+		appClient:      client,
+		config:         config,
+		orgNameCache:   make(map[string]Org),
+		spaceNameCache: make(map[string]Space),
+	}
+}
+
+// orgSpaceInterval is how often cached org and space names are forgotten.
+func (c *resolver) orgSpaceInterval() time.Duration {
+	if c.config.OrgSpaceCacheTTL > 0 {
+		return c.config.OrgSpaceCacheTTL
+	}
+	return c.config.AppCacheTTL
+}
+
+// populateRetryInterval is how often a cache that could not be filled
+// retries.
+func (c *resolver) populateRetryInterval() time.Duration {
+	if c.config.PopulateRetryInterval > 0 {
+		return c.config.PopulateRetryInterval
+	}
+	return DefaultPopulateRetryInterval
+}
+
+// resetOrgsAndSpaces forgets every cached org and space name.
+func (c *resolver) resetOrgsAndSpaces() {
+	c.orgSpaceLock.Lock()
+	c.orgNameCache = make(map[string]Org)
+	c.spaceNameCache = make(map[string]Space)
+	c.orgSpaceLock.Unlock()
+}
+
+// fromPCFApp converts app, reading the names of its space and org and its
+// labels when they are not cached.
+func (c *resolver) fromPCFApp(app *cfclient.App) (*App, error) {
+	cachedApp := &App{
+		Name:      app.Name,
+		Guid:      app.Guid,
+		SpaceGuid: app.SpaceGuid,
+	}
+
+	if err := c.fillOrgAndSpace(cachedApp); err != nil {
+		return nil, err
+	}
+	if err := c.fillLabels(cachedApp); err != nil {
+		return nil, err
+	}
+	env, err := c.environment(app)
+	if err != nil {
+		return nil, err
+	}
+	cachedApp.IgnoredApp = c.config.OptOut.OptedOut(cachedApp, env)
+
+	return cachedApp, nil
+}
+
+func (c *resolver) fillOrgAndSpace(app *App) error {
+	now := time.Now()
+
+	c.orgSpaceLock.RLock()
+	space, ok := c.spaceNameCache[app.SpaceGuid]
+	c.orgSpaceLock.RUnlock()
+
+	if !ok || now.Sub(space.LastUpdated) > c.config.OrgSpaceCacheTTL {
+		cfspace, err := c.appClient.GetSpaceByGuid(app.SpaceGuid)
+		if observeCFAPI("get_space", err) != nil {
+			return err
+		}
+
+		space = Space{
+			Name:        cfspace.Name,
+			OrgGUID:     cfspace.OrganizationGuid,
+			LastUpdated: now,
+		}
+
+		c.orgSpaceLock.Lock()
+		c.spaceNameCache[app.SpaceGuid] = space
+		c.orgSpaceLock.Unlock()
+	}
+
+	app.SpaceName = space.Name
+	app.OrgGuid = space.OrgGUID
+
+	c.orgSpaceLock.RLock()
+	org, ok := c.orgNameCache[space.OrgGUID]
+	c.orgSpaceLock.RUnlock()
+	if !ok || now.Sub(org.LastUpdated) > c.config.OrgSpaceCacheTTL {
+		cforg, err := c.appClient.GetOrgByGuid(space.OrgGUID)
+		if observeCFAPI("get_org", err) != nil {
+			return err
+		}
+
+		org = Org{
+			Name:        cforg.Name,
+			LastUpdated: now,
+		}
+
+		c.orgSpaceLock.Lock()
+		c.orgNameCache[space.OrgGUID] = org
+		c.orgSpaceLock.Unlock()
+	}
+
+	app.OrgGuid = space.OrgGUID
+	app.OrgName = org.Name
+
+	return nil
+}
+
+// fillLabels reads the app's v3 metadata labels when they are needed.
+func (c *resolver) fillLabels(app *App) error {
+	mc, ok := c.appClient.(MetadataClient)
+	if !ok || (c.config.OptOut.Label == "" && !c.config.AppMetadata) {
+		return nil
+	}
+	metadata, err := mc.AppMetadata(app.Guid)
+	if observeCFAPI("get_app_metadata", err) != nil {
+		log.Errorf("Unable to read metadata of app %s: %v", app.Guid, err)
+		return err
+	}
+	app.Labels = metadata.Labels
+	return nil
+}
+
+// environment returns the app's environment variables, reading them when
+// the AppClient did not list them.
+func (c *resolver) environment(app *cfclient.App) (map[string]interface{}, error) {
+	ec, ok := c.appClient.(EnvironmentClient)
+	if !ok || app.Environment != nil {
+		return app.Environment, nil
+	}
+	env, err := ec.AppEnvironment(*app)
+	if observeCFAPI("get_app_environment", err) != nil {
+		log.Errorf("Unable to read environment of app %s: %v", app.Guid, err)
+		return nil, err
+	}
+	return env, nil
+}
@@ -0,0 +1,412 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sync"
+	"time"
+
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+)
+
+// Cloud Controller API versions an AppClient can be built on.
+const (
+	APIV2 = "v2"
+	APIV3 = "v3"
+)
+
+// v3PerPage is the page size of app listings that do not ask for one; it is
+// the largest the Cloud Controller allows.
+const v3PerPage = "5000"
+
+// NewAppClient returns the AppClient using version of the Cloud Controller
+// API; it defaults to APIV2.
+func NewAppClient(client *cfclient.Client, version string) (AppClient, error) {
+	switch version {
+	case "", APIV2:
+		return CFClient{Client: client}, nil
+	case APIV3:
+		return NewV3Client(client), nil
+	}
+	return nil, fmt.Errorf("unknown cloud controller API version %q", version)
+}
+
+// V3Client is the AppClient backed by the v3 Cloud Controller API. It lists
+// apps together with their spaces, orgs and metadata labels, and answers
+// the space, org and metadata lookups of the apps it returned from those
+// instead of asking the Cloud Controller once more per app.
+//
+// v3 apps do not carry their environment variables. It is an
+// EnvironmentClient that reads them once per app, and again only after the
+// app was updated; this needs a client allowed to read them, such as one
+// with the cloud_controller.admin_read_only scope.
+//
+// It is a ChangesClient: Boltdb refreshes only the apps updated or deleted
+// since its last refresh.
+type V3Client struct {
+	client *cfclient.Client
+
+	lock     sync.Mutex
+	spaces   map[string]cfclient.Space
+	orgs     map[string]cfclient.Org
+	metadata map[string]Metadata
+	envs     map[string]v3Environment
+}
+
+// v3Environment is the environment variables of an app as of its update
+// time.
+type v3Environment struct {
+	updatedAt string
+	vars      map[string]interface{}
+}
+
+func NewV3Client(client *cfclient.Client) *V3Client {
+	return &V3Client{
+		client:   client,
+		spaces:   map[string]cfclient.Space{},
+		orgs:     map[string]cfclient.Org{},
+		metadata: map[string]Metadata{},
+		envs:     map[string]v3Environment{},
+	}
+}
+
+type v3Relationship struct {
+	Data struct {
+		Guid string `json:"guid"`
+	} `json:"data"`
+}
+
+type v3App struct {
+	Guid          string `json:"guid"`
+	Name          string `json:"name"`
+	CreatedAt     string `json:"created_at"`
+	UpdatedAt     string `json:"updated_at"`
+	Relationships struct {
+		Space v3Relationship `json:"space"`
+	} `json:"relationships"`
+	Metadata Metadata `json:"metadata"`
+}
+
+type v3Space struct {
+	Guid          string `json:"guid"`
+	Name          string `json:"name"`
+	Relationships struct {
+		Organization v3Relationship `json:"organization"`
+	} `json:"relationships"`
+}
+
+type v3Org struct {
+	Guid string `json:"guid"`
+	Name string `json:"name"`
+}
+
+type v3Included struct {
+	Spaces        []v3Space `json:"spaces"`
+	Organizations []v3Org   `json:"organizations"`
+}
+
+type v3Pagination struct {
+	Pagination struct {
+		Next *cfclient.Link `json:"next"`
+	} `json:"pagination"`
+}
+
+func (p *v3Pagination) next() *cfclient.Link {
+	return p.Pagination.Next
+}
+
+type v3AppsPage struct {
+	v3Pagination
+	Resources []v3App    `json:"resources"`
+	Included  v3Included `json:"included"`
+}
+
+type v3AuditEventsPage struct {
+	v3Pagination
+	Resources []struct {
+		CreatedAt string `json:"created_at"`
+		Target    struct {
+			Guid string `json:"guid"`
+		} `json:"target"`
+	} `json:"resources"`
+}
+
+func (c *V3Client) AppByGuid(appGuid string) (cfclient.App, error) {
+	var app struct {
+		v3App
+		Included v3Included `json:"included"`
+	}
+	if err := c.get("/v3/apps/"+appGuid+"?include=space.organization", &app); err != nil {
+		return cfclient.App{}, err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.remember(app.Included)
+	return c.fromV3App(&app.v3App), nil
+}
+
+func (c *V3Client) ListApps() ([]cfclient.App, error) {
+	return c.ListAppsByQueryWithLimits(url.Values{}, 0)
+}
+
+// ListAppsByQueryWithLimits lists the apps matching query, reading at most
+// totalPages pages when it is positive. The v2 parameters the caches use
+// are translated: results-per-page to per_page and order-direction to an
+// order_by on the creation time. inline-relations-depth is dropped and
+// every other parameter is passed on as is.
+//
+// The listing replaces the spaces, orgs and metadata remembered from
+// earlier ones, so that renamed spaces and orgs are picked up and deleted
+// apps are forgotten.
+func (c *V3Client) ListAppsByQueryWithLimits(query url.Values, totalPages int) ([]cfclient.App, error) {
+	return c.listApps(query, totalPages, true)
+}
+
+// listApps lists apps as ListAppsByQueryWithLimits does. Unless replace is
+// set, what the listing includes is added to what earlier ones remembered.
+func (c *V3Client) listApps(query url.Values, totalPages int, replace bool) ([]cfclient.App, error) {
+	q := url.Values{}
+	for k, v := range query {
+		switch k {
+		case "inline-relations-depth":
+		case "results-per-page":
+			q["per_page"] = v
+		case "order-direction":
+			if query.Get(k) == "desc" {
+				q.Set("order_by", "-created_at")
+			} else {
+				q.Set("order_by", "created_at")
+			}
+		default:
+			q[k] = v
+		}
+	}
+	if q.Get("per_page") == "" {
+		q.Set("per_page", v3PerPage)
+	}
+	q.Set("include", "space.organization")
+
+	var resources []v3App
+	included := v3Included{}
+	err := c.getPages("/v3/apps?"+q.Encode(), totalPages, func() v3Page {
+		return &v3AppsPage{}
+	}, func(page v3Page) {
+		p := page.(*v3AppsPage)
+		resources = append(resources, p.Resources...)
+		included.Spaces = append(included.Spaces, p.Included.Spaces...)
+		included.Organizations = append(included.Organizations, p.Included.Organizations...)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if replace {
+		envs := map[string]v3Environment{}
+		for _, app := range resources {
+			if env, ok := c.envs[app.Guid]; ok {
+				envs[app.Guid] = env
+			}
+		}
+		c.spaces = map[string]cfclient.Space{}
+		c.orgs = map[string]cfclient.Org{}
+		c.metadata = map[string]Metadata{}
+		c.envs = envs
+	}
+	c.remember(included)
+	apps := make([]cfclient.App, 0, len(resources))
+	for i := range resources {
+		apps = append(apps, c.fromV3App(&resources[i]))
+	}
+	return apps, nil
+}
+
+// AppsUpdatedSince lists the apps created or updated after since. What it
+// remembered of the other apps is kept.
+func (c *V3Client) AppsUpdatedSince(since time.Time) ([]cfclient.App, error) {
+	q := url.Values{}
+	q.Set("updated_ats[gt]", since.UTC().Format(time.RFC3339))
+	return c.listApps(q, 0, false)
+}
+
+// AppsDeletedSince lists the apps deleted after since, from the audit
+// events of their deletion.
+func (c *V3Client) AppsDeletedSince(since time.Time) ([]AppDeletion, error) {
+	q := url.Values{}
+	q.Set("types", "audit.app.delete-request")
+	q.Set("created_ats[gt]", since.UTC().Format(time.RFC3339))
+	q.Set("per_page", v3PerPage)
+
+	var deletions []AppDeletion
+	var parseErr error
+	err := c.getPages("/v3/audit_events?"+q.Encode(), 0, func() v3Page {
+		return &v3AuditEventsPage{}
+	}, func(page v3Page) {
+		for _, e := range page.(*v3AuditEventsPage).Resources {
+			at, err := time.Parse(time.RFC3339, e.CreatedAt)
+			if err != nil {
+				parseErr = fmt.Errorf("Error parsing audit event time: %s", err)
+			}
+			deletions = append(deletions, AppDeletion{Guid: e.Target.Guid, At: at})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	return deletions, nil
+}
+
+func (c *V3Client) GetSpaceByGuid(spaceGUID string) (cfclient.Space, error) {
+	c.lock.Lock()
+	space, ok := c.spaces[spaceGUID]
+	c.lock.Unlock()
+	if ok {
+		return space, nil
+	}
+
+	var s v3Space
+	if err := c.get("/v3/spaces/"+spaceGUID, &s); err != nil {
+		return cfclient.Space{}, err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.remember(v3Included{Spaces: []v3Space{s}})
+	return c.spaces[spaceGUID], nil
+}
+
+func (c *V3Client) GetOrgByGuid(orgGUID string) (cfclient.Org, error) {
+	c.lock.Lock()
+	org, ok := c.orgs[orgGUID]
+	c.lock.Unlock()
+	if ok {
+		return org, nil
+	}
+
+	var o v3Org
+	if err := c.get("/v3/organizations/"+orgGUID, &o); err != nil {
+		return cfclient.Org{}, err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.remember(v3Included{Organizations: []v3Org{o}})
+	return c.orgs[orgGUID], nil
+}
+
+// AppMetadata returns the metadata of an app returned last, or reads it
+// when there is none.
+func (c *V3Client) AppMetadata(appGuid string) (Metadata, error) {
+	c.lock.Lock()
+	metadata, ok := c.metadata[appGuid]
+	delete(c.metadata, appGuid)
+	c.lock.Unlock()
+	if ok {
+		return metadata, nil
+	}
+
+	var app v3App
+	if err := c.get("/v3/apps/"+appGuid, &app); err != nil {
+		return Metadata{}, err
+	}
+	return app.Metadata, nil
+}
+
+// AppEnvironment returns the environment variables of app, reading them
+// unless they were read since it was last updated.
+func (c *V3Client) AppEnvironment(app cfclient.App) (map[string]interface{}, error) {
+	c.lock.Lock()
+	env, ok := c.envs[app.Guid]
+	c.lock.Unlock()
+	if ok && app.UpdatedAt != "" && env.updatedAt == app.UpdatedAt {
+		return env.vars, nil
+	}
+
+	var body struct {
+		Var map[string]interface{} `json:"var"`
+	}
+	if err := c.get("/v3/apps/"+app.Guid+"/environment_variables", &body); err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.envs[app.Guid] = v3Environment{updatedAt: app.UpdatedAt, vars: body.Var}
+	return body.Var, nil
+}
+
+// remember keeps the included spaces and orgs. c.lock must be held.
+func (c *V3Client) remember(included v3Included) {
+	for _, s := range included.Spaces {
+		c.spaces[s.Guid] = cfclient.Space{
+			Guid:             s.Guid,
+			Name:             s.Name,
+			OrganizationGuid: s.Relationships.Organization.Data.Guid,
+		}
+	}
+	for _, o := range included.Organizations {
+		c.orgs[o.Guid] = cfclient.Org{Guid: o.Guid, Name: o.Name}
+	}
+}
+
+// fromV3App converts app and keeps its metadata. c.lock must be held.
+func (c *V3Client) fromV3App(app *v3App) cfclient.App {
+	c.metadata[app.Guid] = app.Metadata
+	return cfclient.App{
+		Guid:      app.Guid,
+		Name:      app.Name,
+		CreatedAt: app.CreatedAt,
+		UpdatedAt: app.UpdatedAt,
+		SpaceGuid: app.Relationships.Space.Data.Guid,
+	}
+}
+
+// v3Page is a page of a v3 listing.
+type v3Page interface {
+	next() *cfclient.Link
+}
+
+// getPages reads the listing at path page by page, at most totalPages pages
+// when it is positive. Each page is read into a value of newPage and passed
+// to each.
+func (c *V3Client) getPages(path string, totalPages int, newPage func() v3Page, each func(v3Page)) error {
+	for page := 1; path != ""; page++ {
+		p := newPage()
+		if err := c.get(path, p); err != nil {
+			return err
+		}
+		each(p)
+
+		path = ""
+		if next := p.next(); next != nil && next.Href != "" && (totalPages <= 0 || page < totalPages) {
+			u, err := url.Parse(next.Href)
+			if err != nil {
+				return fmt.Errorf("Error parsing next page: %s", err)
+			}
+			path = u.RequestURI()
+		}
+	}
+	return nil
+}
+
+// get reads the JSON resource at path, relative to the API address, into
+// out.
+func (c *V3Client) get(path string, out interface{}) error {
+	resp, err := c.client.DoRequest(c.client.NewRequest("GET", path))
+	if err != nil {
+		return fmt.Errorf("Error requesting %s: %s", path, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("Error reading %s: %s", path, err)
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("Error unmarshalling %s: %s", path, err)
+	}
+	return nil
+}
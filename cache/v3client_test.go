@@ -0,0 +1,461 @@
+package cache_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/bosh-loki/loki-firehose-nozzle/cache"
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// fakeCAPI serves the v3 apps, app environment variables, spaces,
+// organizations and audit events endpoints from memory and records the requests it gets.
+type fakeCAPI struct {
+	server *httptest.Server
+
+	lock     sync.Mutex
+	apps     []map[string]interface{}
+	deleted  []map[string]interface{}
+	envs     map[string]map[string]interface{}
+	requests []*url.URL
+	auth     []string
+}
+
+func newFakeCAPI() *fakeCAPI {
+	f := &fakeCAPI{envs: map[string]map[string]interface{}{}}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+func (f *fakeCAPI) addApp(guid, spaceGuid string, labels map[string]string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.apps = append(f.apps, map[string]interface{}{
+		"guid": guid,
+		"name": guid,
+		"relationships": map[string]interface{}{
+			"space": relationship(spaceGuid),
+		},
+		"metadata": map[string]interface{}{"labels": labels},
+	})
+}
+
+// setEnv sets the environment variables of the app, updating it at.
+func (f *fakeCAPI) setEnv(guid string, env map[string]interface{}, at string) {
+	f.lock.Lock()
+	f.envs[guid] = env
+	f.lock.Unlock()
+	f.updateApp(guid, at)
+}
+
+// updateApp marks the app as updated at.
+func (f *fakeCAPI) updateApp(guid, at string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, app := range f.apps {
+		if app["guid"] == guid {
+			app["updated_at"] = at
+		}
+	}
+}
+
+func (f *fakeCAPI) deleteApp(guid, at string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.deleted = append(f.deleted, map[string]interface{}{
+		"type":       "audit.app.delete-request",
+		"created_at": at,
+		"target":     map[string]interface{}{"guid": guid, "type": "app"},
+	})
+}
+
+// Requests returns the paths of the v3 requests received, with their
+// queries.
+func (f *fakeCAPI) Requests() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var paths []string
+	for _, u := range f.requests {
+		if strings.HasPrefix(u.Path, "/v3/") {
+			paths = append(paths, u.RequestURI())
+		}
+	}
+	return paths
+}
+
+func relationship(guid string) map[string]interface{} {
+	return map[string]interface{}{"data": map[string]interface{}{"guid": guid}}
+}
+
+var (
+	fakeSpaces = map[string]map[string]interface{}{
+		"space-guid":  {"guid": "space-guid", "name": "dev", "relationships": map[string]interface{}{"organization": relationship("org-guid")}},
+		"other-space": {"guid": "other-space", "name": "prod", "relationships": map[string]interface{}{"organization": relationship("org-guid")}},
+	}
+	fakeOrgs = map[string]map[string]interface{}{
+		"org-guid": {"guid": "org-guid", "name": "acme"},
+	}
+)
+
+func (f *fakeCAPI) serve(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.requests = append(f.requests, r.URL)
+	f.auth = append(f.auth, r.Header.Get("Authorization"))
+
+	var body interface{}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.URL.Path == "/v2/info":
+		body = map[string]string{"token_endpoint": f.server.URL, "authorization_endpoint": f.server.URL}
+	case r.URL.Path == "/v3/apps":
+		body = f.appsPage(r.URL.Query())
+	case r.URL.Path == "/v3/audit_events":
+		body = f.auditEventsPage(r.URL.Query())
+	case len(parts) == 3 && parts[1] == "apps":
+		for _, app := range f.apps {
+			if app["guid"] == parts[2] {
+				body = f.withIncluded(app, []map[string]interface{}{app}, r.URL.Query())
+			}
+		}
+	case len(parts) == 4 && parts[1] == "apps" && parts[3] == "environment_variables":
+		for _, app := range f.apps {
+			if app["guid"] == parts[2] {
+				body = map[string]interface{}{"var": f.envs[parts[2]]}
+			}
+		}
+	case len(parts) == 3 && parts[1] == "spaces":
+		if space, ok := fakeSpaces[parts[2]]; ok {
+			body = space
+		}
+	case len(parts) == 3 && parts[1] == "organizations":
+		if org, ok := fakeOrgs[parts[2]]; ok {
+			body = org
+		}
+	}
+	if body == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"errors":[{"code":10010,"title":"CF-ResourceNotFound","detail":"not found"}]}`)
+		return
+	}
+	json.NewEncoder(w).Encode(body)
+}
+
+func (f *fakeCAPI) appsPage(q url.Values) interface{} {
+	apps := f.apps
+	if since := q.Get("updated_ats[gt]"); since != "" {
+		apps = nil
+		for _, app := range f.apps {
+			if at, ok := app["updated_at"].(string); ok && at > since {
+				apps = append(apps, app)
+			}
+		}
+	}
+	perPage, _ := strconv.Atoi(q.Get("per_page"))
+	page, _ := strconv.Atoi(q.Get("page"))
+	if page == 0 {
+		page = 1
+	}
+	from, to := (page-1)*perPage, page*perPage
+	if to > len(apps) {
+		to = len(apps)
+	}
+	var next interface{}
+	if to < len(apps) {
+		q.Set("page", strconv.Itoa(page+1))
+		next = map[string]string{"href": f.server.URL + "/v3/apps?" + q.Encode()}
+	}
+	return f.withIncluded(map[string]interface{}{
+		"pagination": map[string]interface{}{"next": next},
+		"resources":  apps[from:to],
+	}, apps[from:to], q)
+}
+
+// auditEventsPage serves the deletion events one per page.
+func (f *fakeCAPI) auditEventsPage(q url.Values) interface{} {
+	page, _ := strconv.Atoi(q.Get("page"))
+	if page == 0 {
+		page = 1
+	}
+	var resources []interface{}
+	if page <= len(f.deleted) {
+		resources = append(resources, f.deleted[page-1])
+	}
+	var next interface{}
+	if page < len(f.deleted) {
+		q.Set("page", strconv.Itoa(page+1))
+		next = map[string]string{"href": f.server.URL + "/v3/audit_events?" + q.Encode()}
+	}
+	return map[string]interface{}{
+		"pagination": map[string]interface{}{"next": next},
+		"resources":  resources,
+	}
+}
+
+// withIncluded adds the spaces and orgs of apps to body when asked to.
+func (f *fakeCAPI) withIncluded(body map[string]interface{}, apps []map[string]interface{}, q url.Values) map[string]interface{} {
+	if q.Get("include") != "space.organization" {
+		return body
+	}
+	dup := map[string]interface{}{}
+	for k, v := range body {
+		dup[k] = v
+	}
+	spaces, orgs := []interface{}{}, []interface{}{}
+	seen := map[string]bool{}
+	for _, app := range apps {
+		guid := app["relationships"].(map[string]interface{})["space"].(map[string]interface{})["data"].(map[string]interface{})["guid"].(string)
+		if !seen[guid] {
+			seen[guid] = true
+			spaces = append(spaces, fakeSpaces[guid])
+		}
+	}
+	if len(spaces) > 0 {
+		orgs = append(orgs, fakeOrgs["org-guid"])
+	}
+	dup["included"] = map[string]interface{}{"spaces": spaces, "organizations": orgs}
+	return dup
+}
+
+var _ = Describe("V3Client", func() {
+	var (
+		capi   *fakeCAPI
+		client *V3Client
+	)
+
+	BeforeEach(func() {
+		capi = newFakeCAPI()
+		cf, err := cfclient.NewClient(&cfclient.Config{
+			ApiAddress: capi.server.URL,
+			Token:      "token",
+			HttpClient: &http.Client{},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		client = NewV3Client(cf)
+	})
+
+	AfterEach(func() {
+		capi.server.Close()
+	})
+
+	It("lists apps across pages with their spaces, orgs and labels", func() {
+		for i := 0; i < 5; i++ {
+			capi.addApp(fmt.Sprintf("app-%d", i), "space-guid", map[string]string{"team": strconv.Itoa(i)})
+		}
+		q := url.Values{}
+		q.Set("results-per-page", "2")
+		apps, err := client.ListAppsByQueryWithLimits(q, 0)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(apps).To(HaveLen(5))
+		Expect(apps[4].Guid).To(Equal("app-4"))
+		Expect(apps[4].SpaceGuid).To(Equal("space-guid"))
+		Expect(capi.Requests()).To(HaveLen(3))
+
+		space, err := client.GetSpaceByGuid("space-guid")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(space.Name).To(Equal("dev"))
+		Expect(space.OrganizationGuid).To(Equal("org-guid"))
+		org, err := client.GetOrgByGuid("org-guid")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(org.Name).To(Equal("acme"))
+		metadata, err := client.AppMetadata("app-3")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(metadata.Labels).To(Equal(map[string]string{"team": "3"}))
+		Expect(capi.Requests()).To(HaveLen(3))
+	})
+
+	It("translates the v2 query of the caches and honors the page limit", func() {
+		for i := 0; i < 5; i++ {
+			capi.addApp(fmt.Sprintf("app-%d", i), "space-guid", nil)
+		}
+		q := url.Values{}
+		q.Set("inline-relations-depth", "0")
+		q.Set("order-direction", "desc")
+		q.Set("results-per-page", "2")
+		apps, err := client.ListAppsByQueryWithLimits(q, 2)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(apps).To(HaveLen(4))
+
+		requests := capi.Requests()
+		Expect(requests).To(HaveLen(2))
+		first, err := url.Parse(requests[0])
+		Expect(err).ToNot(HaveOccurred())
+		Expect(first.Query()).To(Equal(url.Values{
+			"include":  {"space.organization"},
+			"order_by": {"-created_at"},
+			"per_page": {"2"},
+		}))
+	})
+
+	It("reads a single app with its space and org", func() {
+		capi.addApp("app", "other-space", map[string]string{"team": "payments"})
+		app, err := client.AppByGuid("app")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(app.Name).To(Equal("app"))
+		Expect(app.SpaceGuid).To(Equal("other-space"))
+
+		space, err := client.GetSpaceByGuid("other-space")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(space.Name).To(Equal("prod"))
+		Expect(capi.Requests()).To(Equal([]string{"/v3/apps/app?include=space.organization"}))
+	})
+
+	It("reads spaces and orgs it was not given", func() {
+		space, err := client.GetSpaceByGuid("other-space")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(space.Name).To(Equal("prod"))
+		org, err := client.GetOrgByGuid("org-guid")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(org.Name).To(Equal("acme"))
+		Expect(capi.Requests()).To(Equal([]string{"/v3/spaces/other-space", "/v3/organizations/org-guid"}))
+	})
+
+	It("reads the environment of an app again only once it was updated", func() {
+		capi.addApp("app", "space-guid", nil)
+		capi.setEnv("app", map[string]interface{}{"F2S_DISABLE_LOGGING": "true"}, "2020-01-01T00:00:00Z")
+		environment := func() map[string]interface{} {
+			apps, err := client.ListApps()
+			Expect(err).ToNot(HaveOccurred())
+			env, err := client.AppEnvironment(apps[0])
+			Expect(err).ToNot(HaveOccurred())
+			return env
+		}
+
+		Expect(environment()).To(Equal(map[string]interface{}{"F2S_DISABLE_LOGGING": "true"}))
+		Expect(environment()).To(Equal(map[string]interface{}{"F2S_DISABLE_LOGGING": "true"}))
+		Expect(capi.Requests()).To(HaveLen(3))
+
+		capi.setEnv("app", map[string]interface{}{"F2S_DISABLE_LOGGING": "false"}, "2020-01-02T00:00:00Z")
+		Expect(environment()).To(Equal(map[string]interface{}{"F2S_DISABLE_LOGGING": "false"}))
+		Expect(capi.Requests()).To(HaveLen(5))
+		Expect(capi.Requests()[4]).To(Equal("/v3/apps/app/environment_variables"))
+	})
+
+	It("lists the apps updated since a time", func() {
+		capi.addApp("app", "space-guid", nil)
+		capi.updateApp("app", "2020-01-03T00:00:00Z")
+		capi.addApp("old", "space-guid", nil)
+		capi.updateApp("old", "2020-01-01T00:00:00Z")
+		apps, err := client.AppsUpdatedSince(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(apps).To(HaveLen(1))
+		Expect(apps[0].Guid).To(Equal("app"))
+
+		first, err := url.Parse(capi.Requests()[0])
+		Expect(err).ToNot(HaveOccurred())
+		Expect(first.Query().Get("updated_ats[gt]")).To(Equal("2020-01-02T03:04:05Z"))
+		Expect(first.Query().Get("include")).To(Equal("space.organization"))
+	})
+
+	It("keeps what it remembered of other apps when it lists the apps updated since a time", func() {
+		capi.addApp("app", "space-guid", nil)
+		capi.addApp("other", "other-space", map[string]string{"team": "payments"})
+		capi.setEnv("other", map[string]interface{}{"NAME": "value"}, "2020-01-01T00:00:00Z")
+		apps, err := client.ListApps()
+		Expect(err).ToNot(HaveOccurred())
+		_, err = client.AppEnvironment(apps[1])
+		Expect(err).ToNot(HaveOccurred())
+
+		capi.updateApp("app", "2020-01-03T00:00:00Z")
+		apps, err = client.AppsUpdatedSince(time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(apps).To(HaveLen(1))
+		requests := len(capi.Requests())
+
+		space, err := client.GetSpaceByGuid("other-space")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(space.Name).To(Equal("prod"))
+		metadata, err := client.AppMetadata("other")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(metadata.Labels).To(Equal(map[string]string{"team": "payments"}))
+		env, err := client.AppEnvironment(cfclient.App{Guid: "other", UpdatedAt: "2020-01-01T00:00:00Z"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(env).To(Equal(map[string]interface{}{"NAME": "value"}))
+		Expect(capi.Requests()).To(HaveLen(requests))
+	})
+
+	It("lists the apps deleted since a time across pages", func() {
+		capi.deleteApp("old", "2020-01-02T00:00:00Z")
+		capi.deleteApp("older", "2020-01-01T00:00:00Z")
+		deletions, err := client.AppsDeletedSince(time.Date(2019, 12, 31, 0, 0, 0, 0, time.UTC))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(deletions).To(Equal([]AppDeletion{
+			{Guid: "old", At: time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)},
+			{Guid: "older", At: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+		}))
+
+		requests := capi.Requests()
+		Expect(requests).To(HaveLen(2))
+		first, err := url.Parse(requests[0])
+		Expect(err).ToNot(HaveOccurred())
+		Expect(first.Path).To(Equal("/v3/audit_events"))
+		Expect(first.Query().Get("types")).To(Equal("audit.app.delete-request"))
+		Expect(first.Query().Get("created_ats[gt]")).To(Equal("2019-12-31T00:00:00Z"))
+	})
+
+	It("returns the errors of the Cloud Controller", func() {
+		_, err := client.AppByGuid("ghost")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("CF-ResourceNotFound"))
+	})
+
+	It("authenticates with the token of the cf client", func() {
+		_, err := client.ListApps()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(capi.auth[len(capi.auth)-1]).To(Equal("Bearer token"))
+	})
+
+	It("fills the in-memory cache with a single listing and the environment of each app", func() {
+		capi.addApp("app", "space-guid", map[string]string{"team": "payments"})
+		c := NewMemory(client, &BoltdbConfig{AppMetadata: true})
+		Expect(c.Start(context.Background())).To(Succeed())
+		defer c.Stop()
+
+		app, err := c.GetApp("app")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(app.SpaceName).To(Equal("dev"))
+		Expect(app.OrgName).To(Equal("acme"))
+		Expect(app.Labels).To(Equal(map[string]string{"team": "payments"}))
+		Expect(capi.Requests()).To(HaveLen(2))
+		Expect(capi.Requests()[1]).To(Equal("/v3/apps/app/environment_variables"))
+	})
+
+	It("opts apps out through their environment variables", func() {
+		capi.addApp("quiet", "space-guid", nil)
+		capi.setEnv("quiet", map[string]interface{}{"F2S_DISABLE_LOGGING": "true"}, "2020-01-01T00:00:00Z")
+		capi.addApp("loud", "space-guid", nil)
+		c := NewMemory(client, &BoltdbConfig{})
+		Expect(c.Start(context.Background())).To(Succeed())
+		defer c.Stop()
+
+		app, err := c.GetApp("quiet")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(app.IgnoredApp).To(BeTrue())
+		app, err = c.GetApp("loud")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(app.IgnoredApp).To(BeFalse())
+	})
+})
+
+var _ = Describe("NewAppClient", func() {
+	It("defaults to the v2 API", func() {
+		client, err := NewAppClient(nil, "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(client).To(BeAssignableToTypeOf(CFClient{}))
+	})
+
+	It("rejects unknown API versions", func() {
+		_, err := NewAppClient(nil, "v4")
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -1,8 +1,14 @@
 package config
 
 import (
+	"errors"
 	"time"
 
+	"github.com/bosh-loki/loki-firehose-nozzle/cache"
+	"github.com/bosh-loki/loki-firehose-nozzle/enrich"
+	"github.com/bosh-loki/loki-firehose-nozzle/filter"
+	"github.com/bosh-loki/loki-firehose-nozzle/redact"
+	"github.com/bosh-loki/loki-firehose-nozzle/relabel"
 	"github.com/kelseyhightower/envconfig"
 	"github.com/prometheus/common/log"
 
@@ -18,6 +24,12 @@ type Config struct {
 	CF     cf
 	Loki   loki
 	Nozzle nozzle
+
+	// Filters, RedactionRules and RelabelConfigs can only be set in the
+	// config file.
+	Filters        []filter.Config  `toml:"filters" ignored:"true"`
+	RedactionRules []redact.Config  `toml:"redaction_rules" ignored:"true"`
+	RelabelConfigs []relabel.Config `toml:"relabel_configs" ignored:"true"`
 }
 
 type cf struct {
@@ -29,18 +41,66 @@ type cf struct {
 }
 
 type loki struct {
-	BaseLabels string `toml:"base_labels" envconfig:"NOZZLE_BASE_LABELS"`
-	Endpoint   string `toml:"endpoint" envconfig:"NOZZLE_LOKI_ENDPOINT"`
-	Port       int    `toml:"port" envconfig:"NOZZLE_LOKI_PORT"`
+	BaseLabels          string   `toml:"base_labels" envconfig:"NOZZLE_BASE_LABELS"`
+	BearerToken         string   `toml:"bearer_token" envconfig:"NOZZLE_LOKI_BEARER_TOKEN"`
+	BearerTokenFile     string   `toml:"bearer_token_file" envconfig:"NOZZLE_LOKI_BEARER_TOKEN_FILE"`
+	CAFile              string   `toml:"ca_file" envconfig:"NOZZLE_LOKI_CA_FILE"`
+	CertFile            string   `toml:"cert_file" envconfig:"NOZZLE_LOKI_CERT_FILE"`
+	DeadLetterPath      string   `toml:"dead_letter_path" envconfig:"NOZZLE_LOKI_DEAD_LETTER_PATH"`
+	DefaultTenant       string   `toml:"default_tenant" envconfig:"NOZZLE_LOKI_DEFAULT_TENANT"`
+	Encoding            string   `toml:"encoding" envconfig:"NOZZLE_LOKI_ENCODING"`
+	Endpoint            string   `toml:"endpoint" envconfig:"NOZZLE_LOKI_ENDPOINT"`
+	InsecureSkipVerify  bool     `toml:"insecure_skip_verify" envconfig:"NOZZLE_LOKI_INSECURE_SKIP_VERIFY"`
+	KeyFile             string   `toml:"key_file" envconfig:"NOZZLE_LOKI_KEY_FILE"`
+	MaxInFlight         int      `toml:"max_in_flight" envconfig:"NOZZLE_LOKI_MAX_IN_FLIGHT"`
+	MaxPushInterval     duration `toml:"max_push_interval" envconfig:"NOZZLE_LOKI_MAX_PUSH_INTERVAL"`
+	MinPushInterval     duration `toml:"min_push_interval" envconfig:"NOZZLE_LOKI_MIN_PUSH_INTERVAL"`
+	OverflowPolicy      string   `toml:"overflow_policy" envconfig:"NOZZLE_LOKI_OVERFLOW_POLICY"`
+	Password            string   `toml:"password" envconfig:"NOZZLE_LOKI_PASSWORD"`
+	Port                int      `toml:"port" envconfig:"NOZZLE_LOKI_PORT"`
+	PushAPI             string   `toml:"push_api" envconfig:"NOZZLE_LOKI_PUSH_API"`
+	QueueCapacity       int      `toml:"queue_capacity" envconfig:"NOZZLE_LOKI_QUEUE_CAPACITY"`
+	Scheme              string   `toml:"scheme" envconfig:"NOZZLE_LOKI_SCHEME"`
+	Senders             int      `toml:"senders" envconfig:"NOZZLE_LOKI_SENDERS"`
+	SpoolMaxAge         duration `toml:"spool_max_age" envconfig:"NOZZLE_LOKI_SPOOL_MAX_AGE"`
+	SpoolMaxBytes       int64    `toml:"spool_max_bytes" envconfig:"NOZZLE_LOKI_SPOOL_MAX_BYTES"`
+	SpoolPath           string   `toml:"spool_path" envconfig:"NOZZLE_LOKI_SPOOL_PATH"`
+	SpoolReplayInterval duration `toml:"spool_replay_interval" envconfig:"NOZZLE_LOKI_SPOOL_REPLAY_INTERVAL"`
+	TenantLabel         string   `toml:"tenant_label" envconfig:"NOZZLE_LOKI_TENANT_LABEL"`
+	Username            string   `toml:"username" envconfig:"NOZZLE_LOKI_USERNAME"`
 }
 
 type nozzle struct {
-	AppCacheTTL        duration `toml:"app_cache_ttl" envconfig:"NOZZLE_APP_CACHE_INVALIDATE_TTL"`
-	AppLimits          int      `toml:"app_limits" envconfig:"NOZZLE_APP_LIMITS"`
-	BoltDBPath         string   `toml:"boltdb_path" envconfig:"NOZZLE_BOLTDB_PATH"`
-	IgnoreMissingApps  bool     `toml:"ignore_missing_apps" envconfig:"NOZZLE_IGNORE_MISSING_APPS"`
-	MissingAppCacheTTL duration `toml:"missing_app_cache_ttl" envconfig:"NOZZLE_MISSING_APP_CACHE_INVALIDATE_TTL"`
-	OrgSpaceCacheTTL   duration `toml:"org_space_cache_ttl" envconfig:"NOZZLE_ORG_SPACE_CACHE_INVALIDATE_TTL"`
+	AppCacheSize          int               `toml:"app_cache_size" envconfig:"NOZZLE_APP_CACHE_SIZE"`
+	AppCacheTTL           duration          `toml:"app_cache_ttl" envconfig:"NOZZLE_APP_CACHE_INVALIDATE_TTL"`
+	AppLimits             int               `toml:"app_limits" envconfig:"NOZZLE_APP_LIMITS"`
+	BoltDBPath            string            `toml:"boltdb_path" envconfig:"NOZZLE_BOLTDB_PATH"`
+	CFAPIVersion          string            `toml:"cf_api_version" envconfig:"NOZZLE_CF_API_VERSION"`
+	EnrichmentMode        string            `toml:"enrichment_mode" envconfig:"NOZZLE_ENRICHMENT_MODE"`
+	EnrichmentMaxBuffered int               `toml:"enrichment_max_buffered" envconfig:"NOZZLE_ENRICHMENT_MAX_BUFFERED"`
+	EnrichmentTimeout     duration          `toml:"enrichment_timeout" envconfig:"NOZZLE_ENRICHMENT_TIMEOUT"`
+	IgnoreMissingApps     bool              `toml:"ignore_missing_apps" envconfig:"NOZZLE_IGNORE_MISSING_APPS"`
+	LevelDetection        string            `toml:"level_detection" envconfig:"NOZZLE_LEVEL_DETECTION"`
+	ListenAddress         string            `toml:"listen_address" envconfig:"NOZZLE_LISTEN_ADDRESS"`
+	MaxClockDrift         duration          `toml:"max_clock_drift" envconfig:"NOZZLE_MAX_CLOCK_DRIFT"`
+	MaxEnvelopeSilence    duration          `toml:"max_envelope_silence" envconfig:"NOZZLE_MAX_ENVELOPE_SILENCE"`
+	MissingAppCacheTTL    duration          `toml:"missing_app_cache_ttl" envconfig:"NOZZLE_MISSING_APP_CACHE_INVALIDATE_TTL"`
+	MultilineContinuation string            `toml:"multiline_continuation" envconfig:"NOZZLE_MULTILINE_CONTINUATION"`
+	MultilineFlushTimeout duration          `toml:"multiline_flush_timeout" envconfig:"NOZZLE_MULTILINE_FLUSH_TIMEOUT"`
+	MultilineMaxLines     int               `toml:"multiline_max_lines" envconfig:"NOZZLE_MULTILINE_MAX_LINES"`
+	MultilineStart        string            `toml:"multiline_start" envconfig:"NOZZLE_MULTILINE_START"`
+	OptOutEnvVar          string            `toml:"opt_out_env_var" envconfig:"NOZZLE_OPT_OUT_ENV_VAR"`
+	OptOutLabel           string            `toml:"opt_out_label" envconfig:"NOZZLE_OPT_OUT_LABEL"`
+	OptOutOrgs            []string          `toml:"opt_out_orgs" envconfig:"NOZZLE_OPT_OUT_ORGS"`
+	OptOutSpaces          []string          `toml:"opt_out_spaces" envconfig:"NOZZLE_OPT_OUT_SPACES"`
+	OrgSpaceCacheTTL      duration          `toml:"org_space_cache_ttl" envconfig:"NOZZLE_ORG_SPACE_CACHE_INVALIDATE_TTL"`
+	OutputFormat          string            `toml:"output_format" envconfig:"NOZZLE_OUTPUT_FORMAT"`
+	OutputFormats         map[string]string `toml:"output_formats" envconfig:"NOZZLE_OUTPUT_FORMATS"`
+	PromoteAppLabels      []string          `toml:"promote_app_labels" envconfig:"NOZZLE_PROMOTE_APP_LABELS"`
+	PromoteMaxValues      int               `toml:"promote_max_values" envconfig:"NOZZLE_PROMOTE_MAX_VALUES"`
+	PromoteTags           []string          `toml:"promote_tags" envconfig:"NOZZLE_PROMOTE_TAGS"`
+	ShutdownTimeout       duration          `toml:"shutdown_timeout" envconfig:"NOZZLE_SHUTDOWN_TIMEOUT"`
+	TimestampPolicy       string            `toml:"timestamp_policy" envconfig:"NOZZLE_TIMESTAMP_POLICY"`
 }
 
 func (d *duration) UnmarshalText(text []byte) error {
@@ -60,3 +120,38 @@ func ParseConfig(path string) (Config, error) {
 	}
 	return conf, nil
 }
+
+// Validate reports settings that cannot be honoured together.
+func (c Config) Validate() error {
+	if (c.Nozzle.OptOutLabel != "" || len(c.Nozzle.PromoteAppLabels) > 0) && c.Nozzle.CFAPIVersion != cache.APIV3 {
+		// v2 would read the labels of every app with a request of its own.
+		return errors.New(`opt_out_label and promote_app_labels require cf_api_version = "v3"`)
+	}
+	if c.Nozzle.EnrichmentMode == enrich.AppID && c.AppMetadataRequired() {
+		return errors.New(`enrichment_mode = "app_id" cannot be used with opt_out_env_var, opt_out_label, opt_out_orgs, ` +
+			`opt_out_spaces, org, space or app filters, redaction rules restricted to orgs or spaces, or tenant_label`)
+	}
+	return nil
+}
+
+// AppMetadataRequired reports whether opt-outs, filters, redaction rules or
+// the tenant depend on the app, space and org of envelopes, so that
+// envelopes of apps whose metadata could not be found must not be shipped.
+// The opt-out environment variable counts only when it is configured; apps
+// that could not be looked up are still shipped despite the default one.
+func (c Config) AppMetadataRequired() bool {
+	if c.Nozzle.OptOutEnvVar != "" || c.Nozzle.OptOutLabel != "" || len(c.Nozzle.OptOutOrgs) > 0 || len(c.Nozzle.OptOutSpaces) > 0 || c.Loki.TenantLabel != "" {
+		return true
+	}
+	for _, f := range c.Filters {
+		if len(f.Orgs) > 0 || len(f.Spaces) > 0 || len(f.Apps) > 0 {
+			return true
+		}
+	}
+	for _, r := range c.RedactionRules {
+		if len(r.Orgs) > 0 || len(r.Spaces) > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -25,25 +25,138 @@ var _ = Describe("NozzleConfig", func() {
 		Expect(conf.Loki.BaseLabels).To(Equal("env:prod,region:us"))
 		Expect(conf.Loki.Endpoint).To(Equal("10.244.0.2"))
 		Expect(conf.Loki.Port).To(Equal(3100))
+		Expect(conf.Loki.PushAPI).To(Equal("v1"))
+		Expect(conf.Loki.Encoding).To(Equal("json"))
+		Expect(conf.Loki.TenantLabel).To(Equal("cf_org_name"))
+		Expect(conf.Loki.DefaultTenant).To(Equal("platform"))
+		Expect(conf.Loki.DeadLetterPath).To(Equal("/var/vcap/data/rejected.log"))
+		Expect(conf.Loki.Scheme).To(Equal("https"))
+		Expect(conf.Loki.Username).To(Equal("loki"))
+		Expect(conf.Loki.Password).To(Equal("secret"))
+		Expect(conf.Loki.BearerToken).To(BeEmpty())
+		Expect(conf.Loki.BearerTokenFile).To(Equal("/var/vcap/jobs/token"))
+		Expect(conf.Loki.CAFile).To(Equal("/var/vcap/jobs/ca.pem"))
+		Expect(conf.Loki.CertFile).To(Equal("/var/vcap/jobs/cert.pem"))
+		Expect(conf.Loki.KeyFile).To(Equal("/var/vcap/jobs/key.pem"))
+		Expect(conf.Loki.InsecureSkipVerify).To(Equal(true))
+		Expect(conf.Loki.Senders).To(Equal(4))
+		Expect(conf.Loki.MaxInFlight).To(Equal(8))
+		Expect(conf.Loki.MinPushInterval.Duration).To(Equal(50 * time.Millisecond))
+		Expect(conf.Loki.MaxPushInterval.Duration).To(Equal(10 * time.Second))
+		Expect(conf.Loki.QueueCapacity).To(Equal(500))
+		Expect(conf.Loki.OverflowPolicy).To(Equal("drop_oldest"))
+		Expect(conf.Loki.SpoolPath).To(Equal("/var/vcap/data/spool.db"))
+		Expect(conf.Loki.SpoolMaxBytes).To(BeEquivalentTo(1048576))
+		Expect(conf.Loki.SpoolMaxAge.Duration).To(Equal(time.Hour))
+		Expect(conf.Loki.SpoolReplayInterval.Duration).To(Equal(30 * time.Second))
 		Expect(conf.Nozzle.AppCacheTTL.Duration).To(BeEquivalentTo(0 * time.Second))
+		Expect(conf.Nozzle.AppCacheSize).To(Equal(5000))
 		Expect(conf.Nozzle.AppLimits).To(Equal(0))
 		Expect(conf.Nozzle.BoltDBPath).To(Equal("/var/vcap/nozzle.db"))
+		Expect(conf.Nozzle.CFAPIVersion).To(Equal("v3"))
 		Expect(conf.Nozzle.IgnoreMissingApps).To(Equal(false))
+		Expect(conf.Nozzle.EnrichmentMode).To(Equal("buffer"))
+		Expect(conf.Nozzle.EnrichmentTimeout.Duration).To(Equal(2 * time.Second))
+		Expect(conf.Nozzle.EnrichmentMaxBuffered).To(Equal(50))
 		Expect(conf.Nozzle.MissingAppCacheTTL.Duration).To(BeEquivalentTo(0 * time.Second))
 		Expect(conf.Nozzle.OrgSpaceCacheTTL.Duration).To(Equal(72 * time.Hour))
+		Expect(conf.Nozzle.TimestampPolicy).To(Equal("clamp"))
+		Expect(conf.Nozzle.ShutdownTimeout.Duration).To(Equal(30 * time.Second))
+		Expect(conf.Nozzle.ListenAddress).To(Equal(":8080"))
+		Expect(conf.Filters).To(HaveLen(2))
+		Expect(conf.Filters[0].Name).To(Equal("platform-metrics"))
+		Expect(conf.Filters[0].EventTypes).To(Equal([]string{"ValueMetric", "CounterEvent"}))
+		Expect(conf.Filters[1].Action).To(Equal("exclude"))
+		Expect(conf.Filters[1].Orgs).To(Equal([]string{"/^restricted-.*$/"}))
+		Expect(conf.RedactionRules).To(HaveLen(2))
+		Expect(conf.RedactionRules[0].Builtin).To(Equal("jwt"))
+		Expect(conf.RedactionRules[1].Name).To(Equal("email"))
+		Expect(conf.RedactionRules[1].Regex).To(Equal(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`))
+		Expect(conf.RedactionRules[1].Replacement).To(Equal("[EMAIL]"))
+		Expect(conf.RedactionRules[1].Spaces).To(Equal([]string{"customer-facing"}))
+		Expect(conf.RelabelConfigs).To(HaveLen(2))
+		Expect(conf.RelabelConfigs[0].SourceLabels).To(Equal([]string{"cf_app_name"}))
+		Expect(conf.RelabelConfigs[0].TargetLabel).To(Equal("app"))
+		Expect(conf.RelabelConfigs[0].Regex).To(BeNil())
+		Expect(conf.RelabelConfigs[1].Action).To(Equal("labeldrop"))
+		Expect(*conf.RelabelConfigs[1].Regex).To(Equal("source_instance"))
+		Expect(conf.Nozzle.MaxEnvelopeSilence.Duration).To(Equal(5 * time.Minute))
+		Expect(conf.Nozzle.OptOutEnvVar).To(Equal("DISABLE_LOKI_LOGGING"))
+		Expect(conf.Nozzle.OptOutLabel).To(Equal("loki-nozzle/disable-logging"))
+		Expect(conf.Nozzle.OptOutOrgs).To(Equal([]string{"system"}))
+		Expect(conf.Nozzle.OptOutSpaces).To(Equal([]string{"sandbox", "3c4b0e4c-3d1a-4c4f-9b0e-2f5a5a1f0c11"}))
+		Expect(conf.Nozzle.PromoteTags).To(Equal([]string{"placement_tag", "product"}))
+		Expect(conf.Nozzle.PromoteAppLabels).To(Equal([]string{"team", "example.com/tier"}))
+		Expect(conf.Nozzle.PromoteMaxValues).To(Equal(50))
+		Expect(conf.Nozzle.OutputFormat).To(Equal("logfmt"))
+		Expect(conf.Nozzle.OutputFormats).To(Equal(map[string]string{"HttpStartStop": "json"}))
+		Expect(conf.Nozzle.MultilineStart).To(Equal(`^\S`))
+		Expect(conf.Nozzle.MultilineContinuation).To(Equal(`^\s+at `))
+		Expect(conf.Nozzle.MultilineFlushTimeout.Duration).To(Equal(2 * time.Second))
+		Expect(conf.Nozzle.MultilineMaxLines).To(Equal(200))
+		Expect(conf.Nozzle.LevelDetection).To(Equal("label"))
+		Expect(conf.Nozzle.MaxClockDrift.Duration).To(Equal(5 * time.Minute))
 	})
 
 	It("successfully overwrites file config values with environmental variables", func() {
 		os.Setenv("NOZZLE_API_ENDPOINT", "https://api.cf-dev.com")
 		os.Setenv("NOZZLE_APP_CACHE_INVALIDATE_TTL", "10s")
+		os.Setenv("NOZZLE_APP_CACHE_SIZE", "100")
 		os.Setenv("NOZZLE_APP_LIMITS", "1")
 		os.Setenv("NOZZLE_BASE_LABELS", "env:stg,nozzle:foobar")
 		os.Setenv("NOZZLE_BOLTDB_PATH", "/tmp/nozzle.db")
+		os.Setenv("NOZZLE_CF_API_VERSION", "v2")
 		os.Setenv("NOZZLE_IGNORE_MISSING_APPS", "true")
+		os.Setenv("NOZZLE_ENRICHMENT_MODE", "app_id")
+		os.Setenv("NOZZLE_ENRICHMENT_TIMEOUT", "1s")
+		os.Setenv("NOZZLE_ENRICHMENT_MAX_BUFFERED", "10")
 		os.Setenv("NOZZLE_LOKI_ENDPOINT", "192.168.1.111")
 		os.Setenv("NOZZLE_LOKI_PORT", "3200")
+		os.Setenv("NOZZLE_LOKI_PUSH_API", "legacy")
+		os.Setenv("NOZZLE_LOKI_ENCODING", "protobuf")
+		os.Setenv("NOZZLE_LOKI_TENANT_LABEL", "cf_org_id")
+		os.Setenv("NOZZLE_LOKI_DEFAULT_TENANT", "system")
+		os.Setenv("NOZZLE_LOKI_DEAD_LETTER_PATH", "/tmp/rejected.log")
+		os.Setenv("NOZZLE_LOKI_SCHEME", "http")
+		os.Setenv("NOZZLE_LOKI_USERNAME", "nozzle")
+		os.Setenv("NOZZLE_LOKI_PASSWORD", "hunter2")
+		os.Setenv("NOZZLE_LOKI_BEARER_TOKEN", "token")
+		os.Setenv("NOZZLE_LOKI_BEARER_TOKEN_FILE", "/tmp/token")
+		os.Setenv("NOZZLE_LOKI_CA_FILE", "/tmp/ca.pem")
+		os.Setenv("NOZZLE_LOKI_CERT_FILE", "/tmp/cert.pem")
+		os.Setenv("NOZZLE_LOKI_KEY_FILE", "/tmp/key.pem")
+		os.Setenv("NOZZLE_LOKI_INSECURE_SKIP_VERIFY", "false")
+		os.Setenv("NOZZLE_LOKI_SENDERS", "2")
+		os.Setenv("NOZZLE_LOKI_MAX_IN_FLIGHT", "3")
+		os.Setenv("NOZZLE_LOKI_MIN_PUSH_INTERVAL", "1ms")
+		os.Setenv("NOZZLE_LOKI_MAX_PUSH_INTERVAL", "1s")
+		os.Setenv("NOZZLE_LOKI_QUEUE_CAPACITY", "100")
+		os.Setenv("NOZZLE_LOKI_OVERFLOW_POLICY", "drop_priority")
+		os.Setenv("NOZZLE_LOKI_SPOOL_PATH", "/tmp/spool.db")
+		os.Setenv("NOZZLE_LOKI_SPOOL_MAX_BYTES", "1024")
+		os.Setenv("NOZZLE_LOKI_SPOOL_MAX_AGE", "10m")
+		os.Setenv("NOZZLE_LOKI_SPOOL_REPLAY_INTERVAL", "5s")
 		os.Setenv("NOZZLE_MISSING_APP_CACHE_INVALIDATE_TTL", "10s")
+		os.Setenv("NOZZLE_OPT_OUT_ENV_VAR", "NO_LOGS")
+		os.Setenv("NOZZLE_OPT_OUT_LABEL", "no-logs")
+		os.Setenv("NOZZLE_OPT_OUT_ORGS", "system,test")
+		os.Setenv("NOZZLE_OPT_OUT_SPACES", "scratch")
 		os.Setenv("NOZZLE_ORG_SPACE_CACHE_INVALIDATE_TTL", "48h")
+		os.Setenv("NOZZLE_PROMOTE_TAGS", "product")
+		os.Setenv("NOZZLE_PROMOTE_APP_LABELS", "team,tier")
+		os.Setenv("NOZZLE_PROMOTE_MAX_VALUES", "10")
+		os.Setenv("NOZZLE_OUTPUT_FORMAT", "json")
+		os.Setenv("NOZZLE_MULTILINE_START", `^\d{4}-`)
+		os.Setenv("NOZZLE_MULTILINE_CONTINUATION", "^Caused by:")
+		os.Setenv("NOZZLE_MULTILINE_FLUSH_TIMEOUT", "500ms")
+		os.Setenv("NOZZLE_MULTILINE_MAX_LINES", "50")
+		os.Setenv("NOZZLE_LEVEL_DETECTION", "line")
+		os.Setenv("NOZZLE_OUTPUT_FORMATS", "ValueMetric:text,ContainerMetric:logfmt")
+		os.Setenv("NOZZLE_SHUTDOWN_TIMEOUT", "5s")
+		os.Setenv("NOZZLE_LISTEN_ADDRESS", "127.0.0.1:9100")
+		os.Setenv("NOZZLE_MAX_ENVELOPE_SILENCE", "1m")
+		os.Setenv("NOZZLE_TIMESTAMP_POLICY", "receive")
+		os.Setenv("NOZZLE_MAX_CLOCK_DRIFT", "1m")
 		os.Setenv("NOZZLE_SKIP_SSL_VALIDATION", "false")
 		os.Setenv("NOZZLE_SUBSCRIPTION_ID", "loki-nozzle-dev")
 		os.Setenv("NOZZLE_UAA_CLIENT_ID", "loki-client")
@@ -59,11 +172,105 @@ var _ = Describe("NozzleConfig", func() {
 		Expect(conf.Loki.BaseLabels).To(Equal("env:stg,nozzle:foobar"))
 		Expect(conf.Loki.Endpoint).To(Equal("192.168.1.111"))
 		Expect(conf.Loki.Port).To(Equal(3200))
+		Expect(conf.Loki.PushAPI).To(Equal("legacy"))
+		Expect(conf.Loki.Encoding).To(Equal("protobuf"))
+		Expect(conf.Loki.TenantLabel).To(Equal("cf_org_id"))
+		Expect(conf.Loki.DefaultTenant).To(Equal("system"))
+		Expect(conf.Loki.DeadLetterPath).To(Equal("/tmp/rejected.log"))
+		Expect(conf.Loki.Scheme).To(Equal("http"))
+		Expect(conf.Loki.Username).To(Equal("nozzle"))
+		Expect(conf.Loki.Password).To(Equal("hunter2"))
+		Expect(conf.Loki.BearerToken).To(Equal("token"))
+		Expect(conf.Loki.BearerTokenFile).To(Equal("/tmp/token"))
+		Expect(conf.Loki.CAFile).To(Equal("/tmp/ca.pem"))
+		Expect(conf.Loki.CertFile).To(Equal("/tmp/cert.pem"))
+		Expect(conf.Loki.KeyFile).To(Equal("/tmp/key.pem"))
+		Expect(conf.Loki.InsecureSkipVerify).To(Equal(false))
+		Expect(conf.Loki.Senders).To(Equal(2))
+		Expect(conf.Loki.MaxInFlight).To(Equal(3))
+		Expect(conf.Loki.MinPushInterval.Duration).To(Equal(time.Millisecond))
+		Expect(conf.Loki.MaxPushInterval.Duration).To(Equal(time.Second))
+		Expect(conf.Loki.QueueCapacity).To(Equal(100))
+		Expect(conf.Loki.OverflowPolicy).To(Equal("drop_priority"))
+		Expect(conf.Loki.SpoolPath).To(Equal("/tmp/spool.db"))
+		Expect(conf.Loki.SpoolMaxBytes).To(BeEquivalentTo(1024))
+		Expect(conf.Loki.SpoolMaxAge.Duration).To(Equal(10 * time.Minute))
+		Expect(conf.Loki.SpoolReplayInterval.Duration).To(Equal(5 * time.Second))
 		Expect(conf.Nozzle.AppCacheTTL.Duration).To(BeEquivalentTo(10 * time.Second))
+		Expect(conf.Nozzle.AppCacheSize).To(Equal(100))
 		Expect(conf.Nozzle.AppLimits).To(Equal(1))
 		Expect(conf.Nozzle.BoltDBPath).To(Equal("/tmp/nozzle.db"))
+		Expect(conf.Nozzle.CFAPIVersion).To(Equal("v2"))
 		Expect(conf.Nozzle.IgnoreMissingApps).To(Equal(true))
+		Expect(conf.Nozzle.EnrichmentMode).To(Equal("app_id"))
+		Expect(conf.Nozzle.EnrichmentTimeout.Duration).To(Equal(time.Second))
+		Expect(conf.Nozzle.EnrichmentMaxBuffered).To(Equal(10))
 		Expect(conf.Nozzle.MissingAppCacheTTL.Duration).To(BeEquivalentTo(10 * time.Second))
 		Expect(conf.Nozzle.OrgSpaceCacheTTL.Duration).To(Equal(48 * time.Hour))
+		Expect(conf.Nozzle.TimestampPolicy).To(Equal("receive"))
+		Expect(conf.Nozzle.ShutdownTimeout.Duration).To(Equal(5 * time.Second))
+		Expect(conf.Nozzle.ListenAddress).To(Equal("127.0.0.1:9100"))
+		Expect(conf.Nozzle.MaxEnvelopeSilence.Duration).To(Equal(time.Minute))
+		Expect(conf.Nozzle.OptOutEnvVar).To(Equal("NO_LOGS"))
+		Expect(conf.Nozzle.OptOutLabel).To(Equal("no-logs"))
+		Expect(conf.Nozzle.OptOutOrgs).To(Equal([]string{"system", "test"}))
+		Expect(conf.Nozzle.OptOutSpaces).To(Equal([]string{"scratch"}))
+		Expect(conf.Nozzle.PromoteTags).To(Equal([]string{"product"}))
+		Expect(conf.Nozzle.PromoteAppLabels).To(Equal([]string{"team", "tier"}))
+		Expect(conf.Nozzle.PromoteMaxValues).To(Equal(10))
+		Expect(conf.Nozzle.OutputFormat).To(Equal("json"))
+		Expect(conf.Nozzle.OutputFormats).To(Equal(map[string]string{"ValueMetric": "text", "ContainerMetric": "logfmt"}))
+		Expect(conf.Nozzle.MultilineStart).To(Equal(`^\d{4}-`))
+		Expect(conf.Nozzle.MultilineContinuation).To(Equal(`^Caused by:`))
+		Expect(conf.Nozzle.MultilineFlushTimeout.Duration).To(Equal(500 * time.Millisecond))
+		Expect(conf.Nozzle.MultilineMaxLines).To(Equal(50))
+		Expect(conf.Nozzle.LevelDetection).To(Equal("line"))
+		Expect(conf.Nozzle.MaxClockDrift.Duration).To(Equal(time.Minute))
+	})
+
+	Describe("Validate", func() {
+		var conf Config
+
+		BeforeEach(func() {
+			var err error
+			conf, err = ParseConfig("testdata/test_config.toml")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("accepts the test config", func() {
+			Expect(conf.Validate()).To(Succeed())
+		})
+
+		It("requires the v3 API to read app labels", func() {
+			conf.Nozzle.CFAPIVersion = "v2"
+			Expect(conf.Validate()).ToNot(Succeed())
+			conf.Nozzle.OptOutLabel = ""
+			Expect(conf.Validate()).ToNot(Succeed())
+			conf.Nozzle.PromoteAppLabels = nil
+			Expect(conf.Validate()).To(Succeed())
+		})
+
+		It("rejects the app_id enrichment mode when app metadata is required", func() {
+			conf.Nozzle.EnrichmentMode = "app_id"
+			Expect(conf.AppMetadataRequired()).To(BeTrue())
+			Expect(conf.Validate()).ToNot(Succeed())
+
+			conf.Nozzle.OptOutEnvVar = ""
+			conf.Nozzle.OptOutLabel = ""
+			conf.Nozzle.OptOutOrgs = nil
+			conf.Nozzle.OptOutSpaces = nil
+			conf.Loki.TenantLabel = ""
+			conf.Filters = conf.Filters[:1]
+			conf.RedactionRules = conf.RedactionRules[:1]
+			Expect(conf.AppMetadataRequired()).To(BeFalse())
+			Expect(conf.Validate()).To(Succeed())
+
+			conf.RedactionRules[0].Spaces = []string{"dev"}
+			Expect(conf.Validate()).ToNot(Succeed())
+			conf.RedactionRules[0].Spaces = nil
+
+			conf.Nozzle.OptOutEnvVar = "NO_LOGS"
+			Expect(conf.Validate()).ToNot(Succeed())
+		})
 	})
 })
@@ -0,0 +1,326 @@
+// Package enrich adds the app, space and org metadata of the app cache to
+// events without making the firehose wait for the Cloud Controller.
+package enrich
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bosh-loki/loki-firehose-nozzle/cache"
+	"github.com/bosh-loki/loki-firehose-nozzle/messages"
+	"github.com/bosh-loki/loki-firehose-nozzle/metrics"
+	"github.com/prometheus/common/log"
+)
+
+// Modes for events of apps that are not cached yet.
+const (
+	// Buffer holds the events of the app until its metadata arrives, or
+	// until they waited for BufferTimeout.
+	Buffer = "buffer"
+	// AppID passes the events on right away, labelled with cf_app_id only.
+	AppID = "app_id"
+)
+
+// Defaults for unset Config fields.
+const (
+	DefaultBufferTimeout = 5 * time.Second
+	DefaultMaxBuffered   = 1000
+)
+
+// Reasons events are passed on without metadata.
+const (
+	reasonAppID        = "app_id"
+	reasonTimeout      = "timeout"
+	reasonBufferFull   = "buffer_full"
+	reasonLookupFailed = "lookup_failed"
+	reasonStopped      = "stopped"
+)
+
+var unenriched = metrics.NewCounterVec(
+	"loki_nozzle_unenriched_events_total",
+	"Events of apps passed on without app metadata, by reason: app_id, timeout, buffer_full, lookup_failed or stopped.",
+	"reason")
+
+func init() {
+	metrics.MustRegister(unenriched)
+}
+
+// Config chooses what happens to the events of apps that are not cached.
+type Config struct {
+	// Mode is Buffer or AppID; defaults to Buffer.
+	Mode string
+	// BufferTimeout is how long events wait for the metadata of their app;
+	// defaults to DefaultBufferTimeout.
+	BufferTimeout time.Duration
+	// MaxBuffered caps the events held per app, later ones are passed on
+	// without metadata; defaults to DefaultMaxBuffered.
+	MaxBuffered int
+}
+
+// Enricher annotates events with the metadata of their app. Apps that are
+// not cached are looked up in the background, one lookup per app however
+// many events are waiting for it.
+type Enricher struct {
+	mode          string
+	bufferTimeout time.Duration
+	maxBuffered   int
+
+	cache cache.Cache
+
+	lock    sync.Mutex
+	pending map[string]*pendingApp // by app GUID
+	stopped bool
+	drains  sync.WaitGroup
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+// pendingApp is an app being looked up and the events waiting for it.
+type pendingApp struct {
+	events []held
+	since  time.Time
+	app    *cache.App
+	// reason is why held events are passed on without app, once the
+	// lookup is over or they stopped waiting.
+	reason string
+	// resolved is set once the lookup is over, expired once the events
+	// stopped waiting for it.
+	resolved bool
+	expired  bool
+	// draining is set while a goroutine passes the held events on; events
+	// arriving meanwhile are held too so that they keep their order.
+	draining bool
+}
+
+type held struct {
+	event *messages.Event
+	then  func()
+}
+
+// New validates cfg and returns an Enricher.
+func New(cfg Config) (*Enricher, error) {
+	e := &Enricher{
+		mode:          cfg.Mode,
+		bufferTimeout: cfg.BufferTimeout,
+		maxBuffered:   cfg.MaxBuffered,
+		pending:       map[string]*pendingApp{},
+	}
+	switch e.mode {
+	case "":
+		e.mode = Buffer
+	case Buffer, AppID:
+	default:
+		return nil, fmt.Errorf("unknown enrichment mode %q", cfg.Mode)
+	}
+	if e.bufferTimeout < 0 || e.maxBuffered < 0 {
+		return nil, errors.New("enrichment buffer timeout and max buffered must not be negative")
+	}
+	if e.bufferTimeout == 0 {
+		e.bufferTimeout = DefaultBufferTimeout
+	}
+	if e.maxBuffered == 0 {
+		e.maxBuffered = DefaultMaxBuffered
+	}
+	return e, nil
+}
+
+// RegisterMetrics exposes the number of apps being looked up.
+func (e *Enricher) RegisterMetrics() {
+	metrics.MustRegister(metrics.NewGaugeFunc(
+		"loki_nozzle_enrichment_pending_apps",
+		"Apps being looked up in the app cache in the background.",
+		func() float64 {
+			e.lock.Lock()
+			defer e.lock.Unlock()
+			return float64(len(e.pending))
+		}))
+}
+
+// Start looks apps up in appCache, which may be nil when it failed to start,
+// and starts passing on events that waited too long.
+func (e *Enricher) Start(appCache cache.Cache) {
+	e.cache = appCache
+	e.quit = make(chan struct{})
+	e.done = make(chan struct{})
+	go e.run()
+}
+
+// Stop passes every held event on without metadata. Lookups still in flight
+// are abandoned.
+func (e *Enricher) Stop() {
+	if e.quit == nil {
+		return
+	}
+	close(e.quit)
+	<-e.done
+
+	e.lock.Lock()
+	e.stopped = true
+	var drain []string
+	for guid, p := range e.pending {
+		if !p.draining && len(p.events) > 0 {
+			p.reason, p.expired, p.draining = reasonStopped, true, true
+			e.drains.Add(1)
+			drain = append(drain, guid)
+		}
+	}
+	e.lock.Unlock()
+
+	for _, guid := range drain {
+		e.drain(guid)
+	}
+	e.drains.Wait()
+}
+
+// Add annotates event with the metadata of its app and calls then, which
+// passes event on. then is called right away unless the app must be looked
+// up first and the mode is Buffer; it is then called from another goroutine.
+func (e *Enricher) Add(event *messages.Event, then func()) {
+	guid := event.Labels["cf_app_id"]
+	if guid == "" || e.cache == nil {
+		then()
+		return
+	}
+
+	e.lock.Lock()
+	_, looking := e.pending[guid]
+	e.lock.Unlock()
+	if !looking {
+		if app, known := e.cache.CachedApp(guid); known {
+			messages.Annotate(event, app)
+			then()
+			return
+		}
+	}
+
+	if reason := e.hold(guid, event, then); reason != "" {
+		unenriched.WithLabelValues(reason).Inc()
+		then()
+	}
+}
+
+// hold keeps event until the app is looked up, starting the lookup when
+// none is in flight. It returns why event should rather be passed on right
+// away, or "" when it is held.
+func (e *Enricher) hold(guid string, event *messages.Event, then func()) string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.stopped {
+		return reasonStopped
+	}
+	p, ok := e.pending[guid]
+	if !ok {
+		p = &pendingApp{since: time.Now()}
+		e.pending[guid] = p
+		go e.lookUp(guid)
+	}
+	switch {
+	case p.draining:
+	case e.mode == AppID:
+		return reasonAppID
+	case p.expired:
+		return reasonTimeout
+	case len(p.events) >= e.maxBuffered:
+		return reasonBufferFull
+	}
+	p.events = append(p.events, held{event: event, then: then})
+	return ""
+}
+
+func (e *Enricher) lookUp(guid string) {
+	app, err := e.cache.GetApp(guid)
+	if err != nil {
+		log.Errorf("Encountered an error while getting app info: %v", err)
+	}
+
+	e.lock.Lock()
+	p := e.pending[guid]
+	p.app, p.resolved = app, true
+	if app == nil && !p.expired {
+		p.reason = reasonLookupFailed
+	}
+	start := !p.draining && !e.stopped
+	if start {
+		p.draining = true
+		e.drains.Add(1)
+	}
+	e.lock.Unlock()
+
+	if start {
+		e.drain(guid)
+	}
+}
+
+func (e *Enricher) run() {
+	defer close(e.done)
+	tick := e.bufferTimeout / 4
+	if tick < 10*time.Millisecond {
+		tick = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			e.expire(now)
+		case <-e.quit:
+			return
+		}
+	}
+}
+
+// expire passes on the events of apps that are looked up for longer than
+// the buffer timeout.
+func (e *Enricher) expire(now time.Time) {
+	var drain []string
+	e.lock.Lock()
+	for guid, p := range e.pending {
+		if !p.resolved && !p.expired && !p.draining && now.Sub(p.since) >= e.bufferTimeout {
+			p.reason, p.expired = reasonTimeout, true
+			if len(p.events) > 0 {
+				p.draining = true
+				e.drains.Add(1)
+				drain = append(drain, guid)
+			}
+		}
+	}
+	e.lock.Unlock()
+
+	for _, guid := range drain {
+		e.drain(guid)
+	}
+}
+
+// drain passes on the events held for guid, including those held while it
+// runs, and forgets the app once its lookup is over. The caller sets
+// draining and adds to e.drains.
+func (e *Enricher) drain(guid string) {
+	defer e.drains.Done()
+	for {
+		e.lock.Lock()
+		p := e.pending[guid]
+		events, app, reason := p.events, p.app, p.reason
+		p.events = nil
+		if len(events) == 0 {
+			p.draining = false
+			if p.resolved {
+				delete(e.pending, guid)
+			}
+			e.lock.Unlock()
+			return
+		}
+		e.lock.Unlock()
+
+		for _, h := range events {
+			if app != nil {
+				messages.Annotate(h.event, app)
+			} else {
+				unenriched.WithLabelValues(reason).Inc()
+			}
+			h.then()
+		}
+	}
+}
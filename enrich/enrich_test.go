@@ -0,0 +1,270 @@
+package enrich_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/bosh-loki/loki-firehose-nozzle/cache"
+	. "github.com/bosh-loki/loki-firehose-nozzle/enrich"
+	"github.com/bosh-loki/loki-firehose-nozzle/messages"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// fakeCache knows the apps it was given. GetApp waits for release and
+// caches the app it returns.
+type fakeCache struct {
+	lock    sync.Mutex
+	apps    map[string]*cache.App
+	cached  map[string]bool
+	lookups int
+	release chan struct{}
+}
+
+func newFakeCache() *fakeCache {
+	return &fakeCache{
+		apps:    map[string]*cache.App{},
+		cached:  map[string]bool{},
+		release: make(chan struct{}),
+	}
+}
+
+func (c *fakeCache) Start(context.Context) error { return nil }
+func (c *fakeCache) Stop() error                 { return nil }
+func (c *fakeCache) Populated() bool             { return true }
+func (c *fakeCache) GetAllApps() (map[string]*cache.App, error) {
+	return nil, nil
+}
+
+func (c *fakeCache) GetApp(guid string) (*cache.App, error) {
+	c.lock.Lock()
+	c.lookups++
+	c.lock.Unlock()
+	<-c.release
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	app, ok := c.apps[guid]
+	if !ok {
+		return nil, errors.New("app not found")
+	}
+	c.cached[guid] = true
+	return app, nil
+}
+
+func (c *fakeCache) CachedApp(guid string) (*cache.App, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.cached[guid] {
+		return nil, false
+	}
+	return c.apps[guid], true
+}
+
+func (c *fakeCache) Lookups() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lookups
+}
+
+func (c *fakeCache) addApp(guid string, cached bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.apps[guid] = &cache.App{Guid: guid, Name: guid + "-name", OrgName: "acme"}
+	c.cached[guid] = cached
+}
+
+// collector records the events passed on.
+type collector struct {
+	lock   sync.Mutex
+	events []*messages.Event
+}
+
+func (c *collector) add(e *Enricher, event *messages.Event) {
+	e.Add(event, func() {
+		c.lock.Lock()
+		c.events = append(c.events, event)
+		c.lock.Unlock()
+	})
+}
+
+// Names returns the cf_app_name label of every event passed on, or
+// "-" for events without it, and their lines.
+func (c *collector) Names() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var names []string
+	for _, e := range c.events {
+		name := e.Labels["cf_app_name"]
+		if name == "" {
+			name = "-"
+		}
+		names = append(names, name+" "+e.Msg)
+	}
+	return names
+}
+
+func event(guid, msg string) *messages.Event {
+	return &messages.Event{Labels: messages.LabelSet{"cf_app_id": guid}, Msg: msg}
+}
+
+var _ = Describe("Enricher", func() {
+	var (
+		appCache *fakeCache
+		out      *collector
+	)
+
+	BeforeEach(func() {
+		appCache = newFakeCache()
+		out = &collector{}
+	})
+
+	start := func(cfg Config) *Enricher {
+		e, err := New(cfg)
+		Expect(err).ToNot(HaveOccurred())
+		e.Start(appCache)
+		return e
+	}
+
+	It("passes events of cached apps and without app on right away", func() {
+		appCache.addApp("web", true)
+		e := start(Config{})
+		defer e.Stop()
+
+		out.add(e, event("web", "1"))
+		out.add(e, &messages.Event{Labels: messages.LabelSet{}, Msg: "2"})
+		Expect(out.Names()).To(Equal([]string{"web-name 1", "- 2"}))
+		Expect(appCache.Lookups()).To(Equal(0))
+	})
+
+	It("holds events until their app is looked up once", func() {
+		appCache.addApp("web", false)
+		e := start(Config{})
+		defer e.Stop()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				out.add(e, event("web", "x"))
+			}()
+		}
+		wg.Wait()
+		Consistently(out.Names, 50*time.Millisecond).Should(BeEmpty())
+
+		close(appCache.release)
+		Eventually(out.Names).Should(Equal([]string{"web-name x", "web-name x", "web-name x", "web-name x"}))
+		Expect(appCache.Lookups()).To(Equal(1))
+	})
+
+	It("keeps the order of the events of an app", func() {
+		appCache.addApp("web", false)
+		e := start(Config{})
+		defer e.Stop()
+
+		out.add(e, event("web", "1"))
+		out.add(e, event("web", "2"))
+		close(appCache.release)
+		out.add(e, event("web", "3"))
+		Eventually(out.Names).Should(Equal([]string{"web-name 1", "web-name 2", "web-name 3"}))
+	})
+
+	It("passes held events on without metadata after the timeout", func() {
+		appCache.addApp("web", false)
+		e := start(Config{BufferTimeout: 20 * time.Millisecond})
+		defer e.Stop()
+
+		out.add(e, event("web", "1"))
+		Eventually(out.Names).Should(Equal([]string{"- 1"}))
+		out.add(e, event("web", "2"))
+		Expect(out.Names()).To(Equal([]string{"- 1", "- 2"}))
+
+		close(appCache.release)
+		Eventually(func() bool {
+			_, known := appCache.CachedApp("web")
+			return known
+		}).Should(BeTrue())
+		Eventually(func() []string {
+			out.add(e, event("web", "3"))
+			names := out.Names()
+			return names[len(names)-1:]
+		}).Should(Equal([]string{"web-name 3"}))
+		Expect(appCache.Lookups()).To(Equal(1))
+	})
+
+	It("passes events beyond the buffer on right away", func() {
+		appCache.addApp("web", false)
+		e := start(Config{MaxBuffered: 2})
+		defer e.Stop()
+
+		for _, msg := range []string{"1", "2", "3"} {
+			out.add(e, event("web", msg))
+		}
+		Expect(out.Names()).To(Equal([]string{"- 3"}))
+		close(appCache.release)
+		Eventually(out.Names).Should(Equal([]string{"- 3", "web-name 1", "web-name 2"}))
+	})
+
+	It("passes held events on without metadata when the lookup fails", func() {
+		e := start(Config{})
+		defer e.Stop()
+
+		out.add(e, event("ghost", "1"))
+		close(appCache.release)
+		Eventually(out.Names).Should(Equal([]string{"- 1"}))
+	})
+
+	It("sends events with their app id only in app_id mode", func() {
+		appCache.addApp("web", false)
+		e := start(Config{Mode: AppID})
+		defer e.Stop()
+
+		out.add(e, event("web", "1"))
+		out.add(e, event("web", "2"))
+		Expect(out.Names()).To(Equal([]string{"- 1", "- 2"}))
+		close(appCache.release)
+
+		Eventually(func() bool {
+			_, known := appCache.CachedApp("web")
+			return known
+		}).Should(BeTrue())
+		Eventually(func() []string {
+			out.add(e, event("web", "3"))
+			names := out.Names()
+			return names[len(names)-1:]
+		}).Should(Equal([]string{"web-name 3"}))
+		Expect(appCache.Lookups()).To(Equal(1))
+	})
+
+	It("passes held events on when stopped", func() {
+		appCache.addApp("web", false)
+		e := start(Config{})
+
+		out.add(e, event("web", "1"))
+		e.Stop()
+		Expect(out.Names()).To(Equal([]string{"- 1"}))
+		close(appCache.release)
+	})
+
+	It("passes every event on right away without a cache", func() {
+		e, err := New(Config{})
+		Expect(err).ToNot(HaveOccurred())
+		e.Start(nil)
+		defer e.Stop()
+
+		out.add(e, event("web", "1"))
+		Expect(out.Names()).To(Equal([]string{"- 1"}))
+	})
+
+	It("rejects unknown modes and negative limits", func() {
+		_, err := New(Config{Mode: "sync"})
+		Expect(err).To(HaveOccurred())
+		_, err = New(Config{BufferTimeout: -time.Second})
+		Expect(err).To(HaveOccurred())
+		_, err = New(Config{MaxBuffered: -1})
+		Expect(err).To(HaveOccurred())
+	})
+})
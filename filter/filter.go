@@ -0,0 +1,275 @@
+// Package filter decides which envelopes are shipped to Loki.
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/bosh-loki/loki-firehose-nozzle/messages"
+	"github.com/bosh-loki/loki-firehose-nozzle/metrics"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// Filter actions.
+const (
+	// Include drops every envelope the filter does not match.
+	Include = "include"
+	// Exclude drops every envelope the filter matches.
+	Exclude = "exclude"
+)
+
+// Config is a single filter. A filter matches an envelope when every field
+// that is set matches, and a field matches when any of its patterns does.
+// Patterns are globs ("*" and "?"), or regular expressions when wrapped in
+// slashes, e.g. "/^prod-.*$/". Empty values, such as the org of a platform
+// envelope, never match.
+type Config struct {
+	// Name identifies the filter in metrics; defaults to "filter_<index>".
+	Name   string `toml:"name"`
+	Action string `toml:"action"`
+
+	// Envelope fields, matched before the envelope is decoded.
+	EventTypes  []string `toml:"event_types"`
+	Origins     []string `toml:"origins"`
+	Deployments []string `toml:"deployments"`
+	Jobs        []string `toml:"jobs"`
+
+	// App metadata, matched against names or GUIDs after enrichment.
+	Orgs   []string `toml:"orgs"`
+	Spaces []string `toml:"spaces"`
+	Apps   []string `toml:"apps"`
+}
+
+// Stat is how many envelopes a filter dropped.
+type Stat struct {
+	Name    string
+	Dropped int64
+}
+
+type filter struct {
+	name    string
+	exclude bool
+
+	eventTypes  matcher
+	origins     matcher
+	deployments matcher
+	jobs        matcher
+	orgs        matcher
+	spaces      matcher
+	apps        matcher
+
+	lock    sync.Mutex
+	dropped int64
+}
+
+// Filters is a compiled list of filters. An envelope is shipped only if
+// every filter lets it through.
+type Filters struct {
+	envelope []*filter
+	event    []*filter
+	all      []*filter
+}
+
+// Compile validates cfgs and compiles their patterns.
+func Compile(cfgs []Config) (*Filters, error) {
+	fs := &Filters{}
+	names := map[string]bool{}
+	for i, cfg := range cfgs {
+		f, err := compile(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("filter %d: %s", i, err)
+		}
+		if f.name == "" {
+			f.name = fmt.Sprintf("filter_%d", i)
+		}
+		if names[f.name] {
+			return nil, fmt.Errorf("filter %d: duplicate name %q", i, f.name)
+		}
+		names[f.name] = true
+
+		fs.all = append(fs.all, f)
+		if f.needsEvent() {
+			fs.event = append(fs.event, f)
+		} else {
+			fs.envelope = append(fs.envelope, f)
+		}
+	}
+	return fs, nil
+}
+
+func compile(cfg Config) (*filter, error) {
+	f := &filter{name: cfg.Name}
+	switch strings.ToLower(cfg.Action) {
+	case "", Exclude:
+		f.exclude = true
+	case Include:
+	default:
+		return nil, fmt.Errorf("unknown action %q", cfg.Action)
+	}
+
+	fields := []struct {
+		m        *matcher
+		patterns []string
+	}{
+		{&f.eventTypes, cfg.EventTypes},
+		{&f.origins, cfg.Origins},
+		{&f.deployments, cfg.Deployments},
+		{&f.jobs, cfg.Jobs},
+		{&f.orgs, cfg.Orgs},
+		{&f.spaces, cfg.Spaces},
+		{&f.apps, cfg.Apps},
+	}
+	empty := true
+	for _, field := range fields {
+		m, err := newMatcher(field.patterns)
+		if err != nil {
+			return nil, err
+		}
+		*field.m = m
+		empty = empty && m == nil
+	}
+	if empty {
+		return nil, fmt.Errorf("no patterns")
+	}
+	return f, nil
+}
+
+func (f *filter) needsEvent() bool {
+	return f.orgs != nil || f.spaces != nil || f.apps != nil
+}
+
+func (f *filter) matchEnvelope(e *events.Envelope) bool {
+	return f.eventTypes.match(e.GetEventType().String()) &&
+		f.origins.match(e.GetOrigin()) &&
+		f.deployments.match(e.GetDeployment()) &&
+		f.jobs.match(e.GetJob())
+}
+
+func (f *filter) matchEvent(e *events.Envelope, ls messages.LabelSet) bool {
+	return f.matchEnvelope(e) &&
+		f.orgs.match(ls["cf_org_name"], ls["cf_org_id"]) &&
+		f.spaces.match(ls["cf_space_name"], ls["cf_space_id"]) &&
+		f.apps.match(ls["cf_app_name"], ls["cf_app_id"])
+}
+
+// pass counts the envelope as dropped unless it gets through the filter.
+func (f *filter) pass(matched bool) bool {
+	if matched != f.exclude {
+		return true
+	}
+	f.lock.Lock()
+	f.dropped++
+	f.lock.Unlock()
+	return false
+}
+
+// AllowEnvelope applies the filters that only look at envelope fields. It
+// is meant to run before the envelope is decoded and enriched.
+func (fs *Filters) AllowEnvelope(e *events.Envelope) bool {
+	if fs == nil {
+		return true
+	}
+	for _, f := range fs.envelope {
+		if !f.pass(f.matchEnvelope(e)) {
+			return false
+		}
+	}
+	return true
+}
+
+// AllowEvent applies the filters on app metadata to the enriched labels of
+// an envelope that passed AllowEnvelope.
+func (fs *Filters) AllowEvent(e *events.Envelope, ls messages.LabelSet) bool {
+	if fs == nil {
+		return true
+	}
+	for _, f := range fs.event {
+		if !f.pass(f.matchEvent(e, ls)) {
+			return false
+		}
+	}
+	return true
+}
+
+// RegisterMetrics exposes the drop counts on the default metrics registry.
+// It must be called at most once.
+func (fs *Filters) RegisterMetrics() {
+	metrics.MustRegister(metrics.NewCounterFunc(
+		"loki_nozzle_filter_dropped_envelopes_total",
+		"Envelopes dropped by each filter.",
+		"filter",
+		func() map[string]float64 {
+			dropped := map[string]float64{}
+			for _, s := range fs.Stats() {
+				dropped[s.Name] = float64(s.Dropped)
+			}
+			return dropped
+		}))
+}
+
+// Stats returns how many envelopes each filter dropped, in config order.
+func (fs *Filters) Stats() []Stat {
+	if fs == nil {
+		return nil
+	}
+	stats := make([]Stat, 0, len(fs.all))
+	for _, f := range fs.all {
+		f.lock.Lock()
+		stats = append(stats, Stat{Name: f.name, Dropped: f.dropped})
+		f.lock.Unlock()
+	}
+	return stats
+}
+
+// matcher matches a value against any of its patterns. A nil matcher
+// matches everything.
+type matcher []*regexp.Regexp
+
+func newMatcher(patterns []string) (matcher, error) {
+	var m matcher
+	for _, p := range patterns {
+		var expr string
+		if len(p) >= 2 && strings.HasPrefix(p, "/") && strings.HasSuffix(p, "/") {
+			expr = p[1 : len(p)-1]
+		} else {
+			expr = "^" + globToRegexp(p) + "$"
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %s", p, err)
+		}
+		m = append(m, re)
+	}
+	return m, nil
+}
+
+func (m matcher) match(values ...string) bool {
+	if m == nil {
+		return true
+	}
+	for _, re := range m {
+		for _, v := range values {
+			if v != "" && re.MatchString(v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,81 @@
+package filter_test
+
+import (
+	. "github.com/bosh-loki/loki-firehose-nozzle/filter"
+	"github.com/bosh-loki/loki-firehose-nozzle/messages"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func envelope(eventType events.Envelope_EventType, origin, job string) *events.Envelope {
+	return &events.Envelope{
+		EventType:  eventType.Enum(),
+		Origin:     proto.String(origin),
+		Deployment: proto.String("cf"),
+		Job:        proto.String(job),
+	}
+}
+
+var _ = Describe("Filters", func() {
+	compile := func(cfgs ...Config) *Filters {
+		fs, err := Compile(cfgs)
+		Expect(err).ToNot(HaveOccurred())
+		return fs
+	}
+
+	It("lets everything through without filters", func() {
+		var fs *Filters
+		Expect(fs.AllowEnvelope(envelope(events.Envelope_ValueMetric, "gorouter", "router"))).To(BeTrue())
+		Expect(compile().AllowEnvelope(envelope(events.Envelope_ValueMetric, "gorouter", "router"))).To(BeTrue())
+	})
+
+	It("excludes envelopes by event type and counts them", func() {
+		fs := compile(Config{Name: "metrics", EventTypes: []string{"ValueMetric", "CounterEvent"}})
+		Expect(fs.AllowEnvelope(envelope(events.Envelope_ValueMetric, "gorouter", "router"))).To(BeFalse())
+		Expect(fs.AllowEnvelope(envelope(events.Envelope_CounterEvent, "gorouter", "router"))).To(BeFalse())
+		Expect(fs.AllowEnvelope(envelope(events.Envelope_LogMessage, "rep", "diego-cell"))).To(BeTrue())
+		Expect(fs.Stats()).To(Equal([]Stat{{Name: "metrics", Dropped: 2}}))
+	})
+
+	It("requires every field of a filter to match", func() {
+		fs := compile(Config{EventTypes: []string{"ValueMetric"}, Origins: []string{"gorouter"}})
+		Expect(fs.AllowEnvelope(envelope(events.Envelope_ValueMetric, "gorouter", "router"))).To(BeFalse())
+		Expect(fs.AllowEnvelope(envelope(events.Envelope_ValueMetric, "rep", "diego-cell"))).To(BeTrue())
+		Expect(fs.Stats()[0].Name).To(Equal("filter_0"))
+	})
+
+	It("includes only matching envelopes", func() {
+		fs := compile(Config{Action: Include, Jobs: []string{"diego-*"}})
+		Expect(fs.AllowEnvelope(envelope(events.Envelope_LogMessage, "rep", "diego-cell"))).To(BeTrue())
+		Expect(fs.AllowEnvelope(envelope(events.Envelope_LogMessage, "gorouter", "router"))).To(BeFalse())
+	})
+
+	It("matches app metadata by name or GUID after enrichment", func() {
+		fs := compile(
+			Config{Name: "compliance", Orgs: []string{"/^restricted-.*$/"}},
+			Config{Name: "noisy-app", Apps: []string{"4f3e1b2a-*"}},
+		)
+		e := envelope(events.Envelope_LogMessage, "rep", "diego-cell")
+		Expect(fs.AllowEnvelope(e)).To(BeTrue(), "app filters wait for enrichment")
+
+		Expect(fs.AllowEvent(e, messages.LabelSet{"cf_org_name": "restricted-finance"})).To(BeFalse())
+		Expect(fs.AllowEvent(e, messages.LabelSet{"cf_org_name": "payments", "cf_app_id": "4f3e1b2a-0000"})).To(BeFalse())
+		Expect(fs.AllowEvent(e, messages.LabelSet{"cf_org_name": "payments", "cf_app_id": "11111111-0000"})).To(BeTrue())
+		Expect(fs.AllowEvent(e, messages.LabelSet{})).To(BeTrue(), "platform envelopes have no org")
+		Expect(fs.Stats()).To(Equal([]Stat{{Name: "compliance", Dropped: 1}, {Name: "noisy-app", Dropped: 1}}))
+	})
+
+	It("rejects invalid configs", func() {
+		for _, cfgs := range [][]Config{
+			{{Action: "allow", Origins: []string{"x"}}},
+			{{Name: "empty"}},
+			{{Origins: []string{"/(/"}}},
+			{{Name: "a", Origins: []string{"x"}}, {Name: "a", Jobs: []string{"y"}}},
+		} {
+			_, err := Compile(cfgs)
+			Expect(err).To(HaveOccurred(), "%+v", cfgs)
+		}
+	})
+})
@@ -0,0 +1,147 @@
+// Package level detects the severity of application log lines.
+package level
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/bosh-loki/loki-firehose-nozzle/messages"
+	"github.com/bosh-loki/loki-firehose-nozzle/metrics"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// Detection modes.
+const (
+	// Off disables detection.
+	Off = "off"
+	// Label adds the detected level as the "level" label.
+	Label = "label"
+	// Line leaves the labels alone and prefixes plain text lines with
+	// "level=<level> " so that LogQL's | logfmt finds it. JSON and logfmt
+	// lines that carry a level already are not changed.
+	Line = "line"
+)
+
+// LabelName is the label the level is added as.
+const LabelName = "level"
+
+// Normalized levels.
+const (
+	Trace = "trace"
+	Debug = "debug"
+	Info  = "info"
+	Warn  = "warn"
+	Error = "error"
+	Fatal = "fatal"
+)
+
+var detected = metrics.NewCounterVec(
+	"loki_nozzle_detected_levels_total",
+	"Application log lines by detected level, or \"unknown\".",
+	"level")
+
+func init() {
+	metrics.MustRegister(detected)
+}
+
+var (
+	jsonKeys = []string{"level", "severity", "lvl", "Level", "Severity", "LEVEL"}
+
+	logfmtLevel = regexp.MustCompile(`(?:^|\s)(?:level|severity|lvl)="?([A-Za-z]+)`)
+	// textLevel matches an upper case level, optionally bracketed, among
+	// the first words of a line so that timestamps may precede it.
+	textLevel = regexp.MustCompile(`^(?:\S+\s+){0,3}?[\[(<]?(TRACE|DEBUG|INFO|NOTICE|WARN|WARNING|ERROR|ERR|FATAL|CRITICAL|CRIT|PANIC)[\])>]?(?::|\s|$)`)
+)
+
+// Detector adds the level of application log lines. A nil *Detector does
+// nothing.
+type Detector struct {
+	mode string
+}
+
+// New returns a Detector for mode, or nil when mode is empty or Off.
+func New(mode string) (*Detector, error) {
+	switch mode {
+	case "", Off:
+		return nil, nil
+	case Label, Line:
+		return &Detector{mode: mode}, nil
+	}
+	return nil, fmt.Errorf("unknown level detection mode %q", mode)
+}
+
+// Apply detects the level of a log message event and records it as the mode
+// requires. Other events are left alone.
+func (d *Detector) Apply(e *messages.Event) {
+	if d == nil || e.Labels["event_type"] != events.Envelope_LogMessage.String() {
+		return
+	}
+	lvl, inLine := Detect(e.Msg)
+	if lvl == "" && e.Labels["message_type"] == events.LogMessage_ERR.String() {
+		lvl = Error
+	}
+	if lvl == "" {
+		detected.WithLabelValues("unknown").Inc()
+		return
+	}
+	detected.WithLabelValues(lvl).Inc()
+
+	switch d.mode {
+	case Label:
+		e.Labels[LabelName] = lvl
+	case Line:
+		if !inLine {
+			e.Msg = LabelName + "=" + lvl + " " + e.Msg
+		}
+	}
+}
+
+// Detect returns the normalized level of line, from its JSON fields, its
+// logfmt keys or a text prefix, in that order. structured reports whether
+// the level was read from a JSON field or logfmt key.
+func Detect(line string) (lvl string, structured bool) {
+	trimmed := strings.TrimSpace(line)
+	if strings.HasPrefix(trimmed, "{") {
+		var fields map[string]interface{}
+		if json.Unmarshal([]byte(trimmed), &fields) == nil {
+			for _, k := range jsonKeys {
+				if v, ok := fields[k].(string); ok {
+					if lvl := Normalize(v); lvl != "" {
+						return lvl, true
+					}
+				}
+			}
+		}
+	}
+	if m := logfmtLevel.FindStringSubmatch(trimmed); m != nil {
+		if lvl := Normalize(m[1]); lvl != "" {
+			return lvl, true
+		}
+	}
+	if m := textLevel.FindStringSubmatch(trimmed); m != nil {
+		return Normalize(m[1]), false
+	}
+	return "", false
+}
+
+// Normalize maps the common spellings of a level to one of the normalized
+// levels, or returns "" when s is not a level.
+func Normalize(s string) string {
+	switch strings.ToLower(s) {
+	case "trace", "trc", "finest", "finer":
+		return Trace
+	case "debug", "dbg", "fine":
+		return Debug
+	case "info", "inf", "information", "informational", "notice":
+		return Info
+	case "warn", "warning", "wrn":
+		return Warn
+	case "error", "err", "eror", "severe":
+		return Error
+	case "fatal", "critical", "crit", "panic", "emerg", "emergency", "alert":
+		return Fatal
+	}
+	return ""
+}
@@ -0,0 +1,13 @@
+package level_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestLevel(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Level Suite")
+}
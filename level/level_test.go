@@ -0,0 +1,105 @@
+package level_test
+
+import (
+	. "github.com/bosh-loki/loki-firehose-nozzle/level"
+	"github.com/bosh-loki/loki-firehose-nozzle/messages"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Detect", func() {
+	detect := func(line string) string {
+		lvl, _ := Detect(line)
+		return lvl
+	}
+
+	It("reads JSON fields", func() {
+		Expect(detect(`{"msg":"hi","level":"WARNING"}`)).To(Equal(Warn))
+		Expect(detect(`{"severity":"ERROR","msg":"boom"}`)).To(Equal(Error))
+		Expect(detect(`{"lvl":"dbg"}`)).To(Equal(Debug))
+	})
+
+	It("reads logfmt keys", func() {
+		lvl, structured := Detect(`ts=2020-01-01T00:00:00Z level=info msg="started"`)
+		Expect(lvl).To(Equal(Info))
+		Expect(structured).To(BeTrue())
+		Expect(detect(`severity="crit" msg=x`)).To(Equal(Fatal))
+	})
+
+	It("reads text prefixes, after a timestamp too", func() {
+		for line, want := range map[string]string{
+			"ERROR: connection refused":                         Error,
+			"[WARN] disk almost full":                           Warn,
+			"2020-01-01 12:00:00.000  INFO 1234 --- [main] App": Info,
+			"12:00:00 DEBUG starting":                           Debug,
+			"FATAL":                                             Fatal,
+		} {
+			lvl, structured := Detect(line)
+			Expect(lvl).To(Equal(want), line)
+			Expect(structured).To(BeFalse(), line)
+		}
+	})
+
+	It("does not guess from words in the message", func() {
+		Expect(detect("the user said there was no error at all")).To(Equal(""))
+		Expect(detect(`{"level":"chatty"}`)).To(Equal(""))
+	})
+})
+
+var _ = Describe("Detector", func() {
+	logEvent := func(messageType, msg string) *messages.Event {
+		return &messages.Event{
+			Labels: messages.LabelSet{"event_type": "LogMessage", "message_type": messageType},
+			Msg:    msg,
+		}
+	}
+
+	It("adds a level label", func() {
+		d, err := New(Label)
+		Expect(err).ToNot(HaveOccurred())
+		e := logEvent("OUT", "WARN slow request")
+		d.Apply(e)
+		Expect(e.Labels).To(HaveKeyWithValue("level", "warn"))
+		Expect(e.Msg).To(Equal("WARN slow request"))
+	})
+
+	It("falls back to error for stderr", func() {
+		d, _ := New(Label)
+		e := logEvent("ERR", "something happened")
+		d.Apply(e)
+		Expect(e.Labels).To(HaveKeyWithValue("level", "error"))
+
+		e = logEvent("OUT", "something happened")
+		d.Apply(e)
+		Expect(e.Labels).ToNot(HaveKey("level"))
+	})
+
+	It("keeps the level in the line only", func() {
+		d, _ := New(Line)
+		e := logEvent("ERR", "something happened")
+		d.Apply(e)
+		Expect(e.Labels).ToNot(HaveKey("level"))
+		Expect(e.Msg).To(Equal("level=error something happened"))
+
+		e = logEvent("OUT", `{"level":"info"}`)
+		d.Apply(e)
+		Expect(e.Msg).To(Equal(`{"level":"info"}`))
+	})
+
+	It("leaves other events alone", func() {
+		d, _ := New(Label)
+		e := &messages.Event{Labels: messages.LabelSet{"event_type": "Error"}, Msg: "ERROR boom"}
+		d.Apply(e)
+		Expect(e.Labels).ToNot(HaveKey("level"))
+	})
+
+	It("is disabled by default and rejects unknown modes", func() {
+		d, err := New("")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(d).To(BeNil())
+		d.Apply(logEvent("ERR", "x"))
+
+		_, err = New("loud")
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,103 @@
+package lokiclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// TLSConfig configures the TLS connection to Loki.
+type TLSConfig struct {
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	InsecureSkipVerify bool
+}
+
+// AuthConfig configures how the client authenticates to Loki. At most one
+// of basic auth, BearerToken and BearerTokenFile may be set.
+type AuthConfig struct {
+	Username    string
+	Password    string
+	BearerToken string
+	// BearerTokenFile is re-read before every push so rotated tokens are
+	// picked up without a restart.
+	BearerTokenFile string
+}
+
+func (a AuthConfig) validate() error {
+	set := 0
+	if a.Username != "" || a.Password != "" {
+		set++
+	}
+	if a.BearerToken != "" {
+		set++
+	}
+	if a.BearerTokenFile != "" {
+		set++
+	}
+	if set > 1 {
+		return errors.New("at most one of basic auth, bearer token and bearer token file may be configured")
+	}
+	return nil
+}
+
+// authorize adds credentials to req.
+func (a AuthConfig) authorize(req *http.Request) error {
+	switch {
+	case a.Username != "" || a.Password != "":
+		req.SetBasicAuth(a.Username, a.Password)
+	case a.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+a.BearerToken)
+	case a.BearerTokenFile != "":
+		token, err := ioutil.ReadFile(a.BearerTokenFile)
+		if err != nil {
+			return fmt.Errorf("unable to read bearer token file %s: %s", a.BearerTokenFile, err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	return nil
+}
+
+func newHTTPClient(cfg TLSConfig) (*http.Client, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+
+	if cfg.CAFile != "" {
+		ca, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA file %s: %s", cfg.CAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		if cfg.CertFile == "" || cfg.KeyFile == "" {
+			return nil, errors.New("both cert file and key file are required for client certificates")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     tlsConfig,
+			TLSHandshakeTimeout: 10 * time.Second,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}, nil
+}
@@ -0,0 +1,122 @@
+package lokiclient_test
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "github.com/bosh-loki/loki-firehose-nozzle/lokiclient"
+	"github.com/bosh-loki/loki-firehose-nozzle/messages"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Authentication and TLS", func() {
+	var (
+		server  *httptest.Server
+		lock    sync.Mutex
+		headers []http.Header
+		tmpDir  string
+	)
+
+	BeforeEach(func() {
+		headers = nil
+		server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			headers = append(headers, r.Header)
+			lock.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		}))
+
+		var err error
+		tmpDir, err = ioutil.TempDir("", "lokiclient")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(tmpDir)
+	})
+
+	receivedHeaders := func() []http.Header {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]http.Header(nil), headers...)
+	}
+
+	writeCA := func() string {
+		path := filepath.Join(tmpDir, "ca.pem")
+		ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+		Expect(ioutil.WriteFile(path, ca, 0600)).To(Succeed())
+		return path
+	}
+
+	newClient := func(auth AuthConfig, tlsConfig TLSConfig) *Client {
+		cfg := DefaultConfig()
+		cfg.URL = server.URL + "/api/prom/push"
+		cfg.BatchWait = 10 * time.Millisecond
+		cfg.BackoffConfig = BackoffConfig{MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxRetries: 2}
+		cfg.Auth = auth
+		cfg.TLSConfig = tlsConfig
+		client, err := New(cfg)
+		Expect(err).ToNot(HaveOccurred())
+		return client
+	}
+
+	It("verifies Loki against a custom CA and sends basic auth", func() {
+		client := newClient(AuthConfig{Username: "loki", Password: "secret"}, TLSConfig{CAFile: writeCA()})
+		Expect(client.Handle(messages.LabelSet{"job": "router"}, time.Now(), "hello")).To(Succeed())
+		client.Stop()
+
+		Expect(receivedHeaders()).To(HaveLen(1))
+		req := &http.Request{Header: receivedHeaders()[0]}
+		user, pass, ok := req.BasicAuth()
+		Expect(ok).To(BeTrue())
+		Expect(user).To(Equal("loki"))
+		Expect(pass).To(Equal("secret"))
+	})
+
+	It("fails to push to an unknown CA without insecure_skip_verify", func() {
+		client := newClient(AuthConfig{}, TLSConfig{})
+		Expect(client.Handle(messages.LabelSet{"job": "router"}, time.Now(), "hello")).To(Succeed())
+		client.Stop()
+
+		Expect(receivedHeaders()).To(BeEmpty())
+	})
+
+	It("re-reads the bearer token file before every push", func() {
+		tokenFile := filepath.Join(tmpDir, "token")
+		Expect(ioutil.WriteFile(tokenFile, []byte("first\n"), 0600)).To(Succeed())
+
+		client := newClient(AuthConfig{BearerTokenFile: tokenFile}, TLSConfig{InsecureSkipVerify: true})
+		Expect(client.Handle(messages.LabelSet{"job": "router"}, time.Now(), "one")).To(Succeed())
+		Eventually(receivedHeaders).Should(HaveLen(1))
+
+		Expect(ioutil.WriteFile(tokenFile, []byte("second\n"), 0600)).To(Succeed())
+		Expect(client.Handle(messages.LabelSet{"job": "router"}, time.Now(), "two")).To(Succeed())
+		Eventually(receivedHeaders).Should(HaveLen(2))
+		client.Stop()
+
+		Expect(receivedHeaders()[0].Get("Authorization")).To(Equal("Bearer first"))
+		Expect(receivedHeaders()[1].Get("Authorization")).To(Equal("Bearer second"))
+	})
+
+	It("rejects conflicting credentials", func() {
+		cfg := DefaultConfig()
+		cfg.Auth = AuthConfig{Username: "loki", BearerToken: "token"}
+		_, err := New(cfg)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("rejects a client certificate without a key", func() {
+		cfg := DefaultConfig()
+		cfg.TLSConfig = TLSConfig{CertFile: "cert.pem"}
+		_, err := New(cfg)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -68,6 +68,19 @@ func (b *Backoff) NumRetries() int {
 	return b.numRetries
 }
 
+// WaitFor sleeps for d instead of the backoff time, e.g. when the server told
+// us how long to wait, then increases the retry count
+// Returns immediately if Context is terminated
+func (b *Backoff) WaitFor(d time.Duration) {
+	b.numRetries++
+	if b.Ongoing() {
+		select {
+		case <-b.ctx.Done():
+		case <-time.After(d):
+		}
+	}
+}
+
 // Wait sleeps for the backoff time then increases the retry count and backoff time
 // Returns immediately if Context is terminated
 func (b *Backoff) Wait() {
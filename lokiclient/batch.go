@@ -0,0 +1,91 @@
+package lokiclient
+
+import (
+	"hash/fnv"
+	"time"
+
+	"github.com/bosh-loki/loki-firehose-nozzle/messages"
+)
+
+// batch holds the pending entries of one tenant, grouped by stream.
+type batch struct {
+	tenant  string
+	streams map[string]*stream
+	bytes   int
+	// created is when the batch was started; it is pushed once it is
+	// older than BatchWait.
+	created time.Time
+}
+
+// stream is a set of entries sharing one label set.
+type stream struct {
+	labels  messages.LabelSet
+	entries []logEntry
+}
+
+type logEntry struct {
+	ts   time.Time
+	line string
+}
+
+func newBatch(tenant string) *batch {
+	return &batch{
+		tenant:  tenant,
+		streams: map[string]*stream{},
+		created: time.Now(),
+	}
+}
+
+func (b *batch) add(e entry) {
+	b.bytes += len(e.line)
+	fp := e.labels.String()
+	s, ok := b.streams[fp]
+	if !ok {
+		s = &stream{
+			labels: e.labels,
+		}
+		b.streams[fp] = s
+	}
+	s.entries = append(s.entries, e.logEntry)
+}
+
+// age returns how long ago the batch was started.
+func (b *batch) age(now time.Time) time.Duration {
+	return now.Sub(b.created)
+}
+
+func (b *batch) empty() bool {
+	return len(b.streams) == 0
+}
+
+// count returns the number of entries in the batch.
+func (b *batch) count() int {
+	n := 0
+	for _, s := range b.streams {
+		n += len(s.entries)
+	}
+	return n
+}
+
+// split partitions the batch into n batches so that each stream always lands
+// in the same partition. Empty partitions are nil.
+func (b *batch) split(n int) []*batch {
+	parts := make([]*batch, n)
+	for fp, s := range b.streams {
+		i := shard(fp, n)
+		if parts[i] == nil {
+			parts[i] = newBatch(b.tenant)
+		}
+		parts[i].streams[fp] = s
+		for _, e := range s.entries {
+			parts[i].bytes += len(e.line)
+		}
+	}
+	return parts
+}
+
+func shard(fp string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(fp))
+	return int(h.Sum32() % uint32(n))
+}
@@ -0,0 +1,202 @@
+package lokiclient
+
+import (
+	"encoding/json"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// Loki reports rejected entries one per line, e.g.
+//
+//	entry with timestamp 2019-06-18 09:21:33 +0000 UTC ignored, reason: 'entry out of order' for stream: {job="x"},
+//	entry for stream '{job="x"}' has timestamp too old: 2019-06-11 09:21:33 +0000 UTC
+//	Per stream rate limit exceeded (limit: 3MB/sec) while attempting to ingest for stream '{job="x"}' totaling 5MB, ...
+var (
+	rejectedEntryRE  = regexp.MustCompile(`entry with timestamp (.+?) ignored, reason: '([^']*)',? for stream: (\{.*\}),?\s*$`)
+	rejectedStreamRE = regexp.MustCompile(`stream '(\{.*\})'`)
+)
+
+const lokiTimeLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+// rejection identifies what Loki refused in a batch. A zero ts rejects the
+// whole stream.
+type rejection struct {
+	stream string
+	ts     time.Time
+	reason string
+}
+
+// parseRejections extracts the rejected streams and entries from the body
+// of a 400 response. ok is false when a line names a stream that could not
+// be parsed.
+func parseRejections(body string) (rejections []rejection, ok bool) {
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		if m := rejectedEntryRE.FindStringSubmatch(line); m != nil {
+			ts, err := time.Parse(lokiTimeLayout, m[1])
+			if err != nil {
+				// Unknown timestamp format; reject the whole stream.
+				ts = time.Time{}
+			}
+			rejections = append(rejections, rejection{stream: m[3], ts: ts, reason: m[2]})
+			continue
+		}
+		if m := rejectedStreamRE.FindStringSubmatch(line); m != nil {
+			rejections = append(rejections, rejection{stream: m[1], reason: line})
+			continue
+		}
+		if strings.Contains(line, "stream") {
+			return nil, false
+		}
+	}
+	return rejections, true
+}
+
+// deadLetterRejected moves the entries of b that Loki reported rejecting
+// into the dead-letter sink.
+//
+// It assumes Loki stored every other entry of the batch: the distributor
+// appends the entries it accepts and answers 400 only for the ones it
+// refused, so they are counted as sent and never pushed again. Only when
+// the response cannot be parsed into rejections of streams in b is the
+// whole batch dead-lettered.
+func (c *Client) deadLetterRejected(b *batch, body string) {
+	rejections, ok := parseRejections(body)
+
+	byStream := map[string][]rejection{}
+	for _, r := range rejections {
+		if _, found := b.streams[r.stream]; !found {
+			ok = false
+			break
+		}
+		byStream[r.stream] = append(byStream[r.stream], r)
+	}
+
+	if !ok || len(rejections) == 0 {
+		log.Warnf("Could not parse which entries Loki rejected, dead-lettering the whole batch: %s", firstLine(body))
+		for fp, s := range b.streams {
+			c.deadLetter(b.tenant, fp, s.entries, firstLine(body))
+		}
+		return
+	}
+
+	dropped := 0
+	for fp, rs := range byStream {
+		for _, e := range b.streams[fp].entries {
+			if reason, match := matchRejection(rs, e); match {
+				c.deadLetter(b.tenant, fp, []logEntry{e}, reason)
+				dropped++
+			}
+		}
+	}
+	if dropped == 0 {
+		log.Warnf("None of the entries Loki rejected are in the batch: %s", firstLine(body))
+	}
+	sentEntries.Add(float64(b.count() - dropped))
+}
+
+func matchRejection(rs []rejection, e logEntry) (string, bool) {
+	for _, r := range rs {
+		if r.ts.IsZero() || r.ts.Equal(e.ts) {
+			return r.reason, true
+		}
+	}
+	return "", false
+}
+
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+func (c *Client) deadLetter(tenant, stream string, entries []logEntry, reason string) {
+	c.deadLetters.write(tenant, stream, entries, reason)
+	droppedEntries.WithLabelValues(dropRejected).Add(float64(len(entries)))
+	c.statsLock.Lock()
+	c.rejected += int64(len(entries))
+	c.statsLock.Unlock()
+}
+
+// RejectedEntries returns the number of entries Loki refused that were sent
+// to the dead-letter sink.
+func (c *Client) RejectedEntries() int64 {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+	return c.rejected
+}
+
+// deadLetterSink records entries Loki rejected.
+type deadLetterSink interface {
+	write(tenant, stream string, entries []logEntry, reason string)
+	close() error
+}
+
+func newDeadLetterSink(path string) (deadLetterSink, error) {
+	if path == "" {
+		return logDeadLetters{}, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &fileDeadLetters{file: f, enc: json.NewEncoder(f)}, nil
+}
+
+// logDeadLetters logs rejected entries.
+type logDeadLetters struct{}
+
+func (logDeadLetters) write(tenant, stream string, entries []logEntry, reason string) {
+	for _, e := range entries {
+		log.Warnf("Loki rejected entry (tenant=%q stream=%s ts=%s reason=%q): %s", tenant, stream, e.ts.Format(time.RFC3339Nano), reason, e.line)
+	}
+}
+
+func (logDeadLetters) close() error {
+	return nil
+}
+
+// fileDeadLetters appends rejected entries to a file as JSON lines.
+type fileDeadLetters struct {
+	lock sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+type deadLetterRecord struct {
+	Tenant    string    `json:"tenant,omitempty"`
+	Stream    string    `json:"stream"`
+	Timestamp time.Time `json:"ts"`
+	Line      string    `json:"line"`
+	Reason    string    `json:"reason"`
+}
+
+func (f *fileDeadLetters) write(tenant, stream string, entries []logEntry, reason string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, e := range entries {
+		err := f.enc.Encode(deadLetterRecord{
+			Tenant:    tenant,
+			Stream:    stream,
+			Timestamp: e.ts,
+			Line:      e.line,
+			Reason:    reason,
+		})
+		if err != nil {
+			log.Errorf("Error writing dead letter to %s: %s", f.file.Name(), err)
+			return
+		}
+	}
+}
+
+func (f *fileDeadLetters) close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.file.Close()
+}
@@ -0,0 +1,180 @@
+package lokiclient_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "github.com/bosh-loki/loki-firehose-nozzle/lokiclient"
+	"github.com/bosh-loki/loki-firehose-nozzle/messages"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Rejected entries", func() {
+	type pushed struct {
+		Streams []struct {
+			Stream map[string]string `json:"stream"`
+			Values [][2]string       `json:"values"`
+		} `json:"streams"`
+	}
+
+	var (
+		server   *httptest.Server
+		dir      string
+		lock     sync.Mutex
+		rejectBy string
+		bodies   []pushed
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "deadletter")
+		Expect(err).ToNot(HaveOccurred())
+
+		rejectBy, bodies = "", nil
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var p pushed
+			Expect(json.NewDecoder(r.Body).Decode(&p)).To(Succeed())
+			lock.Lock()
+			defer lock.Unlock()
+			bodies = append(bodies, p)
+			if len(bodies) == 1 && rejectBy != "" {
+				http.Error(w, rejectBy, http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(dir)
+	})
+
+	newClient := func() *Client {
+		cfg := DefaultConfig()
+		cfg.URL = server.URL + "/loki/api/v1/push"
+		cfg.PushAPI = PushAPIV1
+		cfg.Encoding = EncodingJSON
+		cfg.BatchWait = 20 * time.Millisecond
+		cfg.BackoffConfig = BackoffConfig{MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxRetries: 3}
+		cfg.DeadLetterPath = filepath.Join(dir, "rejected.log")
+		client, err := New(cfg)
+		Expect(err).ToNot(HaveOccurred())
+		return client
+	}
+
+	requests := func() []pushed {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]pushed(nil), bodies...)
+	}
+
+	deadLetters := func() []map[string]interface{} {
+		f, err := os.Open(filepath.Join(dir, "rejected.log"))
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+		var records []map[string]interface{}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var rec map[string]interface{}
+			Expect(json.Unmarshal(scanner.Bytes(), &rec)).To(Succeed())
+			records = append(records, rec)
+		}
+		return records
+	}
+
+	It("dead-letters the rejected stream without resending the ones Loki stored", func() {
+		rejectBy = `entry for stream '{job="bad"}' has timestamp too old: 2019-06-11 09:21:33 +0000 UTC`
+		client := newClient()
+		ts := time.Now()
+		Expect(client.Handle(messages.LabelSet{"job": "bad"}, ts, "stale")).To(Succeed())
+		Expect(client.Handle(messages.LabelSet{"job": "good"}, ts, "fresh")).To(Succeed())
+
+		Eventually(client.RejectedEntries).Should(BeEquivalentTo(1))
+		client.Stop()
+		Expect(requests()).To(HaveLen(1))
+
+		records := deadLetters()
+		Expect(records).To(HaveLen(1))
+		Expect(records[0]["stream"]).To(Equal(`{job="bad"}`))
+		Expect(records[0]["line"]).To(Equal("stale"))
+		Expect(records[0]["reason"]).To(ContainSubstring("timestamp too old"))
+	})
+
+	It("dead-letters only the out-of-order entries of a stream", func() {
+		ts := time.Unix(1560849693, 0).UTC()
+		rejectBy = "entry with timestamp " + ts.String() + ` ignored, reason: 'entry out of order' for stream: {job="x"},`
+		client := newClient()
+		Expect(client.Handle(messages.LabelSet{"job": "x"}, ts, "late")).To(Succeed())
+		Expect(client.Handle(messages.LabelSet{"job": "x"}, ts.Add(time.Second), "on time")).To(Succeed())
+
+		Eventually(client.RejectedEntries).Should(BeEquivalentTo(1))
+		client.Stop()
+		Expect(requests()).To(HaveLen(1))
+
+		records := deadLetters()
+		Expect(records).To(HaveLen(1))
+		Expect(records[0]["line"]).To(Equal("late"))
+		Expect(records[0]["reason"]).To(Equal("entry out of order"))
+	})
+
+	It("matches streams whose label values contain quotes", func() {
+		rejectBy = `entry for stream '{job="o'brien"}' has timestamp too old: 2019-06-11 09:21:33 +0000 UTC`
+		client := newClient()
+		Expect(client.Handle(messages.LabelSet{"job": "o'brien"}, time.Now(), "stale")).To(Succeed())
+		Expect(client.Handle(messages.LabelSet{"job": "good"}, time.Now(), "fresh")).To(Succeed())
+
+		Eventually(client.RejectedEntries).Should(BeEquivalentTo(1))
+		client.Stop()
+
+		records := deadLetters()
+		Expect(records).To(HaveLen(1))
+		Expect(records[0]["stream"]).To(Equal(`{job="o'brien"}`))
+	})
+
+	It("dead-letters the whole batch when a rejected stream is not in it", func() {
+		rejectBy = `entry for stream '{job="unknown"}' has timestamp too old: 2019-06-11 09:21:33 +0000 UTC`
+		client := newClient()
+		Expect(client.Handle(messages.LabelSet{"job": "a"}, time.Now(), "one")).To(Succeed())
+		Expect(client.Handle(messages.LabelSet{"job": "b"}, time.Now(), "two")).To(Succeed())
+
+		Eventually(client.RejectedEntries).Should(BeEquivalentTo(2))
+		client.Stop()
+		Expect(requests()).To(HaveLen(1))
+	})
+
+	It("dead-letters nothing when the rejected entries are not in the batch", func() {
+		ts := time.Unix(1560849693, 0).UTC()
+		rejectBy = "entry with timestamp " + ts.Add(-time.Second).String() + ` ignored, reason: 'entry out of order' for stream: {job="x"},`
+		client := newClient()
+		Expect(client.Handle(messages.LabelSet{"job": "x"}, ts, "one")).To(Succeed())
+		Expect(client.Handle(messages.LabelSet{"job": "x"}, ts.Add(time.Second), "two")).To(Succeed())
+
+		Eventually(requests).Should(HaveLen(1))
+		client.Stop()
+
+		Expect(requests()).To(HaveLen(1))
+		Expect(client.RejectedEntries()).To(BeZero())
+	})
+
+	It("dead-letters the whole batch when the response cannot be parsed", func() {
+		rejectBy = "error parsing labels: syntax error"
+		client := newClient()
+		Expect(client.Handle(messages.LabelSet{"job": "a"}, time.Now(), "one")).To(Succeed())
+		Expect(client.Handle(messages.LabelSet{"job": "b"}, time.Now(), "two")).To(Succeed())
+
+		Eventually(client.RejectedEntries).Should(BeEquivalentTo(2))
+		client.Stop()
+
+		Expect(requests()).To(HaveLen(1))
+		Expect(deadLetters()).To(HaveLen(2))
+	})
+})
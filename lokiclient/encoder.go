@@ -0,0 +1,241 @@
+package lokiclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/bosh-loki/loki-firehose-nozzle/logproto"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/golang/snappy"
+)
+
+// Supported push APIs.
+const (
+	PushAPILegacy = "legacy"
+	PushAPIV1     = "v1"
+)
+
+// Supported request body encodings.
+const (
+	EncodingProtobuf = "protobuf"
+	EncodingJSON     = "json"
+)
+
+const (
+	legacyPushPath = "/api/prom/push"
+	v1PushPath     = "/loki/api/v1/push"
+
+	protobufContentType = "application/x-protobuf"
+	jsonContentType     = "application/json"
+)
+
+// PushPath returns the URL path Loki serves the given push API on.
+func PushPath(api string) (string, error) {
+	switch api {
+	case "", PushAPILegacy:
+		return legacyPushPath, nil
+	case PushAPIV1:
+		return v1PushPath, nil
+	}
+	return "", fmt.Errorf("unknown push api %q", api)
+}
+
+// encoder serializes a batch into the body of a push request, and reads
+// such a body back so that the entries of a spooled batch can be
+// dead-lettered. Decoded streams are keyed like the batch they came from.
+type encoder interface {
+	encode(streams map[string]*stream) ([]byte, error)
+	decode(body []byte) (map[string]*stream, error)
+	contentType() string
+}
+
+func newEncoder(api, encoding string) (encoder, error) {
+	if _, err := PushPath(api); err != nil {
+		return nil, err
+	}
+	switch encoding {
+	case "", EncodingProtobuf:
+		// Both APIs accept the same snappy-compressed PushRequest on the wire.
+		return protobufEncoder{}, nil
+	case EncodingJSON:
+		if api == PushAPIV1 {
+			return v1JSONEncoder{}, nil
+		}
+		return legacyJSONEncoder{}, nil
+	}
+	return nil, fmt.Errorf("unknown encoding %q", encoding)
+}
+
+type protobufEncoder struct{}
+
+func (protobufEncoder) contentType() string {
+	return protobufContentType
+}
+
+func (protobufEncoder) encode(streams map[string]*stream) ([]byte, error) {
+	req := logproto.PushRequest{
+		Streams: make([]*logproto.Stream, 0, len(streams)),
+	}
+	for fp, s := range streams {
+		ps := &logproto.Stream{
+			Labels:  fp,
+			Entries: make([]*logproto.Entry, 0, len(s.entries)),
+		}
+		for _, e := range s.entries {
+			ps.Entries = append(ps.Entries, &logproto.Entry{
+				Timestamp: &timestamp.Timestamp{
+					Seconds: e.ts.Unix(),
+					Nanos:   int32(e.ts.Nanosecond()),
+				},
+				Line: e.line,
+			})
+		}
+		req.Streams = append(req.Streams, ps)
+	}
+	buf, err := proto.Marshal(&req)
+	if err != nil {
+		return nil, err
+	}
+	return snappy.Encode(nil, buf), nil
+}
+
+func (protobufEncoder) decode(body []byte) (map[string]*stream, error) {
+	buf, err := snappy.Decode(nil, body)
+	if err != nil {
+		return nil, err
+	}
+	var req logproto.PushRequest
+	if err := proto.Unmarshal(buf, &req); err != nil {
+		return nil, err
+	}
+	streams := make(map[string]*stream, len(req.Streams))
+	for _, ps := range req.Streams {
+		s := &stream{}
+		for _, e := range ps.Entries {
+			s.entries = append(s.entries, logEntry{
+				ts:   time.Unix(e.Timestamp.GetSeconds(), int64(e.Timestamp.GetNanos())),
+				line: e.Line,
+			})
+		}
+		streams[ps.Labels] = s
+	}
+	return streams, nil
+}
+
+// legacyJSONEncoder speaks the JSON flavour of /api/prom/push.
+type legacyJSONEncoder struct{}
+
+type legacyJSONStream struct {
+	Labels  string            `json:"labels"`
+	Entries []legacyJSONEntry `json:"entries"`
+}
+
+type legacyJSONEntry struct {
+	Ts   string `json:"ts"`
+	Line string `json:"line"`
+}
+
+func (legacyJSONEncoder) contentType() string {
+	return jsonContentType
+}
+
+func (legacyJSONEncoder) encode(streams map[string]*stream) ([]byte, error) {
+	req := struct {
+		Streams []legacyJSONStream `json:"streams"`
+	}{
+		Streams: make([]legacyJSONStream, 0, len(streams)),
+	}
+	for fp, s := range streams {
+		js := legacyJSONStream{
+			Labels:  fp,
+			Entries: make([]legacyJSONEntry, 0, len(s.entries)),
+		}
+		for _, e := range s.entries {
+			js.Entries = append(js.Entries, legacyJSONEntry{
+				Ts:   e.ts.UTC().Format(time.RFC3339Nano),
+				Line: e.line,
+			})
+		}
+		req.Streams = append(req.Streams, js)
+	}
+	return json.Marshal(req)
+}
+
+func (legacyJSONEncoder) decode(body []byte) (map[string]*stream, error) {
+	var req struct {
+		Streams []legacyJSONStream `json:"streams"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, err
+	}
+	streams := make(map[string]*stream, len(req.Streams))
+	for _, js := range req.Streams {
+		s := &stream{}
+		for _, e := range js.Entries {
+			ts, err := time.Parse(time.RFC3339Nano, e.Ts)
+			if err != nil {
+				return nil, err
+			}
+			s.entries = append(s.entries, logEntry{ts: ts, line: e.Line})
+		}
+		streams[js.Labels] = s
+	}
+	return streams, nil
+}
+
+// v1JSONEncoder speaks the JSON flavour of /loki/api/v1/push.
+type v1JSONEncoder struct{}
+
+type v1JSONStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+func (v1JSONEncoder) contentType() string {
+	return jsonContentType
+}
+
+func (v1JSONEncoder) encode(streams map[string]*stream) ([]byte, error) {
+	req := struct {
+		Streams []v1JSONStream `json:"streams"`
+	}{
+		Streams: make([]v1JSONStream, 0, len(streams)),
+	}
+	for _, s := range streams {
+		js := v1JSONStream{
+			Stream: s.labels,
+			Values: make([][2]string, 0, len(s.entries)),
+		}
+		for _, e := range s.entries {
+			js.Values = append(js.Values, [2]string{strconv.FormatInt(e.ts.UnixNano(), 10), e.line})
+		}
+		req.Streams = append(req.Streams, js)
+	}
+	return json.Marshal(req)
+}
+
+func (v1JSONEncoder) decode(body []byte) (map[string]*stream, error) {
+	var req struct {
+		Streams []v1JSONStream `json:"streams"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, err
+	}
+	streams := make(map[string]*stream, len(req.Streams))
+	for _, js := range req.Streams {
+		s := &stream{labels: js.Stream}
+		for _, v := range js.Values {
+			ns, err := strconv.ParseInt(v[0], 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			s.entries = append(s.entries, logEntry{ts: time.Unix(0, ns), line: v[1]})
+		}
+		streams[s.labels.String()] = s
+	}
+	return streams, nil
+}
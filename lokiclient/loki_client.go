@@ -1,60 +1,116 @@
 package lokiclient
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/bosh-loki/loki-firehose-nozzle/messages"
 
 	"github.com/prometheus/common/log"
-
-	"github.com/golang/protobuf/ptypes/timestamp"
-
-	"github.com/bosh-loki/loki-firehose-nozzle/logproto"
-	"github.com/gogo/protobuf/proto"
-	"github.com/golang/snappy"
 )
 
-const contentType = "application/x-protobuf"
-const maxErrMsgLen = 1024
+const (
+	maxErrMsgLen  = 1024
+	maxErrBodyLen = 64 * 1024
+)
 
 // Config describes configuration for a HTTP pusher client.
 type Config struct {
 	URL       string
+	PushAPI   string
+	Encoding  string
 	BatchWait time.Duration
 	BatchSize int
 
+	// Senders is the number of goroutines pushing batches concurrently and
+	// MaxInFlight bounds the batches handed to them but not yet pushed.
+	// A stream is always pushed by the same sender, so its entries reach
+	// Loki in order.
+	Senders     int
+	MaxInFlight int
+
+	// QueueCapacity bounds the number of entries waiting to be batched;
+	// OverflowPolicy decides what Handle does when the queue is full.
+	QueueCapacity  int
+	OverflowPolicy string
+
+	// TenantLabel names the label whose value is used as the Loki tenant
+	// (X-Scope-OrgID); entries without it, or whose value Loki would not
+	// accept as a tenant ID, go to DefaultTenant.
+	TenantLabel   string
+	DefaultTenant string
+
+	Auth      AuthConfig
+	TLSConfig TLSConfig
+	Spool     SpoolConfig
+	Rate      RateConfig
+
+	// DeadLetterPath is a file that entries Loki rejects with a 400 are
+	// appended to as JSON lines; if empty they are logged.
+	DeadLetterPath string
+
 	BackoffConfig  BackoffConfig     `yaml:"backoff_config"`
 	ExternalLabels messages.LabelSet `yaml:"external_labels,omitempty"`
 	Timeout        time.Duration     `yaml:"timeout"`
 }
 
-// Client for pushing logs in snappy-compressed protos over HTTP.
+// Client for pushing logs to Loki over HTTP.
 type Client struct {
 	cfg            Config
+	encoder        encoder
+	httpClient     *http.Client
+	limiter        *adaptiveLimiter
+	deadLetters    deadLetterSink
+	spool          *spool
 	quit           chan struct{}
-	entries        chan entry
+	queue          *queue
+	senders        []chan *batch
+	inFlight       chan struct{}
+	sendersWg      sync.WaitGroup
 	wg             sync.WaitGroup
 	externalLabels messages.LabelSet
 	stopLock       sync.Mutex
 	stopped        bool
+
+	// ctx is cancelled when a shutdown deadline passes, aborting
+	// in-flight pushes and retries.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	statsLock sync.Mutex
+	rejected  int64
+	lastPush  PushStatus
+}
+
+// PushStatus describes the outcome of the most recent push request.
+type PushStatus struct {
+	// Time is zero until the first push completes.
+	Time time.Time
+	// Err is set when Loki could not be reached or answered with a status
+	// worth retrying. Entries Loki refuses, e.g. with a 400, do not make it
+	// unhealthy.
+	Err error
 }
 
 type entry struct {
 	labels messages.LabelSet
-	logproto.Entry
+	logEntry
 }
 
-// NewWithDefaults makes a new Client with default config.
-func NewWithDefaults(url string, externalLabels messages.LabelSet) (*Client, error) {
-	cfg := Config{
-		URL:       url,
+// DefaultConfig returns a Config with default batching and backoff settings
+// for the legacy push API.
+func DefaultConfig() Config {
+	return Config{
+		PushAPI:   PushAPILegacy,
+		Encoding:  EncodingProtobuf,
 		BatchWait: time.Second,
 		BatchSize: 100 * 1024,
 		Timeout:   10 * time.Second,
@@ -63,115 +119,342 @@ func NewWithDefaults(url string, externalLabels messages.LabelSet) (*Client, err
 			MaxBackoff: 10 * time.Second,
 			MaxRetries: 10,
 		},
-		ExternalLabels: externalLabels,
+		Senders:        1,
+		MaxInFlight:    1,
+		QueueCapacity:  10000,
+		OverflowPolicy: OverflowBlock,
+		Spool: SpoolConfig{
+			ReplayInterval: 10 * time.Second,
+		},
+		Rate: RateConfig{
+			MinInterval: 10 * time.Millisecond,
+			MaxInterval: 5 * time.Second,
+		},
 	}
+}
+
+// NewWithDefaults makes a new Client with default config.
+func NewWithDefaults(url string, externalLabels messages.LabelSet) (*Client, error) {
+	cfg := DefaultConfig()
+	cfg.URL = url
+	cfg.ExternalLabels = externalLabels
 	return New(cfg)
 }
 
 // New makes a new Client.
 func New(cfg Config) (*Client, error) {
+	enc, err := newEncoder(cfg.PushAPI, cfg.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Auth.validate(); err != nil {
+		return nil, err
+	}
+	httpClient, err := newHTTPClient(cfg.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+	q, err := newQueue(cfg.QueueCapacity, cfg.OverflowPolicy)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Senders <= 0 || cfg.MaxInFlight <= 0 {
+		return nil, fmt.Errorf("senders and max in-flight batches must be positive, got %d and %d", cfg.Senders, cfg.MaxInFlight)
+	}
+	if cfg.DefaultTenant != "" && !validTenant(cfg.DefaultTenant) {
+		return nil, fmt.Errorf("invalid default tenant %q", cfg.DefaultTenant)
+	}
+	if cfg.Spool.Path != "" && cfg.Spool.ReplayInterval <= 0 {
+		return nil, fmt.Errorf("spool replay interval must be positive, got %s", cfg.Spool.ReplayInterval)
+	}
+	deadLetters, err := newDeadLetterSink(cfg.DeadLetterPath)
+	if err != nil {
+		return nil, err
+	}
+	var sp *spool
+	if cfg.Spool.Path != "" {
+		if sp, err = openSpool(cfg.Spool); err != nil {
+			deadLetters.close()
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
 	c := &Client{
+		ctx:            ctx,
+		cancel:         cancel,
 		cfg:            cfg,
+		encoder:        enc,
+		httpClient:     httpClient,
+		limiter:        newAdaptiveLimiter(cfg.Rate),
+		deadLetters:    deadLetters,
+		spool:          sp,
 		quit:           make(chan struct{}),
-		entries:        make(chan entry),
+		queue:          q,
+		inFlight:       make(chan struct{}, cfg.MaxInFlight),
 		externalLabels: cfg.ExternalLabels,
 	}
+	for i := 0; i < cfg.Senders; i++ {
+		ch := make(chan *batch, cfg.MaxInFlight)
+		c.senders = append(c.senders, ch)
+		c.sendersWg.Add(1)
+		go c.sender(ch)
+	}
+	if c.spool != nil {
+		c.wg.Add(1)
+		go c.replaySpool()
+	}
 	c.wg.Add(1)
 	go c.run()
 	return c, nil
 }
 
 func (c *Client) run() {
-	batch := map[string]*logproto.Stream{}
-	batchSize := 0
-	maxWait := time.NewTimer(c.cfg.BatchWait)
+	batches := map[string]*batch{}
+	// Each tenant's batch is pushed once it is BatchWait old, however busy
+	// the other tenants are.
+	tick := c.cfg.BatchWait / 4
+	if tick < 10*time.Millisecond {
+		tick = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	flush := func(olderThan time.Duration) {
+		now := time.Now()
+		for tenant, b := range batches {
+			if b.age(now) >= olderThan {
+				c.dispatch(b)
+				delete(batches, tenant)
+			}
+		}
+	}
+
+	add := func(e entry) {
+		tenant := c.tenant(e.labels)
+		b, ok := batches[tenant]
+		if !ok {
+			b = newBatch(tenant)
+			batches[tenant] = b
+		}
+		if b.bytes+len(e.line) > c.cfg.BatchSize {
+			c.dispatch(b)
+			b = newBatch(tenant)
+			batches[tenant] = b
+		}
+		b.add(e)
+	}
 
 	defer func() {
-		c.sendBatch(batch)
+		for _, e := range c.queue.drain() {
+			add(e)
+		}
+		flush(0)
+		for _, ch := range c.senders {
+			close(ch)
+		}
+		c.sendersWg.Wait()
 		c.wg.Done()
 	}()
 
 	for {
-		maxWait.Reset(c.cfg.BatchWait)
 		select {
 		case <-c.quit:
 			return
 
-		case e := <-c.entries:
-			if batchSize+len(e.Line) > c.cfg.BatchSize {
-				c.sendBatch(batch)
-				batchSize = 0
-				batch = map[string]*logproto.Stream{}
+		case <-c.queue.ready:
+			for _, e := range c.queue.drain() {
+				add(e)
 			}
 
-			batchSize += len(e.Line)
-			fp := e.labels.String()
-			stream, ok := batch[fp]
-			if !ok {
-				stream = &logproto.Stream{
-					Labels: fp,
-				}
-				batch[fp] = stream
-			}
-			stream.Entries = append(stream.Entries, &e.Entry)
+		case <-ticker.C:
+			flush(c.cfg.BatchWait)
+		}
+	}
+}
+
+// dispatch hands the batch to the senders, blocking while MaxInFlight
+// batches are pending.
+func (c *Client) dispatch(b *batch) {
+	for i, part := range b.split(len(c.senders)) {
+		if part == nil {
+			continue
+		}
+		c.inFlight <- struct{}{}
+		c.senders[i] <- part
+	}
+}
+
+func (c *Client) sender(batches <-chan *batch) {
+	defer c.sendersWg.Done()
+	for b := range batches {
+		c.sendBatch(b)
+		<-c.inFlight
+	}
+}
 
-		case <-maxWait.C:
-			if len(batch) > 0 {
-				c.sendBatch(batch)
-				batchSize = 0
-				batch = map[string]*logproto.Stream{}
+// tenant returns the Loki tenant an entry with the given labels belongs to.
+// An empty tenant means no X-Scope-OrgID header is sent.
+func (c *Client) tenant(ls messages.LabelSet) string {
+	if c.cfg.TenantLabel != "" {
+		if t := ls[c.cfg.TenantLabel]; t != "" {
+			if validTenant(t) {
+				return t
 			}
+			invalidTenants.Inc()
+		}
+	}
+	return c.cfg.DefaultTenant
+}
+
+// maxTenantLen is the longest tenant ID Loki accepts.
+const maxTenantLen = 150
+
+// validTenant reports whether Loki accepts t as a tenant ID: letters,
+// digits and !-_.*'() only, at most maxTenantLen of them, and neither "."
+// nor "..". Loki answers 400 to pushes for any other tenant.
+func validTenant(t string) bool {
+	if len(t) > maxTenantLen || t == "." || t == ".." {
+		return false
+	}
+	for _, r := range t {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case strings.ContainsRune("!-_.*'()", r):
+		default:
+			return false
 		}
 	}
+	return true
 }
 
-func (c *Client) sendBatch(batch map[string]*logproto.Stream) {
-	buf, err := encodeBatch(batch)
+func (c *Client) sendBatch(b *batch) {
+	if b.empty() {
+		return
+	}
+	buf, err := c.encoder.encode(b.streams)
 	if err != nil {
 		log.Errorf("Error encoding batch: %s", err)
 		return
 	}
 
-	ctx := context.Background()
-	backoff := NewBackoff(ctx, c.cfg.BackoffConfig)
+	backoff := NewBackoff(c.ctx, c.cfg.BackoffConfig)
 	var status int
 	for backoff.Ongoing() {
-		status, err = c.send(ctx, buf)
+		status, err = c.send(c.ctx, b.tenant, c.encoder.contentType(), buf)
 
 		if err == nil {
+			sentEntries.Add(float64(b.count()))
+			return
+		}
+
+		// Loki refused some streams or entries and stored the rest.
+		if pe, ok := err.(*pushError); ok && status == http.StatusBadRequest {
+			log.Warnf("Loki rejected part of a batch: %s", err)
+			c.deadLetterRejected(b, pe.body)
 			return
 		}
 
-		// Only retry 500s and connection-level errors.
-		if status > 0 && status/100 != 5 {
+		// Only retry 429s, 500s and connection-level errors.
+		if !retryable(status) {
 			break
 		}
 
-		log.Warnf("Error sending batch, will retry %s %s", status, err)
-		backoff.Wait()
+		log.Warnf("Error sending batch, will retry %d %s", status, err)
+		pushRetries.Inc()
+		if pe, ok := err.(*pushError); ok && pe.retryAfter > 0 {
+			// Retry-After is honoured up to MaxBackoff, so that a single
+			// response cannot hold a sender for hours.
+			wait := pe.retryAfter
+			if max := c.cfg.BackoffConfig.MaxBackoff; max > 0 && wait > max {
+				wait = max
+			}
+			backoff.WaitFor(wait)
+		} else {
+			backoff.Wait()
+		}
 	}
 
+	if err == nil {
+		// Shutdown cancelled the push before it was attempted.
+		err = c.ctx.Err()
+	}
 	if err != nil {
-		log.Errorf("Final error sending batch %s %s", status, err)
+		log.Errorf("Final error sending batch %d %s", status, err)
+		if c.spool != nil && retryable(status) && c.spoolBatch(b.tenant, buf) {
+			return
+		}
+		droppedEntries.WithLabelValues(dropFailed).Add(float64(b.count()))
 	}
 }
 
-func encodeBatch(batch map[string]*logproto.Stream) ([]byte, error) {
-	req := logproto.PushRequest{
-		Streams: make([]*logproto.Stream, 0, len(batch)),
+// spoolBatch reports whether the batch was spooled.
+func (c *Client) spoolBatch(tenant string, buf []byte) bool {
+	err := c.spool.push(spoolRecord{
+		Tenant:      tenant,
+		ContentType: c.encoder.contentType(),
+		Created:     time.Now(),
+		Body:        buf,
+	})
+	if err != nil {
+		log.Errorf("Error spooling batch, dropping it: %s", err)
+		return false
 	}
-	for _, stream := range batch {
-		req.Streams = append(req.Streams, stream)
+	spooledBatches.Inc()
+	log.Infof("Spooled batch of %d bytes for later delivery", len(buf))
+	return true
+}
+
+// replaySpool periodically retries delivery of spooled batches.
+func (c *Client) replaySpool() {
+	defer c.wg.Done()
+	ticker := time.NewTicker(c.cfg.Spool.ReplayInterval)
+	defer ticker.Stop()
+
+	for {
+		c.spool.replay(func(rec *spoolRecord) (int, error) {
+			return c.send(c.ctx, rec.Tenant, rec.ContentType, rec.Body)
+		}, c.spoolRejected)
+		select {
+		case <-c.quit:
+			return
+		case <-ticker.C:
+		}
 	}
-	buf, err := proto.Marshal(&req)
-	if err != nil {
-		return nil, err
+}
+
+// spoolRejected handles a spooled batch Loki refused when it was replayed
+// as sendBatch handles a live one: the entries refused with a 400 are
+// dead-lettered, the others are counted as dropped.
+func (c *Client) spoolRejected(rec *spoolRecord, err error) {
+	if rec.ContentType != c.encoder.contentType() {
+		log.Errorf("Cannot decode spooled batch of type %s, its entries are lost", rec.ContentType)
+		return
+	}
+	streams, decodeErr := c.encoder.decode(rec.Body)
+	if decodeErr != nil {
+		log.Errorf("Error decoding spooled batch, its entries are lost: %s", decodeErr)
+		return
+	}
+	b := &batch{tenant: rec.Tenant, streams: streams}
+	if pe, ok := err.(*pushError); ok && pe.status == http.StatusBadRequest {
+		c.deadLetterRejected(b, pe.body)
+		return
+	}
+	droppedEntries.WithLabelValues(dropFailed).Add(float64(b.count()))
+}
+
+// SpoolStats returns the state of the spool; it is zero when spooling is
+// disabled.
+func (c *Client) SpoolStats() SpoolStats {
+	if c.spool == nil {
+		return SpoolStats{}
 	}
-	buf = snappy.Encode(nil, buf)
-	return buf, nil
+	return c.spool.getStats()
 }
 
-func (c *Client) send(ctx context.Context, buf []byte) (int, error) {
+func (c *Client) send(ctx context.Context, tenant, contentType string, buf []byte) (int, error) {
+	c.limiter.wait(ctx)
 	ctx, cancel := context.WithTimeout(ctx, c.cfg.Timeout)
 	defer cancel()
 	req, err := http.NewRequest("POST", c.cfg.URL, bytes.NewReader(buf))
@@ -180,50 +463,148 @@ func (c *Client) send(ctx context.Context, buf []byte) (int, error) {
 	}
 	req = req.WithContext(ctx)
 	req.Header.Set("Content-Type", contentType)
+	if tenant != "" {
+		req.Header.Set("X-Scope-OrgID", tenant)
+	}
+	if err := c.cfg.Auth.authorize(req); err != nil {
+		return -1, err
+	}
 
-	resp, err := http.DefaultClient.Do(req)
+	start := time.Now()
+	resp, err := c.httpClient.Do(req)
+	pushDuration.Observe(time.Since(start).Seconds())
 	if err != nil {
+		pushRequests.WithLabelValues("error").Inc()
+		c.recordPush(err)
 		return -1, err
 	}
 	defer resp.Body.Close()
+	pushRequests.WithLabelValues(strconv.Itoa(resp.StatusCode)).Inc()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		c.limiter.limited()
+	} else if resp.StatusCode/100 == 2 {
+		c.limiter.succeeded()
+		sentBytes.Add(float64(len(buf)))
+	}
 
 	if resp.StatusCode/100 != 2 {
-		scanner := bufio.NewScanner(io.LimitReader(resp.Body, maxErrMsgLen))
-		line := ""
-		if scanner.Scan() {
-			line = scanner.Text()
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrBodyLen))
+		line := firstLine(string(body))
+		if len(line) > maxErrMsgLen {
+			line = line[:maxErrMsgLen]
 		}
-		err = fmt.Errorf("server returned HTTP status %s (%d): %s", resp.Status, resp.StatusCode, line)
+		err = &pushError{
+			status:     resp.StatusCode,
+			retryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+			body:       string(body),
+			msg:        fmt.Sprintf("server returned HTTP status %s (%d): %s", resp.Status, resp.StatusCode, line),
+		}
+	}
+	if retryable(resp.StatusCode) {
+		c.recordPush(err)
+	} else {
+		c.recordPush(nil)
 	}
 	return resp.StatusCode, err
 }
 
+// pushError is returned by send when Loki answers with a non-2xx status.
+type pushError struct {
+	status     int
+	retryAfter time.Duration
+	body       string
+	msg        string
+}
+
+func (e *pushError) Error() string {
+	return e.msg
+}
+
+// PushInterval returns the current minimum interval between pushes, which
+// grows while Loki answers 429.
+func (c *Client) PushInterval() time.Duration {
+	return c.limiter.currentInterval()
+}
+
+func (c *Client) recordPush(err error) {
+	c.statsLock.Lock()
+	c.lastPush = PushStatus{Time: time.Now(), Err: err}
+	c.statsLock.Unlock()
+}
+
+// LastPush returns the outcome of the most recent push request, including
+// retries and spool replays.
+func (c *Client) LastPush() PushStatus {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+	return c.lastPush
+}
+
 // Stop the client.
 func (c *Client) Stop() {
+	c.Shutdown(context.Background())
+}
+
+// Shutdown stops accepting entries and flushes everything queued. If ctx
+// is done first, pending pushes are abandoned, spooled when a spool is
+// configured, and ctx's error is returned.
+func (c *Client) Shutdown(ctx context.Context) error {
 	c.stopLock.Lock()
 	defer c.stopLock.Unlock()
 	if c.stopped {
-		return
+		return nil
 	}
 	log.Info("Loki client waiting for stop")
 	c.stopped = true
+	c.queue.close()
 	close(c.quit)
-	c.wg.Wait()
+
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		log.Warnf("Loki client did not flush in time, abandoning pending batches: %s", err)
+		c.cancel()
+		<-done
+	}
+	c.cancel()
+
+	if c.spool != nil {
+		if err := c.spool.close(); err != nil {
+			log.Errorf("Error closing spool: %s", err)
+		}
+	}
+	if err := c.deadLetters.close(); err != nil {
+		log.Errorf("Error closing dead letters: %s", err)
+	}
+	return err
 }
 
 // Handle implement EntryHandler; adds a new line to the next batch; send is async.
+// A zero t is stamped with the current time. When the queue is full, Handle
+// blocks or drops entries according to the overflow policy.
 func (c *Client) Handle(ls messages.LabelSet, t time.Time, s string) error {
 	if len(c.externalLabels) > 0 {
 		ls = c.externalLabels.Merge(ls)
 	}
+	if t.IsZero() {
+		t = time.Now()
+	}
 
-	now := time.Now().UnixNano()
-	c.entries <- entry{ls, logproto.Entry{
-		Timestamp: &timestamp.Timestamp{
-			Seconds: now / int64(time.Second),
-			Nanos:   int32(now % int64(time.Second)),
-		},
-		Line: s,
-	}}
-	return nil
+	return c.queue.push(entry{ls, logEntry{
+		ts:   t,
+		line: s,
+	}})
+}
+
+// QueueStats returns the state of the ingestion queue.
+func (c *Client) QueueStats() QueueStats {
+	return c.queue.stats()
 }
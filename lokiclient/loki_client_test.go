@@ -0,0 +1,373 @@
+package lokiclient_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bosh-loki/loki-firehose-nozzle/logproto"
+	. "github.com/bosh-loki/loki-firehose-nozzle/lokiclient"
+	"github.com/bosh-loki/loki-firehose-nozzle/messages"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type pushRequest struct {
+	path        string
+	contentType string
+	tenant      string
+	body        []byte
+}
+
+// fakeLoki records every push request it receives.
+type fakeLoki struct {
+	*httptest.Server
+	lock     sync.Mutex
+	requests []pushRequest
+}
+
+func newFakeLoki() *fakeLoki {
+	f := &fakeLoki{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		f.lock.Lock()
+		f.requests = append(f.requests, pushRequest{
+			path:        r.URL.Path,
+			contentType: r.Header.Get("Content-Type"),
+			tenant:      r.Header.Get("X-Scope-OrgID"),
+			body:        body,
+		})
+		f.lock.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	return f
+}
+
+func (f *fakeLoki) Requests() []pushRequest {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]pushRequest(nil), f.requests...)
+}
+
+var _ = Describe("Client", func() {
+	var (
+		loki *fakeLoki
+		ts   = time.Unix(1500000000, 123)
+	)
+
+	BeforeEach(func() {
+		loki = newFakeLoki()
+	})
+
+	AfterEach(func() {
+		loki.Close()
+	})
+
+	push := func(api, encoding string) pushRequest {
+		path, err := PushPath(api)
+		Expect(err).ToNot(HaveOccurred())
+
+		cfg := DefaultConfig()
+		cfg.URL = loki.URL + path
+		cfg.PushAPI = api
+		cfg.Encoding = encoding
+		cfg.BatchWait = time.Hour
+		client, err := New(cfg)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(client.Handle(messages.LabelSet{"job": "router"}, ts, "hello")).To(Succeed())
+		client.Stop()
+
+		Expect(loki.Requests()).To(HaveLen(1))
+		return loki.Requests()[0]
+	}
+
+	decodeProtobuf := func(body []byte) *logproto.PushRequest {
+		buf, err := snappy.Decode(nil, body)
+		Expect(err).ToNot(HaveOccurred())
+		var req logproto.PushRequest
+		Expect(proto.Unmarshal(buf, &req)).To(Succeed())
+		return &req
+	}
+
+	It("pushes snappy protobuf to the legacy endpoint", func() {
+		req := push(PushAPILegacy, EncodingProtobuf)
+		Expect(req.path).To(Equal("/api/prom/push"))
+		Expect(req.contentType).To(Equal("application/x-protobuf"))
+
+		pr := decodeProtobuf(req.body)
+		Expect(pr.Streams).To(HaveLen(1))
+		Expect(pr.Streams[0].Labels).To(Equal(`{job="router"}`))
+		Expect(pr.Streams[0].Entries).To(HaveLen(1))
+		Expect(pr.Streams[0].Entries[0].Line).To(Equal("hello"))
+		Expect(pr.Streams[0].Entries[0].Timestamp.Seconds).To(Equal(ts.Unix()))
+		Expect(pr.Streams[0].Entries[0].Timestamp.Nanos).To(BeEquivalentTo(ts.Nanosecond()))
+	})
+
+	It("pushes snappy protobuf to the v1 endpoint", func() {
+		req := push(PushAPIV1, EncodingProtobuf)
+		Expect(req.path).To(Equal("/loki/api/v1/push"))
+		Expect(req.contentType).To(Equal("application/x-protobuf"))
+
+		pr := decodeProtobuf(req.body)
+		Expect(pr.Streams).To(HaveLen(1))
+		Expect(pr.Streams[0].Labels).To(Equal(`{job="router"}`))
+		Expect(pr.Streams[0].Entries[0].Line).To(Equal("hello"))
+	})
+
+	It("pushes legacy JSON", func() {
+		req := push(PushAPILegacy, EncodingJSON)
+		Expect(req.path).To(Equal("/api/prom/push"))
+		Expect(req.contentType).To(Equal("application/json"))
+
+		var body struct {
+			Streams []struct {
+				Labels  string `json:"labels"`
+				Entries []struct {
+					Ts   time.Time `json:"ts"`
+					Line string    `json:"line"`
+				} `json:"entries"`
+			} `json:"streams"`
+		}
+		Expect(json.Unmarshal(req.body, &body)).To(Succeed())
+		Expect(body.Streams).To(HaveLen(1))
+		Expect(body.Streams[0].Labels).To(Equal(`{job="router"}`))
+		Expect(body.Streams[0].Entries).To(HaveLen(1))
+		Expect(body.Streams[0].Entries[0].Line).To(Equal("hello"))
+		Expect(body.Streams[0].Entries[0].Ts.Equal(ts)).To(BeTrue())
+	})
+
+	It("pushes v1 JSON", func() {
+		req := push(PushAPIV1, EncodingJSON)
+		Expect(req.path).To(Equal("/loki/api/v1/push"))
+		Expect(req.contentType).To(Equal("application/json"))
+
+		var body struct {
+			Streams []struct {
+				Stream map[string]string `json:"stream"`
+				Values [][]string        `json:"values"`
+			} `json:"streams"`
+		}
+		Expect(json.Unmarshal(req.body, &body)).To(Succeed())
+		Expect(body.Streams).To(HaveLen(1))
+		Expect(body.Streams[0].Stream).To(Equal(map[string]string{"job": "router"}))
+		Expect(body.Streams[0].Values).To(HaveLen(1))
+		Expect(body.Streams[0].Values[0]).To(Equal([]string{"1500000000000000123", "hello"}))
+	})
+
+	It("rejects unknown push APIs and encodings", func() {
+		cfg := DefaultConfig()
+		cfg.PushAPI = "v2"
+		_, err := New(cfg)
+		Expect(err).To(HaveOccurred())
+
+		cfg = DefaultConfig()
+		cfg.Encoding = "xml"
+		_, err = New(cfg)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("batches per tenant and sets X-Scope-OrgID", func() {
+		cfg := DefaultConfig()
+		cfg.URL = loki.URL + "/api/prom/push"
+		cfg.BatchWait = time.Hour
+		cfg.TenantLabel = "cf_org_name"
+		cfg.DefaultTenant = "platform"
+		client, err := New(cfg)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(client.Handle(messages.LabelSet{"cf_org_name": "org-a"}, ts, "a1")).To(Succeed())
+		Expect(client.Handle(messages.LabelSet{"cf_org_name": "org-b"}, ts, "b1")).To(Succeed())
+		Expect(client.Handle(messages.LabelSet{"cf_org_name": "org-a"}, ts, "a2")).To(Succeed())
+		Expect(client.Handle(messages.LabelSet{"event_type": "ValueMetric"}, ts, "metric")).To(Succeed())
+		client.Stop()
+
+		lines := map[string][]string{}
+		for _, req := range loki.Requests() {
+			buf, err := snappy.Decode(nil, req.body)
+			Expect(err).ToNot(HaveOccurred())
+			var pr logproto.PushRequest
+			Expect(proto.Unmarshal(buf, &pr)).To(Succeed())
+			for _, s := range pr.Streams {
+				for _, e := range s.Entries {
+					lines[req.tenant] = append(lines[req.tenant], e.Line)
+				}
+			}
+		}
+		Expect(loki.Requests()).To(HaveLen(3))
+		Expect(lines).To(Equal(map[string][]string{
+			"org-a":    {"a1", "a2"},
+			"org-b":    {"b1"},
+			"platform": {"metric"},
+		}))
+	})
+
+	It("sends entries whose tenant Loki would not accept to the default tenant", func() {
+		cfg := DefaultConfig()
+		cfg.URL = loki.URL + "/api/prom/push"
+		cfg.BatchWait = time.Hour
+		cfg.TenantLabel = "cf_org_name"
+		cfg.DefaultTenant = "platform"
+		client, err := New(cfg)
+		Expect(err).ToNot(HaveOccurred())
+
+		for _, org := range []string{"Acme_Corp.(eu)", "acme corp", "acme/corp", "..", strings.Repeat("a", 151)} {
+			Expect(client.Handle(messages.LabelSet{"cf_org_name": org}, ts, org)).To(Succeed())
+		}
+		client.Stop()
+
+		var tenants []string
+		for _, req := range loki.Requests() {
+			tenants = append(tenants, req.tenant)
+		}
+		Expect(tenants).To(ConsistOf("Acme_Corp.(eu)", "platform"))
+	})
+
+	It("rejects a default tenant Loki would not accept", func() {
+		cfg := DefaultConfig()
+		cfg.DefaultTenant = "cf platform"
+		_, err := New(cfg)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("pushes the batch of a quiet tenant after BatchWait while another tenant is busy", func() {
+		cfg := DefaultConfig()
+		cfg.URL = loki.URL + "/api/prom/push"
+		cfg.BatchWait = 200 * time.Millisecond
+		cfg.TenantLabel = "cf_org_name"
+		client, err := New(cfg)
+		Expect(err).ToNot(HaveOccurred())
+		defer client.Stop()
+
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				case <-time.After(10 * time.Millisecond):
+					client.Handle(messages.LabelSet{"cf_org_name": "busy"}, ts, "busy")
+				}
+			}
+		}()
+		Expect(client.Handle(messages.LabelSet{"cf_org_name": "quiet"}, ts, "quiet")).To(Succeed())
+
+		tenants := func() []string {
+			var tenants []string
+			for _, req := range loki.Requests() {
+				tenants = append(tenants, req.tenant)
+			}
+			return tenants
+		}
+		Eventually(tenants, time.Second).Should(ContainElement("quiet"))
+		Eventually(tenants, time.Second).Should(ContainElement("busy"))
+	})
+
+	It("omits X-Scope-OrgID without tenants configured", func() {
+		req := push(PushAPILegacy, EncodingProtobuf)
+		Expect(req.tenant).To(BeEmpty())
+	})
+
+	Describe("with several senders", func() {
+		var (
+			server   *httptest.Server
+			release  chan struct{}
+			lock     sync.Mutex
+			inFlight int
+			peak     int
+			lines    []string
+		)
+
+		BeforeEach(func() {
+			release = make(chan struct{})
+			inFlight, peak, lines = 0, 0, nil
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				buf, _ := snappy.Decode(nil, body)
+				var pr logproto.PushRequest
+				proto.Unmarshal(buf, &pr)
+
+				lock.Lock()
+				inFlight++
+				if inFlight > peak {
+					peak = inFlight
+				}
+				for _, s := range pr.Streams {
+					for _, e := range s.Entries {
+						lines = append(lines, e.Line)
+					}
+				}
+				lock.Unlock()
+
+				<-release
+
+				lock.Lock()
+				inFlight--
+				lock.Unlock()
+				w.WriteHeader(http.StatusNoContent)
+			}))
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		newClient := func() *Client {
+			cfg := DefaultConfig()
+			cfg.URL = server.URL + "/api/prom/push"
+			cfg.BatchSize = 1
+			cfg.BatchWait = time.Hour
+			cfg.Senders = 4
+			cfg.MaxInFlight = 4
+			client, err := New(cfg)
+			Expect(err).ToNot(HaveOccurred())
+			return client
+		}
+
+		It("pushes batches of different streams concurrently", func() {
+			client := newClient()
+			for i := 0; i < 10; i++ {
+				Expect(client.Handle(messages.LabelSet{"source_instance": strconv.Itoa(i)}, ts, "line")).To(Succeed())
+			}
+			Eventually(func() int {
+				lock.Lock()
+				defer lock.Unlock()
+				return peak
+			}).Should(BeNumerically(">", 1))
+
+			close(release)
+			client.Stop()
+		})
+
+		It("keeps the entries of a stream in order", func() {
+			close(release)
+			client := newClient()
+			var expected []string
+			for i := 0; i < 50; i++ {
+				line := strconv.Itoa(i)
+				expected = append(expected, line)
+				Expect(client.Handle(messages.LabelSet{"job": "router"}, ts, line)).To(Succeed())
+			}
+			client.Stop()
+
+			lock.Lock()
+			defer lock.Unlock()
+			Expect(lines).To(Equal(expected))
+		})
+
+		It("rejects a pool without senders", func() {
+			cfg := DefaultConfig()
+			cfg.Senders = 0
+			_, err := New(cfg)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
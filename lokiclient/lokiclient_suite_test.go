@@ -0,0 +1,13 @@
+package lokiclient_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestLokiclient(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Lokiclient Suite")
+}
@@ -0,0 +1,83 @@
+package lokiclient
+
+import (
+	"github.com/bosh-loki/loki-firehose-nozzle/metrics"
+)
+
+var (
+	pushRequests = metrics.NewCounterVec(
+		"loki_nozzle_push_requests_total",
+		"Push requests sent to Loki by HTTP status code, or \"error\" when no response was received.",
+		"status_code")
+	pushDurationVec, pushDuration = metrics.NewHistogram(
+		"loki_nozzle_push_duration_seconds",
+		"Latency of push requests to Loki.",
+		metrics.DefBuckets)
+	pushRetriesVec, pushRetries = metrics.NewCounter(
+		"loki_nozzle_push_retries_total",
+		"Push requests retried after a retryable failure.")
+	sentEntriesVec, sentEntries = metrics.NewCounter(
+		"loki_nozzle_sent_entries_total",
+		"Entries accepted by Loki.")
+	sentBytesVec, sentBytes = metrics.NewCounter(
+		"loki_nozzle_sent_bytes_total",
+		"Encoded request bytes accepted by Loki.")
+	droppedEntries = metrics.NewCounterVec(
+		"loki_nozzle_dropped_entries_total",
+		"Entries that will never reach Loki, by reason.",
+		"reason")
+	spooledBatchesVec, spooledBatches = metrics.NewCounter(
+		"loki_nozzle_spooled_batches_total",
+		"Batches written to the spool after delivery failed.")
+	invalidTenantsVec, invalidTenants = metrics.NewCounter(
+		"loki_nozzle_invalid_tenant_entries_total",
+		"Entries sent to the default tenant because Loki would not accept their tenant label value as a tenant ID.")
+)
+
+// Reasons for dropped entries.
+const (
+	dropRejected = "rejected"
+	dropFailed   = "failed"
+)
+
+func init() {
+	metrics.MustRegister(
+		pushRequests,
+		pushDurationVec,
+		pushRetriesVec,
+		sentEntriesVec,
+		sentBytesVec,
+		droppedEntries,
+		spooledBatchesVec,
+		invalidTenantsVec,
+	)
+}
+
+// RegisterMetrics exposes the queue, spool and rate limiter state of c on
+// the default metrics registry. It must be called at most once.
+func (c *Client) RegisterMetrics() {
+	metrics.MustRegister(
+		metrics.NewGaugeFunc("loki_nozzle_queue_length", "Entries waiting to be batched.", func() float64 {
+			return float64(c.QueueStats().Length)
+		}),
+		metrics.NewGaugeFunc("loki_nozzle_queue_capacity", "Capacity of the ingestion queue.", func() float64 {
+			return float64(c.QueueStats().Capacity)
+		}),
+		metrics.NewCounterFunc("loki_nozzle_queue_dropped_entries_total", "Entries dropped by the overflow policy, by event type.", "event_type", func() map[string]float64 {
+			dropped := map[string]float64{}
+			for k, v := range c.QueueStats().Dropped {
+				dropped[k] = float64(v)
+			}
+			return dropped
+		}),
+		metrics.NewGaugeFunc("loki_nozzle_spool_batches", "Batches waiting in the spool.", func() float64 {
+			return float64(c.SpoolStats().Batches)
+		}),
+		metrics.NewGaugeFunc("loki_nozzle_spool_bytes", "Size of the batches waiting in the spool.", func() float64 {
+			return float64(c.SpoolStats().Bytes)
+		}),
+		metrics.NewGaugeFunc("loki_nozzle_push_interval_seconds", "Current minimum spacing between pushes imposed by rate limiting.", func() float64 {
+			return c.PushInterval().Seconds()
+		}),
+	)
+}
@@ -0,0 +1,60 @@
+package lokiclient_test
+
+import (
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"time"
+
+	. "github.com/bosh-loki/loki-firehose-nozzle/lokiclient"
+	"github.com/bosh-loki/loki-firehose-nozzle/messages"
+	"github.com/bosh-loki/loki-firehose-nozzle/metrics"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Metrics", func() {
+	var loki *fakeLoki
+
+	BeforeEach(func() {
+		loki = newFakeLoki()
+	})
+
+	AfterEach(func() {
+		loki.Close()
+	})
+
+	// sample returns the value of a series on the default registry, or 0
+	// if it has not been reported yet.
+	sample := func(series string) float64 {
+		rec := httptest.NewRecorder()
+		metrics.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		m := regexp.MustCompile("(?m)^" + regexp.QuoteMeta(series) + " (.+)$").FindStringSubmatch(rec.Body.String())
+		if m == nil {
+			return 0
+		}
+		v, err := strconv.ParseFloat(m[1], 64)
+		Expect(err).ToNot(HaveOccurred())
+		return v
+	}
+
+	It("counts pushed entries, bytes and requests", func() {
+		entries := sample("loki_nozzle_sent_entries_total")
+		bytes := sample("loki_nozzle_sent_bytes_total")
+		requests := sample(`loki_nozzle_push_requests_total{status_code="204"}`)
+
+		cfg := DefaultConfig()
+		cfg.URL = loki.URL + "/api/prom/push"
+		cfg.BatchWait = time.Hour
+		client, err := New(cfg)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(client.Handle(messages.LabelSet{"job": "router"}, time.Now(), "one")).To(Succeed())
+		Expect(client.Handle(messages.LabelSet{"job": "cell"}, time.Now(), "two")).To(Succeed())
+		client.Stop()
+
+		Expect(loki.Requests()).To(HaveLen(1))
+		Expect(sample("loki_nozzle_sent_entries_total") - entries).To(Equal(2.0))
+		Expect(sample("loki_nozzle_sent_bytes_total") - bytes).To(Equal(float64(len(loki.Requests()[0].body))))
+		Expect(sample(`loki_nozzle_push_requests_total{status_code="204"}`) - requests).To(Equal(1.0))
+	})
+})
@@ -0,0 +1,161 @@
+package lokiclient
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Overflow policies for a full queue.
+const (
+	// OverflowBlock makes Handle wait until there is room.
+	OverflowBlock = "block"
+	// OverflowDropNewest discards the entry being added.
+	OverflowDropNewest = "drop_newest"
+	// OverflowDropOldest discards the oldest queued entry.
+	OverflowDropOldest = "drop_oldest"
+	// OverflowDropPriority discards the oldest entry of the lowest priority
+	// present, or the entry being added if nothing queued ranks below it.
+	// Application logs rank above other application events, which rank
+	// above platform envelopes.
+	OverflowDropPriority = "drop_priority"
+)
+
+var errQueueClosed = errors.New("queue closed")
+
+// QueueStats describes the ingestion queue.
+type QueueStats struct {
+	Length   int
+	Capacity int
+	// Dropped counts discarded entries by their event_type label.
+	Dropped map[string]int64
+}
+
+// queue is a bounded FIFO between Handle and the batching loop.
+type queue struct {
+	lock     sync.Mutex
+	notFull  *sync.Cond
+	items    []entry
+	capacity int
+	policy   string
+	closed   bool
+	dropped  map[string]int64
+
+	// ready has room for one signal and is signalled whenever items
+	// become available.
+	ready chan struct{}
+}
+
+func newQueue(capacity int, policy string) (*queue, error) {
+	if capacity <= 0 {
+		return nil, fmt.Errorf("queue capacity must be positive, got %d", capacity)
+	}
+	switch policy {
+	case "":
+		policy = OverflowBlock
+	case OverflowBlock, OverflowDropNewest, OverflowDropOldest, OverflowDropPriority:
+	default:
+		return nil, fmt.Errorf("unknown overflow policy %q", policy)
+	}
+	q := &queue{
+		capacity: capacity,
+		policy:   policy,
+		dropped:  map[string]int64{},
+		ready:    make(chan struct{}, 1),
+	}
+	q.notFull = sync.NewCond(&q.lock)
+	return q, nil
+}
+
+func (q *queue) push(e entry) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.policy == OverflowBlock {
+		for len(q.items) >= q.capacity && !q.closed {
+			q.notFull.Wait()
+		}
+	}
+	if q.closed {
+		return errQueueClosed
+	}
+
+	if len(q.items) >= q.capacity {
+		switch q.policy {
+		case OverflowDropNewest:
+			q.drop(e)
+			return nil
+		case OverflowDropOldest:
+			q.drop(q.items[0])
+			q.items = q.items[1:]
+		case OverflowDropPriority:
+			victim := -1
+			for i := range q.items {
+				p := priority(q.items[i])
+				if p < priority(e) && (victim < 0 || p < priority(q.items[victim])) {
+					victim = i
+				}
+			}
+			if victim < 0 {
+				q.drop(e)
+				return nil
+			}
+			q.drop(q.items[victim])
+			q.items = append(q.items[:victim], q.items[victim+1:]...)
+		}
+	}
+
+	q.items = append(q.items, e)
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// drain removes and returns everything queued.
+func (q *queue) drain() []entry {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	items := q.items
+	q.items = make([]entry, 0, len(items))
+	q.notFull.Broadcast()
+	return items
+}
+
+// close makes blocked and future pushes fail. Entries already queued can
+// still be drained.
+func (q *queue) close() {
+	q.lock.Lock()
+	q.closed = true
+	q.notFull.Broadcast()
+	q.lock.Unlock()
+}
+
+func (q *queue) drop(e entry) {
+	q.dropped[e.labels["event_type"]]++
+}
+
+func (q *queue) stats() QueueStats {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	dropped := make(map[string]int64, len(q.dropped))
+	for k, v := range q.dropped {
+		dropped[k] = v
+	}
+	return QueueStats{
+		Length:   len(q.items),
+		Capacity: q.capacity,
+		Dropped:  dropped,
+	}
+}
+
+func priority(e entry) int {
+	switch {
+	case e.labels["event_type"] == "LogMessage":
+		return 2
+	case e.labels["cf_app_id"] != "":
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,169 @@
+package lokiclient_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/bosh-loki/loki-firehose-nozzle/logproto"
+	. "github.com/bosh-loki/loki-firehose-nozzle/lokiclient"
+	"github.com/bosh-loki/loki-firehose-nozzle/messages"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Ingestion queue", func() {
+	var (
+		server   *httptest.Server
+		release  chan struct{}
+		lock     sync.Mutex
+		requests int
+		lines    []string
+		client   *Client
+		finish   func()
+	)
+
+	appLog := messages.LabelSet{"event_type": "LogMessage", "cf_app_id": "app"}
+	metric := messages.LabelSet{"event_type": "ValueMetric"}
+
+	// finish unblocks the server and stops the client; it is safe to call
+	// more than once.
+	finish = func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+		if client != nil {
+			client.Stop()
+		}
+	}
+
+	BeforeEach(func() {
+		client = nil
+		release = make(chan struct{})
+		requests = 0
+		lines = nil
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			buf, _ := snappy.Decode(nil, body)
+			var pr logproto.PushRequest
+			proto.Unmarshal(buf, &pr)
+
+			lock.Lock()
+			requests++
+			for _, s := range pr.Streams {
+				for _, e := range s.Entries {
+					lines = append(lines, e.Line)
+				}
+			}
+			lock.Unlock()
+
+			<-release
+			w.WriteHeader(http.StatusNoContent)
+		}))
+	})
+
+	AfterEach(func() {
+		finish()
+		server.Close()
+	})
+
+	requestCount := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return requests
+	}
+
+	receivedLines := func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string(nil), lines...)
+	}
+
+	// stall starts a client whose sender is blocked pushing "a" and whose
+	// batching loop is blocked handing over "b", holding "c", with the queue
+	// empty.
+	stall := func(policy string) {
+		cfg := DefaultConfig()
+		cfg.URL = server.URL + "/api/prom/push"
+		cfg.BatchSize = 1
+		cfg.BatchWait = time.Hour
+		cfg.QueueCapacity = 2
+		cfg.OverflowPolicy = policy
+		var err error
+		client, err = New(cfg)
+		Expect(err).ToNot(HaveOccurred())
+
+		queued := func() int { return client.QueueStats().Length }
+		Expect(client.Handle(appLog, time.Now(), "a")).To(Succeed())
+		Eventually(queued).Should(Equal(0))
+		Expect(client.Handle(appLog, time.Now(), "b")).To(Succeed())
+		Eventually(requestCount).Should(Equal(1))
+		Expect(client.Handle(appLog, time.Now(), "c")).To(Succeed())
+		Eventually(queued).Should(Equal(0))
+	}
+
+	It("rejects unknown overflow policies", func() {
+		cfg := DefaultConfig()
+		cfg.OverflowPolicy = "drop_random"
+		_, err := New(cfg)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("blocks Handle while the queue is full", func() {
+		stall(OverflowBlock)
+		Expect(client.Handle(appLog, time.Now(), "d")).To(Succeed())
+		Expect(client.Handle(appLog, time.Now(), "e")).To(Succeed())
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			client.Handle(appLog, time.Now(), "f")
+		}()
+		Consistently(done, 100*time.Millisecond).ShouldNot(BeClosed())
+
+		close(release)
+		Eventually(done).Should(BeClosed())
+		client.Stop()
+		Expect(receivedLines()).To(Equal([]string{"a", "b", "c", "d", "e", "f"}))
+	})
+
+	It("drops the newest entry", func() {
+		stall(OverflowDropNewest)
+		Expect(client.Handle(appLog, time.Now(), "d")).To(Succeed())
+		Expect(client.Handle(appLog, time.Now(), "e")).To(Succeed())
+		Expect(client.Handle(appLog, time.Now(), "f")).To(Succeed())
+		Expect(client.QueueStats().Dropped).To(Equal(map[string]int64{"LogMessage": 1}))
+
+		finish()
+		Expect(receivedLines()).To(Equal([]string{"a", "b", "c", "d", "e"}))
+	})
+
+	It("drops the oldest entry", func() {
+		stall(OverflowDropOldest)
+		Expect(client.Handle(appLog, time.Now(), "d")).To(Succeed())
+		Expect(client.Handle(appLog, time.Now(), "e")).To(Succeed())
+		Expect(client.Handle(appLog, time.Now(), "f")).To(Succeed())
+		Expect(client.QueueStats().Dropped).To(Equal(map[string]int64{"LogMessage": 1}))
+
+		finish()
+		Expect(receivedLines()).To(Equal([]string{"a", "b", "c", "e", "f"}))
+	})
+
+	It("drops platform metrics before application logs", func() {
+		stall(OverflowDropPriority)
+		Expect(client.Handle(metric, time.Now(), "metric")).To(Succeed())
+		Expect(client.Handle(appLog, time.Now(), "d")).To(Succeed())
+		Expect(client.Handle(appLog, time.Now(), "e")).To(Succeed())
+		Expect(client.Handle(metric, time.Now(), "metric2")).To(Succeed())
+		Expect(client.QueueStats().Dropped).To(Equal(map[string]int64{"ValueMetric": 2}))
+
+		finish()
+		Expect(receivedLines()).To(Equal([]string{"a", "b", "c", "d", "e"}))
+	})
+})
@@ -0,0 +1,106 @@
+package lokiclient
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateConfig configures the adaptive spacing of pushes. Every 429 from Loki
+// doubles the minimum interval between pushes, starting at MinInterval and
+// capped at MaxInterval; every successful push shrinks it again. A zero
+// MaxInterval disables the adaptation.
+type RateConfig struct {
+	MinInterval time.Duration
+	MaxInterval time.Duration
+}
+
+// adaptiveLimiter spaces out pushes across all senders while Loki keeps
+// rate limiting us.
+type adaptiveLimiter struct {
+	cfg RateConfig
+
+	lock     sync.Mutex
+	interval time.Duration
+	last     time.Time // start of the most recently admitted push
+}
+
+func newAdaptiveLimiter(cfg RateConfig) *adaptiveLimiter {
+	return &adaptiveLimiter{cfg: cfg}
+}
+
+// wait blocks until the current interval has passed since the previous push
+// started, or ctx is done.
+func (l *adaptiveLimiter) wait(ctx context.Context) {
+	l.lock.Lock()
+	now := time.Now()
+	start := l.last.Add(l.interval)
+	if start.Before(now) {
+		start = now
+	}
+	l.last = start
+	l.lock.Unlock()
+
+	if d := start.Sub(now); d > 0 {
+		select {
+		case <-ctx.Done():
+		case <-time.After(d):
+		}
+	}
+}
+
+// limited records a 429 response.
+func (l *adaptiveLimiter) limited() {
+	if l.cfg.MaxInterval <= 0 {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.interval < l.cfg.MinInterval {
+		l.interval = l.cfg.MinInterval
+	} else {
+		l.interval *= 2
+	}
+	if l.interval > l.cfg.MaxInterval {
+		l.interval = l.cfg.MaxInterval
+	}
+}
+
+// succeeded records a successful push.
+func (l *adaptiveLimiter) succeeded() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.interval -= l.interval / 4
+	if l.interval < l.cfg.MinInterval {
+		l.interval = 0
+	}
+}
+
+// currentInterval returns the current spacing between pushes.
+func (l *adaptiveLimiter) currentInterval() time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.interval
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an
+// HTTP date. It returns zero if the header is missing or invalid.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
@@ -0,0 +1,117 @@
+package lokiclient_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	. "github.com/bosh-loki/loki-firehose-nozzle/lokiclient"
+	"github.com/bosh-loki/loki-firehose-nozzle/messages"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Rate limiting", func() {
+	var (
+		server     *httptest.Server
+		lock       sync.Mutex
+		limitFirst int
+		retryAfter string
+		times      []time.Time
+		statuses   []int
+		maxBackoff time.Duration
+	)
+
+	BeforeEach(func() {
+		limitFirst, retryAfter, times, statuses = 0, "", nil, nil
+		maxBackoff = time.Millisecond
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			defer lock.Unlock()
+			times = append(times, time.Now())
+			if len(times) <= limitFirst {
+				if retryAfter != "" {
+					w.Header().Set("Retry-After", retryAfter)
+				}
+				statuses = append(statuses, http.StatusTooManyRequests)
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			statuses = append(statuses, http.StatusNoContent)
+			w.WriteHeader(http.StatusNoContent)
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	newClient := func(rate RateConfig) *Client {
+		cfg := DefaultConfig()
+		cfg.URL = server.URL + "/api/prom/push"
+		cfg.BatchWait = 10 * time.Millisecond
+		cfg.BackoffConfig = BackoffConfig{MinBackoff: time.Millisecond, MaxBackoff: maxBackoff, MaxRetries: 5}
+		cfg.Rate = rate
+		client, err := New(cfg)
+		Expect(err).ToNot(HaveOccurred())
+		return client
+	}
+
+	received := func() []int {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]int(nil), statuses...)
+	}
+
+	It("retries 429 responses instead of dropping the batch", func() {
+		limitFirst = 2
+		client := newClient(RateConfig{})
+		Expect(client.Handle(messages.LabelSet{"job": "router"}, time.Now(), "hello")).To(Succeed())
+		Eventually(received).Should(Equal([]int{429, 429, 204}))
+		client.Stop()
+	})
+
+	It("waits as long as Retry-After asks", func() {
+		limitFirst = 1
+		retryAfter = "1"
+		maxBackoff = 2 * time.Second
+		client := newClient(RateConfig{})
+		Expect(client.Handle(messages.LabelSet{"job": "router"}, time.Now(), "hello")).To(Succeed())
+		Eventually(received, 3*time.Second).Should(Equal([]int{429, 204}))
+		client.Stop()
+
+		lock.Lock()
+		defer lock.Unlock()
+		Expect(times[1].Sub(times[0])).To(BeNumerically(">=", 900*time.Millisecond))
+	})
+
+	It("waits no longer than the max backoff whatever Retry-After asks", func() {
+		limitFirst = 1
+		retryAfter = "3600"
+		maxBackoff = 50 * time.Millisecond
+		client := newClient(RateConfig{})
+		Expect(client.Handle(messages.LabelSet{"job": "router"}, time.Now(), "hello")).To(Succeed())
+		Eventually(received, time.Second).Should(Equal([]int{429, 204}))
+		client.Stop()
+	})
+
+	It("slows down while Loki keeps limiting and speeds up again", func() {
+		limitFirst = 3
+		client := newClient(RateConfig{MinInterval: 10 * time.Millisecond, MaxInterval: time.Second})
+		defer client.Stop()
+
+		Expect(client.Handle(messages.LabelSet{"job": "router"}, time.Now(), "hello")).To(Succeed())
+		Eventually(received).Should(Equal([]int{429, 429, 429, 204}))
+		Expect(client.PushInterval()).To(BeNumerically("~", 30*time.Millisecond, time.Millisecond))
+
+		lock.Lock()
+		Expect(times[3].Sub(times[2])).To(BeNumerically(">=", 35*time.Millisecond))
+		lock.Unlock()
+
+		Eventually(func() time.Duration {
+			Expect(client.Handle(messages.LabelSet{"job": "router"}, time.Now(), "hello")).To(Succeed())
+			return client.PushInterval()
+		}).Should(BeZero())
+	})
+})
@@ -0,0 +1,102 @@
+package lokiclient_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "github.com/bosh-loki/loki-firehose-nozzle/lokiclient"
+	"github.com/bosh-loki/loki-firehose-nozzle/messages"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Shutdown", func() {
+	var (
+		server  *httptest.Server
+		dir     string
+		lock    sync.Mutex
+		pushes  int
+		hang    chan struct{}
+		hanging bool
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "shutdown")
+		Expect(err).ToNot(HaveOccurred())
+
+		pushes, hanging = 0, false
+		hang = make(chan struct{})
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			wait := hanging
+			lock.Unlock()
+			if wait {
+				select {
+				case <-hang:
+				case <-r.Context().Done():
+				}
+				return
+			}
+			lock.Lock()
+			pushes++
+			lock.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		}))
+	})
+
+	AfterEach(func() {
+		close(hang)
+		server.Close()
+		os.RemoveAll(dir)
+	})
+
+	newClient := func() *Client {
+		cfg := DefaultConfig()
+		cfg.URL = server.URL + "/api/prom/push"
+		cfg.BatchWait = time.Hour
+		cfg.Timeout = time.Hour
+		cfg.BackoffConfig = BackoffConfig{MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxRetries: 3}
+		cfg.Spool.Path = filepath.Join(dir, "spool.db")
+		client, err := New(cfg)
+		Expect(err).ToNot(HaveOccurred())
+		return client
+	}
+
+	received := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return pushes
+	}
+
+	It("flushes queued entries before returning", func() {
+		client := newClient()
+		Expect(client.Handle(messages.LabelSet{"job": "router"}, time.Now(), "last words")).To(Succeed())
+
+		Expect(client.Shutdown(context.Background())).To(Succeed())
+		Expect(received()).To(Equal(1))
+		Expect(client.Handle(messages.LabelSet{"job": "router"}, time.Now(), "too late")).ToNot(Succeed())
+	})
+
+	It("abandons pushes at the deadline and spools them", func() {
+		lock.Lock()
+		hanging = true
+		lock.Unlock()
+		client := newClient()
+		Expect(client.Handle(messages.LabelSet{"job": "router"}, time.Now(), "stuck")).To(Succeed())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		Expect(client.Shutdown(ctx)).To(Equal(context.DeadlineExceeded))
+		Expect(time.Since(start)).To(BeNumerically("<", 2*time.Second))
+		Expect(client.SpoolStats().Batches).To(Equal(1))
+		Expect(received()).To(Equal(0))
+	})
+})
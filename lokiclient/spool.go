@@ -0,0 +1,227 @@
+package lokiclient
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/prometheus/common/log"
+)
+
+const spoolBucket = "Spool"
+
+// SpoolConfig configures the on-disk spool for batches that could not be
+// delivered. An empty Path disables spooling.
+type SpoolConfig struct {
+	Path string
+	// MaxBytes caps the spool size; the oldest batches are dropped first.
+	// Zero means unbounded.
+	MaxBytes int64
+	// MaxAge drops spooled batches older than this instead of replaying
+	// them. Zero means batches never expire.
+	MaxAge time.Duration
+	// ReplayInterval is how often delivery of spooled batches is retried.
+	ReplayInterval time.Duration
+}
+
+// SpoolStats describes the current state of the spool.
+type SpoolStats struct {
+	Batches int
+	Bytes   int64
+	// Dropped counts batches discarded because of MaxBytes, MaxAge or
+	// a non-retryable response during replay.
+	Dropped int64
+}
+
+type spoolRecord struct {
+	Tenant      string    `json:"tenant"`
+	ContentType string    `json:"content_type"`
+	Created     time.Time `json:"created"`
+	Body        []byte    `json:"body"`
+}
+
+// spool persists encoded batches in a bolt bucket keyed by an increasing
+// sequence number, so iteration order is the order they failed in.
+type spool struct {
+	cfg SpoolConfig
+	db  *bolt.DB
+
+	lock  sync.Mutex
+	stats SpoolStats
+}
+
+func openSpool(cfg SpoolConfig) (*spool, error) {
+	db, err := bolt.Open(cfg.Path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open spool: %s", err)
+	}
+	s := &spool{cfg: cfg, db: db}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(spoolBucket))
+		if err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
+		return b.ForEach(func(k, v []byte) error {
+			s.stats.Batches++
+			s.stats.Bytes += int64(len(v))
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if s.stats.Batches > 0 {
+		log.Infof("Spool %s holds %d batches (%d bytes) to replay", cfg.Path, s.stats.Batches, s.stats.Bytes)
+	}
+	return s, nil
+}
+
+// push appends a record and trims the spool to MaxBytes.
+func (s *spool) push(rec spoolRecord) error {
+	value, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(spoolBucket))
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		if err := b.Put(key, value); err != nil {
+			return err
+		}
+		s.stats.Batches++
+		s.stats.Bytes += int64(len(value))
+
+		if s.cfg.MaxBytes <= 0 {
+			return nil
+		}
+		var trim [][]byte
+		c := b.Cursor()
+		for k, v := c.First(); k != nil && s.stats.Bytes > s.cfg.MaxBytes; k, v = c.Next() {
+			trim = append(trim, k)
+			s.stats.Batches--
+			s.stats.Bytes -= int64(len(v))
+			s.stats.Dropped++
+		}
+		for _, k := range trim {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		if len(trim) > 0 {
+			log.Warnf("Spool exceeded %d bytes, dropped %d oldest batches", s.cfg.MaxBytes, len(trim))
+		}
+		return nil
+	})
+}
+
+// first returns the oldest record, or a nil key if the spool is empty.
+func (s *spool) first() ([]byte, *spoolRecord, error) {
+	var key, value []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		k, v := tx.Bucket([]byte(spoolBucket)).Cursor().First()
+		if k != nil {
+			key = append([]byte(nil), k...)
+			value = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	if err != nil || key == nil {
+		return nil, nil, err
+	}
+	var rec spoolRecord
+	if err := json.Unmarshal(value, &rec); err != nil {
+		return key, nil, err
+	}
+	return key, &rec, nil
+}
+
+func (s *spool) remove(key []byte, dropped bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(spoolBucket))
+		v := b.Get(key)
+		if v == nil {
+			// Already trimmed by push.
+			return nil
+		}
+		s.stats.Batches--
+		s.stats.Bytes -= int64(len(v))
+		if dropped {
+			s.stats.Dropped++
+		}
+		return b.Delete(key)
+	})
+}
+
+// replay sends spooled batches oldest first until the spool is empty or a
+// send fails with a retryable error. Batches Loki refuses are passed to
+// rejected before they are removed.
+func (s *spool) replay(send func(rec *spoolRecord) (int, error), rejected func(rec *spoolRecord, err error)) {
+	for {
+		key, rec, err := s.first()
+		if key == nil {
+			return
+		}
+		if err != nil {
+			log.Errorf("Dropping unreadable spooled batch: %s", err)
+			if rmErr := s.remove(key, true); rmErr != nil {
+				log.Errorf("Error removing spooled batch: %s", rmErr)
+				return
+			}
+			continue
+		}
+		if s.cfg.MaxAge > 0 && time.Since(rec.Created) > s.cfg.MaxAge {
+			log.Warnf("Dropping spooled batch older than %s", s.cfg.MaxAge)
+			if rmErr := s.remove(key, true); rmErr != nil {
+				log.Errorf("Error removing spooled batch: %s", rmErr)
+				return
+			}
+			continue
+		}
+
+		status, err := send(rec)
+		if err != nil && retryable(status) {
+			log.Warnf("Replaying spooled batch failed, will retry in %s: %s", s.cfg.ReplayInterval, err)
+			return
+		}
+		if err != nil {
+			log.Errorf("Dropping spooled batch rejected by Loki: %s", err)
+			rejected(rec, err)
+		}
+		if rmErr := s.remove(key, err != nil); rmErr != nil {
+			log.Errorf("Error removing spooled batch: %s", rmErr)
+			return
+		}
+	}
+}
+
+func (s *spool) getStats() SpoolStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.stats
+}
+
+func (s *spool) close() error {
+	return s.db.Close()
+}
+
+// retryable reports whether a push that ended with status should be tried
+// again: connection-level errors, rate limiting and 5xx responses.
+func retryable(status int) bool {
+	return status <= 0 || status == http.StatusTooManyRequests || status/100 == 5
+}
@@ -0,0 +1,194 @@
+package lokiclient_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "github.com/bosh-loki/loki-firehose-nozzle/lokiclient"
+	"github.com/bosh-loki/loki-firehose-nozzle/messages"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Spool", func() {
+	var (
+		server   *httptest.Server
+		lock     sync.Mutex
+		healthy  bool
+		rejectBy string
+		received int
+		tmpDir   string
+	)
+
+	setHealthy := func(h bool) {
+		lock.Lock()
+		healthy = h
+		lock.Unlock()
+	}
+
+	receivedCount := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return received
+	}
+
+	BeforeEach(func() {
+		healthy = false
+		rejectBy = ""
+		received = 0
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			defer lock.Unlock()
+			if !healthy {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			received++
+			if rejectBy != "" {
+				http.Error(w, rejectBy, http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}))
+
+		var err error
+		tmpDir, err = ioutil.TempDir("", "spool")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(tmpDir)
+	})
+
+	newClientFor := func(api, encoding string, spool SpoolConfig) *Client {
+		path, err := PushPath(api)
+		Expect(err).ToNot(HaveOccurred())
+
+		cfg := DefaultConfig()
+		cfg.URL = server.URL + path
+		cfg.PushAPI = api
+		cfg.Encoding = encoding
+		cfg.BatchWait = 10 * time.Millisecond
+		cfg.BackoffConfig = BackoffConfig{MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxRetries: 2}
+		cfg.Spool = spool
+		cfg.DeadLetterPath = filepath.Join(tmpDir, "rejected.log")
+		client, err := New(cfg)
+		Expect(err).ToNot(HaveOccurred())
+		return client
+	}
+
+	newClient := func(spool SpoolConfig) *Client {
+		return newClientFor(PushAPILegacy, EncodingProtobuf, spool)
+	}
+
+	stats := func(client *Client) func() SpoolStats {
+		return func() SpoolStats {
+			return client.SpoolStats()
+		}
+	}
+
+	It("spools undeliverable batches and replays them once Loki is healthy", func() {
+		client := newClient(SpoolConfig{
+			Path:           filepath.Join(tmpDir, "spool.db"),
+			ReplayInterval: 20 * time.Millisecond,
+		})
+		defer client.Stop()
+
+		Expect(client.Handle(messages.LabelSet{"job": "router"}, time.Now(), "hello")).To(Succeed())
+		Eventually(stats(client)).Should(WithTransform(func(s SpoolStats) int { return s.Batches }, Equal(1)))
+		Expect(client.SpoolStats().Bytes).To(BeNumerically(">", 0))
+
+		setHealthy(true)
+		Eventually(stats(client)).Should(Equal(SpoolStats{}))
+		Expect(receivedCount()).To(Equal(1))
+	})
+
+	It("replays batches spooled before a restart", func() {
+		path := filepath.Join(tmpDir, "spool.db")
+		client := newClient(SpoolConfig{Path: path, ReplayInterval: time.Hour})
+		Expect(client.Handle(messages.LabelSet{"job": "router"}, time.Now(), "hello")).To(Succeed())
+		Eventually(stats(client)).Should(WithTransform(func(s SpoolStats) int { return s.Batches }, Equal(1)))
+		client.Stop()
+
+		setHealthy(true)
+		client = newClient(SpoolConfig{Path: path, ReplayInterval: time.Hour})
+		defer client.Stop()
+		Eventually(receivedCount).Should(Equal(1))
+		Expect(client.SpoolStats().Batches).To(Equal(0))
+	})
+
+	It("drops the oldest batches beyond the size cap", func() {
+		client := newClient(SpoolConfig{
+			Path:           filepath.Join(tmpDir, "spool.db"),
+			MaxBytes:       1,
+			ReplayInterval: time.Hour,
+		})
+		defer client.Stop()
+
+		Expect(client.Handle(messages.LabelSet{"job": "router"}, time.Now(), "hello")).To(Succeed())
+		Eventually(stats(client)).Should(WithTransform(func(s SpoolStats) int64 { return s.Dropped }, BeEquivalentTo(1)))
+		Expect(client.SpoolStats().Batches).To(Equal(0))
+	})
+
+	It("drops batches older than the max age instead of replaying them", func() {
+		client := newClient(SpoolConfig{
+			Path:           filepath.Join(tmpDir, "spool.db"),
+			MaxAge:         time.Nanosecond,
+			ReplayInterval: 20 * time.Millisecond,
+		})
+		defer client.Stop()
+
+		setHealthy(false)
+		Expect(client.Handle(messages.LabelSet{"job": "router"}, time.Now(), "hello")).To(Succeed())
+		Eventually(stats(client)).Should(WithTransform(func(s SpoolStats) int64 { return s.Dropped }, BeEquivalentTo(1)))
+		setHealthy(true)
+		Consistently(receivedCount, 100*time.Millisecond).Should(Equal(0))
+	})
+
+	for _, format := range [][2]string{
+		{PushAPILegacy, EncodingProtobuf},
+		{PushAPILegacy, EncodingJSON},
+		{PushAPIV1, EncodingProtobuf},
+		{PushAPIV1, EncodingJSON},
+	} {
+		api, encoding := format[0], format[1]
+		It(fmt.Sprintf("dead-letters a spooled %s %s batch Loki rejects on replay", api, encoding), func() {
+			client := newClientFor(api, encoding, SpoolConfig{
+				Path:           filepath.Join(tmpDir, "spool.db"),
+				ReplayInterval: 20 * time.Millisecond,
+			})
+			defer client.Stop()
+
+			ts := time.Unix(1560244893, 123456789)
+			Expect(client.Handle(messages.LabelSet{"job": "router"}, ts, "hello")).To(Succeed())
+			Eventually(stats(client)).Should(WithTransform(func(s SpoolStats) int { return s.Batches }, Equal(1)))
+
+			lock.Lock()
+			rejectBy = `entry for stream '{job="router"}' has timestamp too old: 2019-06-11 09:21:33 +0000 UTC`
+			healthy = true
+			lock.Unlock()
+			Eventually(client.RejectedEntries).Should(BeEquivalentTo(1))
+			Expect(client.SpoolStats().Batches).To(Equal(0))
+
+			f, err := os.Open(filepath.Join(tmpDir, "rejected.log"))
+			Expect(err).ToNot(HaveOccurred())
+			defer f.Close()
+			scanner := bufio.NewScanner(f)
+			Expect(scanner.Scan()).To(BeTrue())
+			var rec map[string]interface{}
+			Expect(json.Unmarshal(scanner.Bytes(), &rec)).To(Succeed())
+			Expect(rec).To(HaveKeyWithValue("stream", `{job="router"}`))
+			Expect(rec).To(HaveKeyWithValue("line", "hello"))
+			Expect(rec).To(HaveKeyWithValue("ts", ts.UTC().Format(time.RFC3339Nano)))
+		})
+	}
+})
@@ -0,0 +1,153 @@
+package lokifirehosenozzle
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Check is the outcome of a single health check.
+type Check struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+// Health is the outcome of a set of checks.
+type Health struct {
+	Checks []Check `json:"checks"`
+}
+
+// OK reports whether every check passed.
+func (h Health) OK() bool {
+	for _, c := range h.Checks {
+		if !c.OK {
+			return false
+		}
+	}
+	return true
+}
+
+// HealthHandler serves the result of f as JSON, with status 503 when a
+// check fails.
+func HealthHandler(f func() Health) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := f()
+		w.Header().Set("Content-Type", "application/json")
+		if !h.OK() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(h)
+	})
+}
+
+// healthState tracks what the nozzle knows about its upstreams.
+type healthState struct {
+	lock sync.Mutex
+
+	connected    bool
+	firehoseErr  error
+	lastEnvelope time.Time
+	cacheErr     error
+	cacheReady   bool
+	tokenErr     error
+	tokenFailing time.Time
+	maxSilence   time.Duration
+	startedAt    time.Time
+
+	// cachePopulated reports whether the started cache was filled.
+	cachePopulated func() bool
+}
+
+func (s *healthState) setConnected() {
+	s.lock.Lock()
+	s.connected = true
+	s.firehoseErr = nil
+	s.lock.Unlock()
+}
+
+func (s *healthState) setFirehoseError(err error) {
+	s.lock.Lock()
+	s.connected = false
+	s.firehoseErr = err
+	s.lock.Unlock()
+}
+
+func (s *healthState) setEnvelopeReceived(t time.Time) {
+	s.lock.Lock()
+	s.lastEnvelope = t
+	s.lock.Unlock()
+}
+
+func (s *healthState) setCache(err error) {
+	s.lock.Lock()
+	s.cacheReady = err == nil
+	s.cacheErr = err
+	s.lock.Unlock()
+}
+
+func (s *healthState) setCachePopulated(populated func() bool) {
+	s.lock.Lock()
+	s.cacheErr = nil
+	s.cachePopulated = populated
+	s.lock.Unlock()
+}
+
+func (s *healthState) setTokenRefresh(err error) {
+	s.lock.Lock()
+	if err != nil && s.tokenErr == nil {
+		s.tokenFailing = time.Now()
+	}
+	s.tokenErr = err
+	s.lock.Unlock()
+}
+
+func (s *healthState) firehoseCheck() Check {
+	c := Check{Name: "firehose", OK: s.connected}
+	switch {
+	case s.firehoseErr != nil:
+		c.Message = s.firehoseErr.Error()
+	case !s.connected:
+		c.Message = "not connected"
+	}
+	return c
+}
+
+func (s *healthState) envelopeCheck(now time.Time) Check {
+	c := Check{Name: "envelopes", OK: true}
+	last := s.lastEnvelope
+	if last.IsZero() {
+		c.Message = "no envelope received yet"
+		last = s.startedAt
+	} else {
+		c.Message = fmt.Sprintf("last envelope received %s ago", now.Sub(last).Round(time.Second))
+	}
+	if s.maxSilence > 0 && now.Sub(last) > s.maxSilence {
+		c.OK = false
+	}
+	return c
+}
+
+func (s *healthState) cacheCheck() Check {
+	if !s.cacheReady && s.cachePopulated != nil && s.cachePopulated() {
+		s.cacheReady = true
+	}
+	c := Check{Name: "cache", OK: s.cacheReady}
+	switch {
+	case s.cacheErr != nil:
+		c.Message = s.cacheErr.Error()
+	case !s.cacheReady:
+		c.Message = "not populated"
+	}
+	return c
+}
+
+func (s *healthState) tokenCheck() Check {
+	c := Check{Name: "uaa_token", OK: s.tokenErr == nil}
+	if s.tokenErr != nil {
+		c.Message = fmt.Sprintf("refresh failing since %s: %s", s.tokenFailing.Format(time.RFC3339), s.tokenErr)
+	}
+	return c
+}
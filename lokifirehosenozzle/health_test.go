@@ -0,0 +1,127 @@
+package lokifirehosenozzle_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/bosh-loki/loki-firehose-nozzle/cache"
+	"github.com/bosh-loki/loki-firehose-nozzle/lokiclient"
+	. "github.com/bosh-loki/loki-firehose-nozzle/lokifirehosenozzle"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Health", func() {
+	var (
+		loki       *httptest.Server
+		lokiStatus int
+		lokiClient *lokiclient.Client
+	)
+
+	BeforeEach(func() {
+		lokiStatus = http.StatusNoContent
+		loki = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(lokiStatus)
+		}))
+		cfg := lokiclient.DefaultConfig()
+		cfg.URL = loki.URL + "/api/prom/push"
+		cfg.BatchWait = 10 * time.Millisecond
+		cfg.BackoffConfig = lokiclient.BackoffConfig{MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxRetries: 1}
+		var err error
+		lokiClient, err = lokiclient.New(cfg)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		lokiClient.Stop()
+		loki.Close()
+	})
+
+	newNozzle := func(maxSilence time.Duration) Firehose {
+		return NewLokiFirehoseNozzle(nil, lokiClient, &cache.BoltdbConfig{}, "test", Options{MaxEnvelopeSilence: maxSilence})
+	}
+
+	check := func(h Health, name string) Check {
+		for _, c := range h.Checks {
+			if c.Name == name {
+				return c
+			}
+		}
+		Fail("no check named " + name)
+		return Check{}
+	}
+
+	envelope := func() *events.Envelope {
+		return &events.Envelope{
+			Origin:    proto.String("router"),
+			EventType: events.Envelope_CounterEvent.Enum(),
+			Timestamp: proto.Int64(time.Now().UnixNano()),
+			CounterEvent: &events.CounterEvent{
+				Name:  proto.String("requests"),
+				Delta: proto.Uint64(1),
+				Total: proto.Uint64(1),
+			},
+		}
+	}
+
+	It("is not ready before connecting to the firehose", func() {
+		nozzle := newNozzle(0)
+		ready := nozzle.Readiness()
+		Expect(ready.OK()).To(BeFalse())
+		Expect(check(ready, "firehose").OK).To(BeFalse())
+		Expect(check(ready, "cache").OK).To(BeFalse())
+		Expect(check(ready, "loki")).To(Equal(Check{Name: "loki", OK: true, Message: "nothing pushed yet"}))
+		Expect(nozzle.Liveness().OK()).To(BeTrue())
+	})
+
+	It("reports firehose errors", func() {
+		nozzle := newNozzle(0)
+		nozzle.ReportError(errors.New("websocket: close 1008"))
+		Expect(check(nozzle.Readiness(), "firehose")).To(Equal(Check{Name: "firehose", OK: false, Message: "websocket: close 1008"}))
+	})
+
+	It("reports failed Loki pushes", func() {
+		lokiStatus = http.StatusInternalServerError
+		nozzle := newNozzle(0)
+		nozzle.PostToLoki(envelope())
+
+		Eventually(func() bool { return check(nozzle.Readiness(), "loki").OK }).Should(BeFalse())
+		Expect(check(nozzle.Readiness(), "loki").Message).To(ContainSubstring("500"))
+	})
+
+	It("stays ready when Loki rejects entries", func() {
+		lokiStatus = http.StatusBadRequest
+		nozzle := newNozzle(0)
+		nozzle.PostToLoki(envelope())
+
+		Eventually(func() string { return check(nozzle.Readiness(), "loki").Message }).Should(HavePrefix("last push succeeded"))
+		Expect(check(nozzle.Readiness(), "loki").OK).To(BeTrue())
+	})
+
+	It("is not live once the firehose goes silent", func() {
+		nozzle := newNozzle(50 * time.Millisecond)
+		nozzle.PostToLoki(envelope())
+		Expect(nozzle.Liveness().OK()).To(BeTrue())
+		Eventually(func() bool { return nozzle.Liveness().OK() }).Should(BeFalse())
+	})
+
+	It("serves checks as JSON with a status code", func() {
+		nozzle := newNozzle(0)
+		rec := httptest.NewRecorder()
+		HealthHandler(nozzle.Readiness).ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+		Expect(rec.Code).To(Equal(http.StatusServiceUnavailable))
+
+		var h Health
+		Expect(json.NewDecoder(rec.Body).Decode(&h)).To(Succeed())
+		Expect(h.Checks).ToNot(BeEmpty())
+
+		rec = httptest.NewRecorder()
+		HealthHandler(nozzle.Liveness).ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+		Expect(rec.Code).To(Equal(http.StatusOK))
+	})
+})
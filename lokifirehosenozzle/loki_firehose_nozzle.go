@@ -1,11 +1,19 @@
 package lokifirehosenozzle
 
 import (
+	"context"
 	"crypto/tls"
+	"fmt"
 	"time"
 
 	"github.com/bosh-loki/loki-firehose-nozzle/cache"
+	"github.com/bosh-loki/loki-firehose-nozzle/enrich"
+	"github.com/bosh-loki/loki-firehose-nozzle/filter"
+	"github.com/bosh-loki/loki-firehose-nozzle/level"
 	"github.com/bosh-loki/loki-firehose-nozzle/messages"
+	"github.com/bosh-loki/loki-firehose-nozzle/multiline"
+	"github.com/bosh-loki/loki-firehose-nozzle/redact"
+	"github.com/bosh-loki/loki-firehose-nozzle/relabel"
 	"github.com/prometheus/common/log"
 
 	"github.com/bosh-loki/loki-firehose-nozzle/lokiclient"
@@ -22,47 +30,169 @@ type FirehoseHandler interface {
 type Firehose interface {
 	Connect() (<-chan *events.Envelope, <-chan error)
 	PostToLoki(*events.Envelope)
+	ReportError(error)
+	Liveness() Health
+	Readiness() Health
+	Stop(ctx context.Context) error
 }
 
 type LokiFirehoseNozzle struct {
 	cfClient       *cfclient.Client
+	cfConsumer     *consumer.Consumer
 	cfConfig       *cfclient.Config
 	cachingConfig  *cache.BoltdbConfig
 	cachingClient  cache.Cache
 	lokiClient     *lokiclient.Client
 	subscriptionID string
+	options        Options
+	health         *healthState
 }
 
-func NewLokiFirehoseNozzle(cfConfig *cfclient.Config, lokiClient *lokiclient.Client, cachingConfig *cache.BoltdbConfig, subscriptionID string) Firehose {
-	return &LokiFirehoseNozzle{
+// Options control how envelopes are turned into Loki entries.
+type Options struct {
+	TimestampPolicy messages.TimestampPolicy
+	// OutputFormats decide how the lines of non-log events are written.
+	OutputFormats messages.OutputFormats
+	// Promoter turns envelope tags and app metadata labels into labels.
+	Promoter *messages.Promoter
+	// Enricher adds app metadata without blocking on cache misses; nil
+	// looks apps up synchronously.
+	Enricher *enrich.Enricher
+	// Filters decide which envelopes are shipped.
+	Filters *filter.Filters
+	// RequireAppMetadata drops the envelopes of apps whose metadata could
+	// not be found, when opt-outs, filters, redaction or the tenant depend
+	// on it.
+	RequireAppMetadata bool
+	// Multiline stitches continuation lines of log messages; nil disables it.
+	Multiline *multiline.Stitcher
+	// Levels detects the level of log messages; nil disables it.
+	Levels *level.Detector
+	// Redact masks secrets in every line before it is pushed.
+	Redact redact.Rules
+	// Relabel is applied to every entry before it is pushed.
+	Relabel relabel.Rules
+	// MaxEnvelopeSilence reports the nozzle as not live once no envelope
+	// arrived for that long; zero disables the check.
+	MaxEnvelopeSilence time.Duration
+}
+
+func NewLokiFirehoseNozzle(cfConfig *cfclient.Config, lokiClient *lokiclient.Client, cachingConfig *cache.BoltdbConfig, subscriptionID string, options Options) Firehose {
+	c := &LokiFirehoseNozzle{
 		cfConfig:       cfConfig,
 		lokiClient:     lokiClient,
 		cachingConfig:  cachingConfig,
 		subscriptionID: subscriptionID,
+		options:        options,
+		health:         &healthState{maxSilence: options.MaxEnvelopeSilence, startedAt: time.Now()},
+	}
+	if options.Multiline != nil {
+		options.Multiline.Start(c.ship)
 	}
+	return c
 }
 
 func (c *LokiFirehoseNozzle) Connect() (<-chan *events.Envelope, <-chan error) {
 	c.cfClient = c.createCFClinet()
 	c.cachingClient = c.createCachingClinet()
+	if c.options.Enricher != nil {
+		c.options.Enricher.Start(c.cachingClient)
+	}
 
-	cfConsumer := consumer.New(
+	c.cfConsumer = consumer.New(
 		c.cfClient.Endpoint.DopplerEndpoint,
 		&tls.Config{InsecureSkipVerify: c.cfConfig.SkipSslValidation},
 		nil)
 	log.Infof("Using Doppler endpoint: %s", c.cfClient.Endpoint.DopplerEndpoint)
 
-	refresher := cfClientTokenRefresh{cfClient: c.cfClient}
-	cfConsumer.SetIdleTimeout(time.Duration(30) * time.Second)
-	cfConsumer.SetMaxRetryCount(20)
-	cfConsumer.RefreshTokenFrom(&refresher)
-	return cfConsumer.Firehose(c.subscriptionID, "")
+	refresher := cfClientTokenRefresh{cfClient: c.cfClient, health: c.health}
+	c.cfConsumer.SetOnConnectCallback(c.health.setConnected)
+	c.cfConsumer.SetIdleTimeout(time.Duration(30) * time.Second)
+	c.cfConsumer.SetMaxRetryCount(20)
+	c.cfConsumer.RefreshTokenFrom(&refresher)
+	return c.cfConsumer.Firehose(c.subscriptionID, "")
+}
+
+// Stop disconnects from the firehose, flushes held, stitched and pending entries to
+// Loki until ctx is done and stops the app cache. It returns the first error met.
+func (c *LokiFirehoseNozzle) Stop(ctx context.Context) error {
+	var firstErr error
+	if c.cfConsumer != nil {
+		if err := c.cfConsumer.Close(); err != nil {
+			log.Warnf("Error closing firehose consumer: %v", err)
+		}
+	}
+	if c.options.Enricher != nil {
+		c.options.Enricher.Stop()
+	}
+	if c.options.Multiline != nil {
+		c.options.Multiline.Stop()
+	}
+	if err := c.lokiClient.Shutdown(ctx); err != nil {
+		log.Errorf("Error flushing entries to Loki: %v", err)
+		firstErr = err
+	}
+	if c.cachingClient != nil {
+		if err := c.cachingClient.Stop(); err != nil {
+			log.Errorf("Error stopping cache: %v", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
 }
 
 func (c *LokiFirehoseNozzle) PostToLoki(e *events.Envelope) {
-	lastLineTime := time.Now()
-	event := messages.GetMessage(e, c.cachingClient)
-	_ = c.lokiClient.Handle(event.Labels, lastLineTime, event.Msg)
+	receivedAt := time.Now()
+	c.health.setEnvelopeReceived(receivedAt)
+	envelopesReceived.WithLabelValues(e.GetEventType().String()).Inc()
+	if !c.options.Filters.AllowEnvelope(e) {
+		return
+	}
+	if c.options.Enricher == nil {
+		c.process(e, messages.GetMessage(e, c.cachingClient), receivedAt)
+		return
+	}
+	event := messages.GetMessage(e, nil)
+	c.options.Enricher.Add(event, func() { c.process(e, event, receivedAt) })
+}
+
+// process promotes, renders, filters and ships event, the annotated event
+// of e.
+func (c *LokiFirehoseNozzle) process(e *events.Envelope, event *messages.Event, receivedAt time.Time) {
+	if c.options.RequireAppMetadata && event.Labels["cf_app_id"] != "" && !event.Annotated {
+		unannotated.Inc()
+		return
+	}
+	if event.Ignored {
+		optedOut.Inc()
+		return
+	}
+	c.options.Promoter.Promote(e.GetTags(), event.AppLabels, event.Labels)
+	event.Msg = c.options.OutputFormats.Render(e.GetEventType(), event)
+	if !c.options.Filters.AllowEvent(e, event.Labels) {
+		return
+	}
+	event.Timestamp = c.options.TimestampPolicy.Resolve(event.Timestamp, receivedAt)
+	if c.options.Multiline != nil {
+		c.options.Multiline.Add(event)
+		return
+	}
+	c.ship(event)
+}
+
+// ship detects the level of event, redacts, relabels and hands it to the
+// Loki client.
+func (c *LokiFirehoseNozzle) ship(event *messages.Event) {
+	c.options.Levels.Apply(event)
+	c.options.Redact.Apply(event)
+	labels := c.options.Relabel.Process(event.Labels)
+	if labels == nil {
+		relabelDropped.Inc()
+		return
+	}
+	_ = c.lokiClient.Handle(labels, event.Timestamp, event.Msg)
 }
 
 func (c *LokiFirehoseNozzle) createCFClinet() *cfclient.Client {
@@ -74,39 +204,95 @@ func (c *LokiFirehoseNozzle) createCFClinet() *cfclient.Client {
 	return cfClient
 }
 
+// ReportError records an error received from the firehose consumer.
+func (c *LokiFirehoseNozzle) ReportError(err error) {
+	log.Errorln(err)
+	c.health.setFirehoseError(err)
+}
+
+// Liveness reports failures that a restart may fix: a failing UAA token
+// refresh or a firehose that went silent.
+func (c *LokiFirehoseNozzle) Liveness() Health {
+	c.health.lock.Lock()
+	defer c.health.lock.Unlock()
+	return Health{Checks: []Check{
+		c.health.tokenCheck(),
+		c.health.envelopeCheck(time.Now()),
+	}}
+}
+
+// Readiness reports whether the nozzle is connected to the firehose, has
+// populated its app cache and is delivering to Loki.
+func (c *LokiFirehoseNozzle) Readiness() Health {
+	c.health.lock.Lock()
+	checks := []Check{
+		c.health.firehoseCheck(),
+		c.health.envelopeCheck(time.Now()),
+		c.health.cacheCheck(),
+		c.health.tokenCheck(),
+	}
+	c.health.lock.Unlock()
+
+	loki := Check{Name: "loki", OK: true}
+	last := c.lokiClient.LastPush()
+	switch {
+	case last.Err != nil:
+		loki.OK = false
+		loki.Message = fmt.Sprintf("last push at %s failed: %s", last.Time.Format(time.RFC3339), last.Err)
+	case last.Time.IsZero():
+		loki.Message = "nothing pushed yet"
+	default:
+		loki.Message = fmt.Sprintf("last push succeeded at %s", last.Time.Format(time.RFC3339))
+	}
+	return Health{Checks: append(checks, loki)}
+}
+
 type cfClientTokenRefresh struct {
 	cfClient *cfclient.Client
+	health   *healthState
 }
 
 func (ct *cfClientTokenRefresh) RefreshAuthToken() (token string, err error) {
 	log.Infoln("Refreshing Auth Token")
-	return ct.cfClient.GetToken()
+	token, err = ct.cfClient.GetToken()
+	ct.health.setTokenRefresh(err)
+	return token, err
 }
 
 // AppCache creates in-memory cache or boltDB cache
-func (c *LokiFirehoseNozzle) appCache(client cache.AppClient) (cache.Cache, error) {
+func (c *LokiFirehoseNozzle) appCache() (cache.Cache, error) {
+	appClient, err := cache.NewAppClient(c.cfClient, c.cachingConfig.APIVersion)
+	if err != nil {
+		return nil, err
+	}
+
 	if c.cachingConfig.Path != "" {
 		log.Infoln("Using BoltDB for cache.")
-		return cache.NewBoltdb(client, c.cachingConfig)
+		return cache.NewBoltdb(appClient, c.cachingConfig)
 	}
 
 	log.Infoln("Using in Memory cache.")
-	return cache.NewNoCache(), nil
+	return cache.NewMemory(appClient, c.cachingConfig), nil
 }
 
 func (c *LokiFirehoseNozzle) createCachingClinet() cache.Cache {
-	appCache, err := c.appCache(c.cfClient)
+	appCache, err := c.appCache()
 	if err != nil {
 		log.Errorf("Encountered an error while setting up the caching client: %v", err)
+		c.health.setCache(err)
 		return nil
 	}
 
-	err = appCache.Open()
-	if err != nil {
-		log.Errorf("Error open cache: %v", err)
+	if err := appCache.Start(context.Background()); err != nil {
+		log.Errorf("Error starting cache: %v", err)
+		c.health.setCache(err)
+		appCache.Stop()
 		return nil
 	}
-	defer appCache.Close()
+	// A cache that could not be listed yet keeps retrying; it is reported
+	// not ready until then.
+	c.health.setCachePopulated(appCache.Populated)
 
+	// Stopped by Stop.
 	return appCache
 }
@@ -0,0 +1,13 @@
+package lokifirehosenozzle_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestLokifirehosenozzle(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Lokifirehosenozzle Suite")
+}
@@ -0,0 +1,25 @@
+package lokifirehosenozzle
+
+import (
+	"github.com/bosh-loki/loki-firehose-nozzle/metrics"
+)
+
+var (
+	envelopesReceived = metrics.NewCounterVec(
+		"loki_nozzle_envelopes_received_total",
+		"Envelopes received from the firehose by event type.",
+		"event_type")
+	relabelDroppedVec, relabelDropped = metrics.NewCounter(
+		"loki_nozzle_relabel_dropped_entries_total",
+		"Entries dropped by a keep or drop relabel rule.")
+	optedOutVec, optedOut = metrics.NewCounter(
+		"loki_nozzle_opted_out_envelopes_total",
+		"Envelopes dropped because their app, space or org opted out of logging.")
+	unannotatedVec, unannotated = metrics.NewCounter(
+		"loki_nozzle_unannotated_dropped_envelopes_total",
+		"Envelopes dropped because the metadata of their app could not be found and is required.")
+)
+
+func init() {
+	metrics.MustRegister(envelopesReceived, relabelDroppedVec, optedOutVec, unannotatedVec)
+}
@@ -1,18 +1,30 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/bosh-loki/loki-firehose-nozzle/cache"
 	"github.com/bosh-loki/loki-firehose-nozzle/config"
+	"github.com/bosh-loki/loki-firehose-nozzle/enrich"
 	"github.com/bosh-loki/loki-firehose-nozzle/extralabels"
+	"github.com/bosh-loki/loki-firehose-nozzle/filter"
+	"github.com/bosh-loki/loki-firehose-nozzle/level"
 
 	"github.com/bosh-loki/loki-firehose-nozzle/lokiclient"
 	"github.com/bosh-loki/loki-firehose-nozzle/lokifirehosenozzle"
+	"github.com/bosh-loki/loki-firehose-nozzle/messages"
+	"github.com/bosh-loki/loki-firehose-nozzle/metrics"
+	"github.com/bosh-loki/loki-firehose-nozzle/multiline"
+	"github.com/bosh-loki/loki-firehose-nozzle/redact"
+	"github.com/bosh-loki/loki-firehose-nozzle/relabel"
 
 	"github.com/cloudfoundry-community/go-cfclient"
 	"github.com/prometheus/common/log"
@@ -20,8 +32,16 @@ import (
 
 var (
 	configFile = flag.String("config", "", "Location of the nozzle config toml file")
+
+	firehoseErrorsVec, firehoseErrors = metrics.NewCounter(
+		"loki_nozzle_firehose_errors_total",
+		"Errors reported by the firehose consumer.")
 )
 
+func init() {
+	metrics.MustRegister(firehoseErrorsVec)
+}
+
 type LokiAdapter struct {
 	client *lokiclient.Client
 }
@@ -33,6 +53,9 @@ func main() {
 	if err != nil {
 		log.Fatalf("Error parsing config: %s", err)
 	}
+	if err := conf.Validate(); err != nil {
+		log.Fatalf("Invalid config: %s", err)
+	}
 
 	cfConfig := &cfclient.Config{
 		ApiAddress:        conf.CF.APIEndpoint,
@@ -46,13 +69,63 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	lokiClient, err := lokiclient.NewWithDefaults(
-		fmt.Sprintf("http://%s:%d/api/prom/push", conf.Loki.Endpoint, conf.Loki.Port),
-		baseLabels,
-	)
+	pushPath, err := lokiclient.PushPath(conf.Loki.PushAPI)
+	if err != nil {
+		log.Fatal(err)
+	}
+	scheme := conf.Loki.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	lokiConfig := lokiclient.DefaultConfig()
+	lokiConfig.URL = fmt.Sprintf("%s://%s:%d%s", scheme, conf.Loki.Endpoint, conf.Loki.Port, pushPath)
+	lokiConfig.PushAPI = conf.Loki.PushAPI
+	lokiConfig.Encoding = conf.Loki.Encoding
+	lokiConfig.ExternalLabels = baseLabels
+	lokiConfig.TenantLabel = conf.Loki.TenantLabel
+	lokiConfig.DefaultTenant = conf.Loki.DefaultTenant
+	lokiConfig.DeadLetterPath = conf.Loki.DeadLetterPath
+	lokiConfig.Auth = lokiclient.AuthConfig{
+		Username:        conf.Loki.Username,
+		Password:        conf.Loki.Password,
+		BearerToken:     conf.Loki.BearerToken,
+		BearerTokenFile: conf.Loki.BearerTokenFile,
+	}
+	lokiConfig.TLSConfig = lokiclient.TLSConfig{
+		CAFile:             conf.Loki.CAFile,
+		CertFile:           conf.Loki.CertFile,
+		KeyFile:            conf.Loki.KeyFile,
+		InsecureSkipVerify: conf.Loki.InsecureSkipVerify,
+	}
+	if conf.Loki.Senders != 0 {
+		lokiConfig.Senders = conf.Loki.Senders
+	}
+	if conf.Loki.MaxInFlight != 0 {
+		lokiConfig.MaxInFlight = conf.Loki.MaxInFlight
+	}
+	if conf.Loki.QueueCapacity != 0 {
+		lokiConfig.QueueCapacity = conf.Loki.QueueCapacity
+	}
+	if conf.Loki.OverflowPolicy != "" {
+		lokiConfig.OverflowPolicy = conf.Loki.OverflowPolicy
+	}
+	if conf.Loki.MinPushInterval.Duration != 0 {
+		lokiConfig.Rate.MinInterval = conf.Loki.MinPushInterval.Duration
+	}
+	if conf.Loki.MaxPushInterval.Duration != 0 {
+		lokiConfig.Rate.MaxInterval = conf.Loki.MaxPushInterval.Duration
+	}
+	lokiConfig.Spool.Path = conf.Loki.SpoolPath
+	lokiConfig.Spool.MaxBytes = conf.Loki.SpoolMaxBytes
+	lokiConfig.Spool.MaxAge = conf.Loki.SpoolMaxAge.Duration
+	if conf.Loki.SpoolReplayInterval.Duration != 0 {
+		lokiConfig.Spool.ReplayInterval = conf.Loki.SpoolReplayInterval.Duration
+	}
+	lokiClient, err := lokiclient.New(lokiConfig)
 	if err != nil {
 		log.Fatal(err)
 	}
+	lokiClient.RegisterMetrics()
 
 	cacheConfig := &cache.BoltdbConfig{
 		Path:               conf.Nozzle.BoltDBPath,
@@ -61,9 +134,97 @@ func main() {
 		AppCacheTTL:        conf.Nozzle.AppCacheTTL.Duration,
 		OrgSpaceCacheTTL:   conf.Nozzle.OrgSpaceCacheTTL.Duration,
 		AppLimits:          conf.Nozzle.AppLimits,
+		OptOut: cache.OptOutPolicy{
+			EnvVar: conf.Nozzle.OptOutEnvVar,
+			Label:  conf.Nozzle.OptOutLabel,
+			Orgs:   conf.Nozzle.OptOutOrgs,
+			Spaces: conf.Nozzle.OptOutSpaces,
+		},
+		AppMetadata: len(conf.Nozzle.PromoteAppLabels) > 0,
+		MaxApps:     conf.Nozzle.AppCacheSize,
+		APIVersion:  conf.Nozzle.CFAPIVersion,
+	}
+
+	timestampPolicy, err := messages.NewTimestampPolicy(conf.Nozzle.TimestampPolicy, conf.Nozzle.MaxClockDrift.Duration)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	outputFormats, err := messages.NewOutputFormats(conf.Nozzle.OutputFormat, conf.Nozzle.OutputFormats)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	stitcher, err := multiline.New(multiline.Config{
+		Start:        conf.Nozzle.MultilineStart,
+		Continuation: conf.Nozzle.MultilineContinuation,
+		FlushTimeout: conf.Nozzle.MultilineFlushTimeout.Duration,
+		MaxLines:     conf.Nozzle.MultilineMaxLines,
+	})
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	client := lokifirehosenozzle.NewLokiFirehoseNozzle(cfConfig, lokiClient, cacheConfig, conf.CF.SubscriptionID)
+	levels, err := level.New(conf.Nozzle.LevelDetection)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	enricher, err := enrich.New(enrich.Config{
+		Mode:          conf.Nozzle.EnrichmentMode,
+		BufferTimeout: conf.Nozzle.EnrichmentTimeout.Duration,
+		MaxBuffered:   conf.Nozzle.EnrichmentMaxBuffered,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	enricher.RegisterMetrics()
+
+	promoter := messages.NewPromoter(messages.PromoteConfig{
+		Tags:      conf.Nozzle.PromoteTags,
+		AppLabels: conf.Nozzle.PromoteAppLabels,
+		MaxValues: conf.Nozzle.PromoteMaxValues,
+	})
+	promoter.RegisterMetrics()
+
+	filters, err := filter.Compile(conf.Filters)
+	if err != nil {
+		log.Fatal(err)
+	}
+	filters.RegisterMetrics()
+
+	redactionRules, err := redact.Compile(conf.RedactionRules)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	relabelRules, err := relabel.Compile(conf.RelabelConfigs)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	shutdownTimeout := conf.Nozzle.ShutdownTimeout.Duration
+	if shutdownTimeout == 0 {
+		shutdownTimeout = 10 * time.Second
+	}
+
+	client := lokifirehosenozzle.NewLokiFirehoseNozzle(cfConfig, lokiClient, cacheConfig, conf.CF.SubscriptionID, lokifirehosenozzle.Options{
+		TimestampPolicy:    timestampPolicy,
+		OutputFormats:      outputFormats,
+		Promoter:           promoter,
+		Enricher:           enricher,
+		Filters:            filters,
+		RequireAppMetadata: conf.AppMetadataRequired(),
+		Multiline:          stitcher,
+		Levels:             levels,
+		Redact:             redactionRules,
+		Relabel:            relabelRules,
+		MaxEnvelopeSilence: conf.Nozzle.MaxEnvelopeSilence.Duration,
+	})
+
+	if conf.Nozzle.ListenAddress != "" {
+		go serveHTTP(conf.Nozzle.ListenAddress, client)
+	}
 
 	firehose, errorhose := client.Connect()
 	if firehose == nil {
@@ -72,7 +233,7 @@ func main() {
 		panic(errors.New("errorhose was nil"))
 	}
 	exitSignal := make(chan os.Signal, 1)
-	signal.Notify(exitSignal, os.Interrupt)
+	signal.Notify(exitSignal, os.Interrupt, syscall.SIGTERM)
 
 	for {
 		select {
@@ -86,10 +247,46 @@ func main() {
 			if err == nil {
 				log.Errorln("received nil envelope")
 			} else {
-				log.Errorln(err)
+				firehoseErrors.Inc()
+				client.ReportError(err)
 			}
-		case <-exitSignal:
-			os.Exit(0)
+		case sig := <-exitSignal:
+			log.Infof("Received %s, shutting down", sig)
+			os.Exit(shutdown(client, exitSignal, shutdownTimeout))
 		}
 	}
 }
+
+// serveHTTP exposes the nozzle's own metrics and health checks on addr.
+func serveHTTP(addr string, client lokifirehosenozzle.Firehose) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.Handle("/healthz", lokifirehosenozzle.HealthHandler(client.Liveness))
+	mux.Handle("/readyz", lokifirehosenozzle.HealthHandler(client.Readiness))
+	log.Infof("Serving metrics and health checks on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Fatalf("Error serving metrics and health checks: %s", err)
+	}
+}
+
+// shutdown stops the nozzle and returns the process exit code. A second
+// signal aborts the flush.
+func shutdown(client lokifirehosenozzle.Firehose, exitSignal <-chan os.Signal, timeout time.Duration) int {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		select {
+		case sig := <-exitSignal:
+			log.Warnf("Received %s again, abandoning pending entries", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if err := client.Stop(ctx); err != nil {
+		log.Errorf("Shutdown incomplete: %s", err)
+		return 1
+	}
+	log.Infoln("Shutdown complete")
+	return 0
+}
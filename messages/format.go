@@ -0,0 +1,131 @@
+package messages
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// Output formats.
+const (
+	// FormatText keeps the human readable line of each event type.
+	FormatText = "text"
+	// FormatLogfmt writes every field of the event as key=value pairs.
+	FormatLogfmt = "logfmt"
+	// FormatJSON writes every field of the event as a JSON object.
+	FormatJSON = "json"
+)
+
+// Field is a named value of an event, in the order it is written.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// OutputFormats decides how the line of each event type is written. Log
+// messages always keep the line the app wrote.
+type OutputFormats struct {
+	Default string
+	ByType  map[events.Envelope_EventType]string
+}
+
+// NewOutputFormats validates def and the formats keyed by event type name,
+// e.g. "HttpStartStop", and returns OutputFormats.
+func NewOutputFormats(def string, byType map[string]string) (OutputFormats, error) {
+	def, err := checkFormat(def)
+	if err != nil {
+		return OutputFormats{}, err
+	}
+	f := OutputFormats{Default: def, ByType: map[events.Envelope_EventType]string{}}
+	for name, format := range byType {
+		t, ok := events.Envelope_EventType_value[name]
+		if !ok {
+			return OutputFormats{}, fmt.Errorf("unknown event type %q", name)
+		}
+		if f.ByType[events.Envelope_EventType(t)], err = checkFormat(format); err != nil {
+			return OutputFormats{}, err
+		}
+	}
+	return f, nil
+}
+
+func checkFormat(format string) (string, error) {
+	switch format {
+	case "":
+		return FormatText, nil
+	case FormatText, FormatLogfmt, FormatJSON:
+		return format, nil
+	}
+	return "", fmt.Errorf("unknown output format %q", format)
+}
+
+// Render returns the line of event, an event of type t.
+func (f OutputFormats) Render(t events.Envelope_EventType, event *Event) string {
+	if len(event.Fields) == 0 {
+		return event.Msg
+	}
+	format, ok := f.ByType[t]
+	if !ok {
+		format = f.Default
+	}
+	switch format {
+	case FormatLogfmt:
+		return logfmt(event.Fields)
+	case FormatJSON:
+		return jsonLine(event.Fields)
+	}
+	return event.Msg
+}
+
+func logfmt(fields []Field) string {
+	var b strings.Builder
+	for i, f := range fields {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(f.Key)
+		b.WriteByte('=')
+		v := fieldString(f.Value)
+		if v == "" || strings.ContainsAny(v, " =\"\\\t\n\r") {
+			v = strconv.Quote(v)
+		}
+		b.WriteString(v)
+	}
+	return b.String()
+}
+
+func jsonLine(fields []Field) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, f := range fields {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(f.Key)
+		value, err := json.Marshal(f.Value)
+		if err != nil {
+			// Only NaN and infinite floats fail; write them as strings.
+			value, _ = json.Marshal(fieldString(f.Value))
+		}
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func fieldString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []string:
+		return strings.Join(v, ",")
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,104 @@
+package messages_test
+
+import (
+	. "github.com/bosh-loki/loki-firehose-nozzle/messages"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("OutputFormats", func() {
+	httpEnvelope := func() *events.Envelope {
+		return &events.Envelope{
+			EventType: events.Envelope_HttpStartStop.Enum(),
+			HttpStartStop: &events.HttpStartStop{
+				StartTimestamp: proto.Int64(1000000000),
+				StopTimestamp:  proto.Int64(1012500000),
+				RequestId:      &events.UUID{Low: proto.Uint64(0x0706050403020100), High: proto.Uint64(0x0f0e0d0c0b0a0908)},
+				PeerType:       events.PeerType_Client.Enum(),
+				Method:         events.Method_GET.Enum(),
+				Uri:            proto.String("http://app.example.com/health?full=1"),
+				RemoteAddress:  proto.String("10.0.0.1:51234"),
+				UserAgent:      proto.String("curl/7.64.1"),
+				StatusCode:     proto.Int32(200),
+				ContentLength:  proto.Int64(42),
+				InstanceIndex:  proto.Int32(1),
+				Forwarded:      []string{"203.0.113.7", "10.0.0.1"},
+			},
+		}
+	}
+
+	render := func(formats OutputFormats, e *events.Envelope) string {
+		return formats.Render(e.GetEventType(), GetMessage(e, &staticCache{}))
+	}
+
+	It("keeps the text line by default", func() {
+		formats, err := NewOutputFormats("", nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(render(formats, httpEnvelope())).To(Equal("200 GET http://app.example.com/health?full=1 (12 ms)"))
+	})
+
+	It("writes every HttpStartStop field as JSON", func() {
+		formats, err := NewOutputFormats("text", map[string]string{"HttpStartStop": "json"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(render(formats, httpEnvelope())).To(MatchJSON(`{
+			"start_timestamp": 1000000000,
+			"stop_timestamp": 1012500000,
+			"duration_ms": 12.5,
+			"request_id": "00010203-0405-0607-0809-0a0b0c0d0e0f",
+			"peer_type": "Client",
+			"method": "GET",
+			"uri": "http://app.example.com/health?full=1",
+			"remote_address": "10.0.0.1:51234",
+			"user_agent": "curl/7.64.1",
+			"status_code": 200,
+			"content_length": 42,
+			"instance_index": 1,
+			"forwarded": ["203.0.113.7", "10.0.0.1"]
+		}`))
+	})
+
+	It("writes logfmt, quoting values when needed", func() {
+		formats, err := NewOutputFormats("logfmt", nil)
+		Expect(err).ToNot(HaveOccurred())
+		e := &events.Envelope{
+			EventType: events.Envelope_Error.Enum(),
+			Error: &events.Error{
+				Source:  proto.String("router"),
+				Code:    proto.Int32(500),
+				Message: proto.String(`backend said "no"`),
+			},
+		}
+		Expect(render(formats, e)).To(Equal(`source=router code=500 message="backend said \"no\""`))
+
+		e = &events.Envelope{
+			EventType: events.Envelope_ContainerMetric.Enum(),
+			ContainerMetric: &events.ContainerMetric{
+				ApplicationId: proto.String("app-guid"),
+				InstanceIndex: proto.Int32(0),
+				CpuPercentage: proto.Float64(1.5),
+				MemoryBytes:   proto.Uint64(1024),
+				DiskBytes:     proto.Uint64(2048),
+			},
+		}
+		Expect(render(formats, e)).To(Equal("application_id=app-guid instance_index=0 cpu_percentage=1.5 memory_bytes=1024 disk_bytes=2048"))
+	})
+
+	It("never rewrites log messages", func() {
+		formats, err := NewOutputFormats("json", nil)
+		Expect(err).ToNot(HaveOccurred())
+		e := &events.Envelope{
+			EventType:  events.Envelope_LogMessage.Enum(),
+			LogMessage: &events.LogMessage{Message: []byte("hello"), MessageType: events.LogMessage_OUT.Enum()},
+		}
+		Expect(render(formats, e)).To(Equal("hello"))
+	})
+
+	It("rejects unknown formats and event types", func() {
+		_, err := NewOutputFormats("xml", nil)
+		Expect(err).To(HaveOccurred())
+		_, err = NewOutputFormats("", map[string]string{"HttpStart": "json"})
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -2,6 +2,7 @@ package messages
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/bosh-loki/loki-firehose-nozzle/cache"
 	"github.com/bosh-loki/loki-firehose-nozzle/utils"
@@ -10,8 +11,18 @@ import (
 )
 
 type Event struct {
-	Labels LabelSet
-	Msg    string
+	Labels    LabelSet
+	Msg       string
+	Timestamp time.Time
+	// Fields are every field of a non-log event, used to write it as
+	// logfmt or JSON.
+	Fields []Field
+	// Ignored is set when the event's app opted out of logging.
+	Ignored bool
+	// AppLabels are the CF v3 metadata labels of the event's app.
+	AppLabels map[string]string
+	// Annotated is set once the metadata of the event's app was added.
+	Annotated bool
 }
 
 func GetMessage(e *events.Envelope, c cache.Cache) *Event {
@@ -52,9 +63,14 @@ func newLogMessage(e *events.Envelope) *Event {
 		"source_type":     m.GetSourceType(),
 	}
 	msg := string(m.GetMessage())
+	ts := fromUnixNano(m.GetTimestamp())
+	if ts.IsZero() {
+		ts = fromUnixNano(e.GetTimestamp())
+	}
 	return &Event{
-		Labels: r,
-		Msg:    msg,
+		Labels:    r,
+		Msg:       msg,
+		Timestamp: ts,
 	}
 }
 
@@ -73,6 +89,12 @@ func newValueMetric(e *events.Envelope) *Event {
 	return &Event{
 		Labels: r,
 		Msg:    msg,
+		Fields: []Field{
+			{"name", m.GetName()},
+			{"value", m.GetValue()},
+			{"unit", m.GetUnit()},
+		},
+		Timestamp: fromUnixNano(e.GetTimestamp()),
 	}
 }
 
@@ -94,9 +116,40 @@ func newHTTPStartStop(e *events.Envelope) *Event {
 		r["instance_id"] = m.GetInstanceId()
 	}
 	msg := fmt.Sprintf("%d %s %s (%d ms)", m.GetStatusCode(), m.GetMethod(), m.GetUri(), ((m.GetStopTimestamp()-m.GetStartTimestamp())/1000)/1000)
+	ts := fromUnixNano(m.GetStartTimestamp())
+	if ts.IsZero() {
+		ts = fromUnixNano(e.GetTimestamp())
+	}
+	fields := []Field{
+		{"start_timestamp", m.GetStartTimestamp()},
+		{"stop_timestamp", m.GetStopTimestamp()},
+		{"duration_ms", float64(m.GetStopTimestamp()-m.GetStartTimestamp()) / 1e6},
+		{"request_id", utils.FormatUUID(m.GetRequestId())},
+		{"peer_type", m.GetPeerType().String()},
+		{"method", m.GetMethod().String()},
+		{"uri", m.GetUri()},
+		{"remote_address", m.GetRemoteAddress()},
+		{"user_agent", m.GetUserAgent()},
+		{"status_code", m.GetStatusCode()},
+		{"content_length", m.GetContentLength()},
+	}
+	if m.ApplicationId != nil {
+		fields = append(fields, Field{"application_id", utils.FormatUUID(m.GetApplicationId())})
+	}
+	if m.InstanceIndex != nil {
+		fields = append(fields, Field{"instance_index", m.GetInstanceIndex()})
+	}
+	if m.InstanceId != nil {
+		fields = append(fields, Field{"instance_id", m.GetInstanceId()})
+	}
+	if len(m.GetForwarded()) > 0 {
+		fields = append(fields, Field{"forwarded", m.GetForwarded()})
+	}
 	return &Event{
-		Labels: r,
-		Msg:    msg,
+		Labels:    r,
+		Msg:       msg,
+		Fields:    fields,
+		Timestamp: ts,
 	}
 }
 
@@ -113,9 +166,24 @@ func newContainerMetric(e *events.Envelope) *Event {
 		"origin":     e.GetOrigin(),
 	}
 	msg := fmt.Sprintf("cpu_percentage=%g, memory_bytes=%d, disk_bytes=%d", m.GetCpuPercentage(), m.GetMemoryBytes(), m.GetDiskBytes())
+	fields := []Field{
+		{"application_id", m.GetApplicationId()},
+		{"instance_index", m.GetInstanceIndex()},
+		{"cpu_percentage", m.GetCpuPercentage()},
+		{"memory_bytes", m.GetMemoryBytes()},
+		{"disk_bytes", m.GetDiskBytes()},
+	}
+	if m.MemoryBytesQuota != nil {
+		fields = append(fields, Field{"memory_bytes_quota", m.GetMemoryBytesQuota()})
+	}
+	if m.DiskBytesQuota != nil {
+		fields = append(fields, Field{"disk_bytes_quota", m.GetDiskBytesQuota()})
+	}
 	return &Event{
-		Labels: r,
-		Msg:    msg,
+		Labels:    r,
+		Msg:       msg,
+		Fields:    fields,
+		Timestamp: fromUnixNano(e.GetTimestamp()),
 	}
 }
 
@@ -131,9 +199,18 @@ func newCounterEvent(e *events.Envelope) *Event {
 		"origin":     e.GetOrigin(),
 	}
 	msg := fmt.Sprintf("%s (delta=%d, total=%d)", m.GetName(), m.GetDelta(), m.GetTotal())
+	fields := []Field{
+		{"name", m.GetName()},
+		{"delta", m.GetDelta()},
+	}
+	if m.Total != nil {
+		fields = append(fields, Field{"total", m.GetTotal()})
+	}
 	return &Event{
-		Labels: r,
-		Msg:    msg,
+		Labels:    r,
+		Msg:       msg,
+		Fields:    fields,
+		Timestamp: fromUnixNano(e.GetTimestamp()),
 	}
 }
 
@@ -152,6 +229,12 @@ func newErrorEvent(e *events.Envelope) *Event {
 	return &Event{
 		Labels: r,
 		Msg:    msg,
+		Fields: []Field{
+			{"source", m.GetSource()},
+			{"code", m.GetCode()},
+			{"message", m.GetMessage()},
+		},
+		Timestamp: fromUnixNano(e.GetTimestamp()),
 	}
 }
 
@@ -160,35 +243,50 @@ func AnnotateWithAppData(appCache cache.Cache, e *Event) {
 	appGUID := fmt.Sprintf("%s", cfAppID)
 
 	if appGUID != "<nil>" && cfAppID != "" {
+		if appCache == nil {
+			return
+		}
 		appInfo, err := appCache.GetApp(appGUID)
 		if err != nil {
 			log.Errorf("Encountered an error while getting app info: %v", err)
 		}
+		Annotate(e, appInfo)
+	}
+}
 
-		cfAppName := appInfo.Name
-		cfSpaceID := appInfo.SpaceGuid
-		cfSpaceName := appInfo.SpaceName
-		cfOrgID := appInfo.OrgGuid
-		cfOrgName := appInfo.OrgName
+// Annotate adds the names and GUIDs of app, its space and its org to the
+// labels of e. A nil app adds nothing.
+func Annotate(e *Event, appInfo *cache.App) {
+	if appInfo == nil {
+		return
+	}
 
-		if cfAppName != "" {
-			e.Labels["cf_app_name"] = cfAppName
-		}
+	cfAppName := appInfo.Name
+	cfSpaceID := appInfo.SpaceGuid
+	cfSpaceName := appInfo.SpaceName
+	cfOrgID := appInfo.OrgGuid
+	cfOrgName := appInfo.OrgName
+	e.Annotated = true
+	e.Ignored = appInfo.IgnoredApp
+	e.AppLabels = appInfo.Labels
 
-		if cfSpaceID != "" {
-			e.Labels["cf_space_id"] = cfSpaceID
-		}
+	if cfAppName != "" {
+		e.Labels["cf_app_name"] = cfAppName
+	}
 
-		if cfSpaceName != "" {
-			e.Labels["cf_space_name"] = cfSpaceName
-		}
+	if cfSpaceID != "" {
+		e.Labels["cf_space_id"] = cfSpaceID
+	}
 
-		if cfOrgID != "" {
-			e.Labels["cf_org_id"] = cfOrgID
-		}
+	if cfSpaceName != "" {
+		e.Labels["cf_space_name"] = cfSpaceName
+	}
 
-		if cfOrgName != "" {
-			e.Labels["cf_org_name"] = cfOrgName
-		}
+	if cfOrgID != "" {
+		e.Labels["cf_org_id"] = cfOrgID
+	}
+
+	if cfOrgName != "" {
+		e.Labels["cf_org_name"] = cfOrgName
 	}
 }
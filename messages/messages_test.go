@@ -0,0 +1,75 @@
+package messages_test
+
+import (
+	"context"
+	"errors"
+
+	"github.com/bosh-loki/loki-firehose-nozzle/cache"
+	. "github.com/bosh-loki/loki-firehose-nozzle/messages"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// staticCache returns the same app for every GUID.
+type staticCache struct {
+	app cache.App
+}
+
+func (c *staticCache) Start(context.Context) error { return nil }
+func (c *staticCache) Stop() error                 { return nil }
+func (c *staticCache) Populated() bool             { return true }
+func (c *staticCache) GetAllApps() (map[string]*cache.App, error) {
+	return map[string]*cache.App{c.app.Guid: &c.app}, nil
+}
+func (c *staticCache) GetApp(string) (*cache.App, error) {
+	app := c.app
+	return &app, nil
+}
+func (c *staticCache) CachedApp(guid string) (*cache.App, bool) {
+	app, err := c.GetApp(guid)
+	return app, err == nil
+}
+
+// missingCache knows no app.
+type missingCache struct {
+	staticCache
+}
+
+func (c *missingCache) GetApp(string) (*cache.App, error) {
+	return nil, errors.New("app not found")
+}
+func (c *missingCache) CachedApp(string) (*cache.App, bool) {
+	return nil, false
+}
+
+var _ = Describe("AnnotateWithAppData", func() {
+	It("adds app, space and org labels", func() {
+		e := &Event{Labels: LabelSet{"cf_app_id": "app-guid"}}
+		AnnotateWithAppData(&staticCache{app: cache.App{
+			Guid: "app-guid", Name: "web", SpaceGuid: "space-guid", SpaceName: "dev", OrgGuid: "org-guid", OrgName: "acme",
+		}}, e)
+		Expect(e.Labels).To(Equal(LabelSet{
+			"cf_app_id":     "app-guid",
+			"cf_app_name":   "web",
+			"cf_space_id":   "space-guid",
+			"cf_space_name": "dev",
+			"cf_org_id":     "org-guid",
+			"cf_org_name":   "acme",
+		}))
+		Expect(e.Ignored).To(BeFalse())
+	})
+
+	It("marks events of opted-out apps as ignored", func() {
+		e := &Event{Labels: LabelSet{"cf_app_id": "app-guid"}}
+		AnnotateWithAppData(&staticCache{app: cache.App{Guid: "app-guid", IgnoredApp: true}}, e)
+		Expect(e.Ignored).To(BeTrue())
+	})
+
+	It("leaves events alone when the app is unknown", func() {
+		e := &Event{Labels: LabelSet{"cf_app_id": "app-guid"}}
+		Expect(func() { AnnotateWithAppData(&missingCache{}, e) }).ToNot(Panic())
+		Expect(e.Labels).To(Equal(LabelSet{"cf_app_id": "app-guid"}))
+
+		Expect(func() { AnnotateWithAppData(nil, e) }).ToNot(Panic())
+	})
+})
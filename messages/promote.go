@@ -0,0 +1,158 @@
+package messages
+
+import (
+	"sync"
+
+	"github.com/bosh-loki/loki-firehose-nozzle/metrics"
+)
+
+// DefaultMaxLabelValues is how many distinct values a promoted label may
+// take when PromoteConfig.MaxValues is not set.
+const DefaultMaxLabelValues = 100
+
+// AppLabelPrefix is prepended to the names of promoted app metadata labels.
+const AppLabelPrefix = "cf_app_label_"
+
+// PromoteConfig lists the envelope tags and app metadata labels that become
+// Loki labels.
+type PromoteConfig struct {
+	// Tags are envelope tag names. A tag never replaces a label the nozzle
+	// already sets.
+	Tags []string
+	// AppLabels are CF v3 metadata label keys, promoted as
+	// AppLabelPrefix followed by the sanitized key.
+	AppLabels []string
+	// MaxValues bounds the distinct values each promoted label may take.
+	// Values beyond the bound are not promoted and are counted as overflows.
+	MaxValues int
+}
+
+// Promoter copies allowlisted envelope tags and app metadata labels into
+// label sets. A nil *Promoter promotes nothing.
+type Promoter struct {
+	tags      map[string]string // tag name -> label name
+	appLabels map[string]string // metadata key -> label name
+	maxValues int
+
+	lock      sync.Mutex
+	values    map[string]map[string]struct{}
+	overflows map[string]int64
+}
+
+func NewPromoter(cfg PromoteConfig) *Promoter {
+	if len(cfg.Tags) == 0 && len(cfg.AppLabels) == 0 {
+		return nil
+	}
+	p := &Promoter{
+		tags:      map[string]string{},
+		appLabels: map[string]string{},
+		maxValues: cfg.MaxValues,
+		values:    map[string]map[string]struct{}{},
+		overflows: map[string]int64{},
+	}
+	if p.maxValues <= 0 {
+		p.maxValues = DefaultMaxLabelValues
+	}
+	for _, t := range cfg.Tags {
+		if name := SanitizeLabelName(t); name != "" {
+			p.tags[t] = name
+		}
+	}
+	for _, l := range cfg.AppLabels {
+		if l != "" {
+			p.appLabels[l] = AppLabelPrefix + SanitizeLabelName(l)
+		}
+	}
+	return p
+}
+
+// Promote adds the allowlisted entries of tags and appLabels to ls.
+func (p *Promoter) Promote(tags, appLabels map[string]string, ls LabelSet) {
+	if p == nil {
+		return
+	}
+	for tag, name := range p.tags {
+		if v, ok := tags[tag]; ok {
+			if _, taken := ls[name]; !taken {
+				p.set(ls, name, v)
+			}
+		}
+	}
+	for key, name := range p.appLabels {
+		if v, ok := appLabels[key]; ok {
+			p.set(ls, name, v)
+		}
+	}
+}
+
+// set adds name=value to ls unless name already took maxValues other values.
+func (p *Promoter) set(ls LabelSet, name, value string) {
+	if value == "" {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	seen := p.values[name]
+	if seen == nil {
+		seen = map[string]struct{}{}
+		p.values[name] = seen
+	}
+	if _, ok := seen[value]; !ok {
+		if len(seen) >= p.maxValues {
+			p.overflows[name]++
+			return
+		}
+		seen[value] = struct{}{}
+	}
+	ls[name] = value
+}
+
+// Overflows returns, per label name, how many values were not promoted
+// because the label reached its value limit.
+func (p *Promoter) Overflows() map[string]int64 {
+	if p == nil {
+		return nil
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	overflows := make(map[string]int64, len(p.overflows))
+	for k, v := range p.overflows {
+		overflows[k] = v
+	}
+	return overflows
+}
+
+// RegisterMetrics exposes the overflow counts on the default metrics
+// registry. It must be called at most once.
+func (p *Promoter) RegisterMetrics() {
+	metrics.MustRegister(metrics.NewCounterFunc(
+		"loki_nozzle_promoted_label_overflows_total",
+		"Values not promoted because the label reached its distinct value limit.",
+		"label",
+		func() map[string]float64 {
+			overflows := map[string]float64{}
+			for k, v := range p.Overflows() {
+				overflows[k] = float64(v)
+			}
+			return overflows
+		}))
+}
+
+// SanitizeLabelName maps s to a valid Loki label name by replacing every
+// character outside [a-zA-Z0-9_] with an underscore and prefixing names that
+// start with a digit with one.
+func SanitizeLabelName(s string) string {
+	if s == "" {
+		return ""
+	}
+	b := []byte(s)
+	for i, c := range b {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			b[i] = '_'
+		}
+	}
+	if b[0] >= '0' && b[0] <= '9' {
+		return "_" + string(b)
+	}
+	return string(b)
+}
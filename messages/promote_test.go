@@ -0,0 +1,57 @@
+package messages_test
+
+import (
+	. "github.com/bosh-loki/loki-firehose-nozzle/messages"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Promoter", func() {
+	It("promotes allowlisted tags and app labels only", func() {
+		p := NewPromoter(PromoteConfig{Tags: []string{"placement-tag"}, AppLabels: []string{"example.com/team"}})
+		ls := LabelSet{"job": "router"}
+		p.Promote(
+			map[string]string{"placement-tag": "isolated", "secret": "x"},
+			map[string]string{"example.com/team": "payments", "other": "y"},
+			ls)
+		Expect(ls).To(Equal(LabelSet{
+			"job":                           "router",
+			"placement_tag":                 "isolated",
+			"cf_app_label_example_com_team": "payments",
+		}))
+	})
+
+	It("never replaces labels set by the nozzle", func() {
+		p := NewPromoter(PromoteConfig{Tags: []string{"job"}})
+		ls := LabelSet{"job": "router"}
+		p.Promote(map[string]string{"job": "spoofed"}, nil, ls)
+		Expect(ls["job"]).To(Equal("router"))
+	})
+
+	It("stops promoting new values once a label reaches its limit", func() {
+		p := NewPromoter(PromoteConfig{Tags: []string{"request"}, MaxValues: 2})
+		values := []string{}
+		for _, v := range []string{"a", "b", "c", "a"} {
+			ls := LabelSet{}
+			p.Promote(map[string]string{"request": v}, nil, ls)
+			values = append(values, ls["request"])
+		}
+		Expect(values).To(Equal([]string{"a", "b", "", "a"}))
+		Expect(p.Overflows()).To(Equal(map[string]int64{"request": 1}))
+	})
+
+	It("is a no-op when nothing is allowlisted", func() {
+		p := NewPromoter(PromoteConfig{})
+		ls := LabelSet{}
+		p.Promote(map[string]string{"a": "b"}, nil, ls)
+		Expect(ls).To(BeEmpty())
+		Expect(p.Overflows()).To(BeEmpty())
+	})
+
+	It("sanitizes label names", func() {
+		Expect(SanitizeLabelName("cf_app")).To(Equal("cf_app"))
+		Expect(SanitizeLabelName("example.com/team")).To(Equal("example_com_team"))
+		Expect(SanitizeLabelName("1st")).To(Equal("_1st"))
+		Expect(SanitizeLabelName("")).To(Equal(""))
+	})
+})
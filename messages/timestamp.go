@@ -0,0 +1,64 @@
+package messages
+
+import (
+	"fmt"
+	"time"
+)
+
+// Timestamp policies.
+const (
+	// TimestampSource stamps entries with the time carried by the envelope.
+	TimestampSource = "source"
+	// TimestampReceive stamps entries with the time the nozzle received them.
+	TimestampReceive = "receive"
+	// TimestampClamp uses the envelope time, clamped to MaxDrift around the
+	// receive time.
+	TimestampClamp = "clamp"
+)
+
+// TimestampPolicy decides which time a Loki entry is stamped with.
+type TimestampPolicy struct {
+	Mode     string
+	MaxDrift time.Duration
+}
+
+// NewTimestampPolicy validates mode and returns a TimestampPolicy.
+func NewTimestampPolicy(mode string, maxDrift time.Duration) (TimestampPolicy, error) {
+	switch mode {
+	case "":
+		mode = TimestampSource
+	case TimestampSource, TimestampReceive:
+	case TimestampClamp:
+		if maxDrift <= 0 {
+			return TimestampPolicy{}, fmt.Errorf("timestamp policy %q requires a positive max drift", mode)
+		}
+	default:
+		return TimestampPolicy{}, fmt.Errorf("unknown timestamp policy %q", mode)
+	}
+	return TimestampPolicy{Mode: mode, MaxDrift: maxDrift}, nil
+}
+
+// Resolve returns the timestamp for an entry whose envelope carried source
+// and which was received at received. A zero source always resolves to
+// received.
+func (p TimestampPolicy) Resolve(source, received time.Time) time.Time {
+	if source.IsZero() || p.Mode == TimestampReceive {
+		return received
+	}
+	if p.Mode == TimestampClamp {
+		if min := received.Add(-p.MaxDrift); source.Before(min) {
+			return min
+		}
+		if max := received.Add(p.MaxDrift); source.After(max) {
+			return max
+		}
+	}
+	return source
+}
+
+func fromUnixNano(ns int64) time.Time {
+	if ns <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
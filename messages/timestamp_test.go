@@ -0,0 +1,90 @@
+package messages_test
+
+import (
+	"time"
+
+	. "github.com/bosh-loki/loki-firehose-nozzle/messages"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Timestamps", func() {
+	received := time.Unix(1500000000, 0)
+
+	Describe("GetMessage", func() {
+		It("uses the log message timestamp over the envelope timestamp", func() {
+			e := &events.Envelope{
+				EventType: events.Envelope_LogMessage.Enum(),
+				Timestamp: proto.Int64(1000),
+				LogMessage: &events.LogMessage{
+					Message:     []byte("hello"),
+					MessageType: events.LogMessage_OUT.Enum(),
+					Timestamp:   proto.Int64(2000),
+				},
+			}
+			Expect(GetMessage(e, nil).Timestamp).To(Equal(time.Unix(0, 2000)))
+		})
+
+		It("uses the http start time for HttpStartStop", func() {
+			e := &events.Envelope{
+				EventType: events.Envelope_HttpStartStop.Enum(),
+				Timestamp: proto.Int64(1000),
+				HttpStartStop: &events.HttpStartStop{
+					StartTimestamp: proto.Int64(3000),
+					StopTimestamp:  proto.Int64(4000),
+				},
+			}
+			Expect(GetMessage(e, nil).Timestamp).To(Equal(time.Unix(0, 3000)))
+		})
+
+		It("falls back to the envelope timestamp", func() {
+			e := &events.Envelope{
+				EventType:   events.Envelope_ValueMetric.Enum(),
+				Timestamp:   proto.Int64(1000),
+				ValueMetric: &events.ValueMetric{Name: proto.String("cpu")},
+			}
+			Expect(GetMessage(e, nil).Timestamp).To(Equal(time.Unix(0, 1000)))
+		})
+	})
+
+	Describe("TimestampPolicy", func() {
+		It("rejects unknown modes", func() {
+			_, err := NewTimestampPolicy("wallclock", 0)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("requires a drift for clamping", func() {
+			_, err := NewTimestampPolicy(TimestampClamp, 0)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("defaults to the source time", func() {
+			p, err := NewTimestampPolicy("", 0)
+			Expect(err).ToNot(HaveOccurred())
+			source := received.Add(-time.Hour)
+			Expect(p.Resolve(source, received)).To(Equal(source))
+		})
+
+		It("uses the receive time when asked to", func() {
+			p, err := NewTimestampPolicy(TimestampReceive, 0)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(p.Resolve(received.Add(-time.Hour), received)).To(Equal(received))
+		})
+
+		It("uses the receive time when the source time is missing", func() {
+			p, err := NewTimestampPolicy(TimestampSource, 0)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(p.Resolve(time.Time{}, received)).To(Equal(received))
+		})
+
+		It("clamps to the max drift", func() {
+			p, err := NewTimestampPolicy(TimestampClamp, time.Minute)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(p.Resolve(received.Add(-time.Hour), received)).To(Equal(received.Add(-time.Minute)))
+			Expect(p.Resolve(received.Add(time.Hour), received)).To(Equal(received.Add(time.Minute)))
+			Expect(p.Resolve(received.Add(time.Second), received)).To(Equal(received.Add(time.Second)))
+		})
+	})
+})
@@ -0,0 +1,371 @@
+// Package metrics implements the counters, histograms and gauges the nozzle
+// reports about itself, exposed in the Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Collector is a metric family that can be exposed by a Registry.
+type Collector interface {
+	Name() string
+	write(w *bufio.Writer)
+}
+
+// Registry holds the collectors served on /metrics.
+type Registry struct {
+	lock       sync.Mutex
+	collectors map[string]Collector
+}
+
+// DefaultRegistry is the registry the package-level helpers use.
+var DefaultRegistry = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{collectors: map[string]Collector{}}
+}
+
+// Register adds collectors to the registry. Registering two collectors
+// with the same name is an error.
+func (r *Registry) Register(cs ...Collector) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, c := range cs {
+		if _, ok := r.collectors[c.Name()]; ok {
+			return fmt.Errorf("metric %q is already registered", c.Name())
+		}
+		r.collectors[c.Name()] = c
+	}
+	return nil
+}
+
+// MustRegister is like Register but panics on error.
+func (r *Registry) MustRegister(cs ...Collector) {
+	if err := r.Register(cs...); err != nil {
+		panic(err)
+	}
+}
+
+// ServeHTTP writes every registered metric, sorted by name.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.lock.Lock()
+	names := make([]string, 0, len(r.collectors))
+	for name := range r.collectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	cs := make([]Collector, 0, len(names))
+	for _, name := range names {
+		cs = append(cs, r.collectors[name])
+	}
+	r.lock.Unlock()
+
+	w.Header().Set("Content-Type", contentType)
+	bw := bufio.NewWriter(w)
+	for _, c := range cs {
+		c.write(bw)
+	}
+	bw.Flush()
+}
+
+// MustRegister adds collectors to the DefaultRegistry.
+func MustRegister(cs ...Collector) {
+	DefaultRegistry.MustRegister(cs...)
+}
+
+// Handler serves the DefaultRegistry.
+func Handler() http.Handler {
+	return DefaultRegistry
+}
+
+// desc is the name, help and label names shared by a metric family.
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) Name() string {
+	return d.name
+}
+
+func (d *desc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, escapeHelp(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.typ)
+}
+
+// series holds the children of a vector keyed by their label values.
+type series struct {
+	lock     sync.Mutex
+	children map[string]interface{}
+	values   map[string][]string
+}
+
+func (s *series) get(d *desc, values []string, create func() interface{}) interface{} {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metric %q has %d labels, got %d values", d.name, len(d.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.children == nil {
+		s.children = map[string]interface{}{}
+		s.values = map[string][]string{}
+	}
+	child, ok := s.children[key]
+	if !ok {
+		child = create()
+		s.children[key] = child
+		s.values[key] = append([]string(nil), values...)
+	}
+	return child
+}
+
+// each calls f for every child in label value order.
+func (s *series) each(f func(values []string, child interface{})) {
+	s.lock.Lock()
+	keys := make([]string, 0, len(s.children))
+	for k := range s.children {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	children := make([]interface{}, len(keys))
+	values := make([][]string, len(keys))
+	for i, k := range keys {
+		children[i] = s.children[k]
+		values[i] = s.values[k]
+	}
+	s.lock.Unlock()
+
+	for i := range keys {
+		f(values[i], children[i])
+	}
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	lock  sync.Mutex
+	value float64
+}
+
+// Inc adds one to the counter.
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add adds v, which must not be negative, to the counter.
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		panic("counter cannot decrease")
+	}
+	c.lock.Lock()
+	c.value += v
+	c.lock.Unlock()
+}
+
+// Value returns the current count.
+func (c *Counter) Value() float64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.value
+}
+
+// CounterVec is a family of counters partitioned by label values.
+type CounterVec struct {
+	desc
+	series
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{desc: desc{name: name, help: help, typ: "counter", labels: labels}}
+}
+
+// WithLabelValues returns the counter for the given label values, creating
+// it if needed.
+func (v *CounterVec) WithLabelValues(values ...string) *Counter {
+	return v.get(&v.desc, values, func() interface{} { return &Counter{} }).(*Counter)
+}
+
+func (v *CounterVec) write(w *bufio.Writer) {
+	v.writeHeader(w)
+	v.each(func(values []string, child interface{}) {
+		writeSample(w, v.name, v.labels, values, "", "", child.(*Counter).Value())
+	})
+}
+
+// NewCounter returns a counter family without labels and its only counter.
+func NewCounter(name, help string) (*CounterVec, *Counter) {
+	v := NewCounterVec(name, help)
+	return v, v.WithLabelValues()
+}
+
+// DefBuckets suit latencies measured in seconds.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Histogram counts observations in cumulative buckets.
+type Histogram struct {
+	lock    sync.Mutex
+	bounds  []float64
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+// Observe records v.
+func (h *Histogram) Observe(v float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for i, b := range h.bounds {
+		if v <= b {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// HistogramVec is a family of histograms partitioned by label values.
+type HistogramVec struct {
+	desc
+	series
+	buckets []float64
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+	return &HistogramVec{
+		desc:    desc{name: name, help: help, typ: "histogram", labels: labels},
+		buckets: b,
+	}
+}
+
+// WithLabelValues returns the histogram for the given label values,
+// creating it if needed.
+func (v *HistogramVec) WithLabelValues(values ...string) *Histogram {
+	return v.get(&v.desc, values, func() interface{} {
+		return &Histogram{bounds: v.buckets, buckets: make([]uint64, len(v.buckets))}
+	}).(*Histogram)
+}
+
+func (v *HistogramVec) write(w *bufio.Writer) {
+	v.writeHeader(w)
+	v.each(func(values []string, child interface{}) {
+		h := child.(*Histogram)
+		h.lock.Lock()
+		buckets := append([]uint64(nil), h.buckets...)
+		count, sum := h.count, h.sum
+		h.lock.Unlock()
+
+		for i, b := range v.buckets {
+			writeSample(w, v.name+"_bucket", v.labels, values, "le", formatFloat(b), float64(buckets[i]))
+		}
+		writeSample(w, v.name+"_bucket", v.labels, values, "le", "+Inf", float64(count))
+		writeSample(w, v.name+"_sum", v.labels, values, "", "", sum)
+		writeSample(w, v.name+"_count", v.labels, values, "", "", float64(count))
+	})
+}
+
+// NewHistogram returns a histogram family without labels and its only
+// histogram.
+func NewHistogram(name, help string, buckets []float64) (*HistogramVec, *Histogram) {
+	v := NewHistogramVec(name, help, buckets)
+	return v, v.WithLabelValues()
+}
+
+// GaugeFunc reports the value of a function at scrape time.
+type GaugeFunc struct {
+	desc
+	f func() float64
+}
+
+func NewGaugeFunc(name, help string, f func() float64) *GaugeFunc {
+	return &GaugeFunc{desc: desc{name: name, help: help, typ: "gauge"}, f: f}
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	g.writeHeader(w)
+	writeSample(w, g.name, nil, nil, "", "", g.f())
+}
+
+// CounterFunc reports counts kept elsewhere, partitioned by a single label,
+// at scrape time.
+type CounterFunc struct {
+	desc
+	f func() map[string]float64
+}
+
+func NewCounterFunc(name, help, label string, f func() map[string]float64) *CounterFunc {
+	return &CounterFunc{desc: desc{name: name, help: help, typ: "counter", labels: []string{label}}, f: f}
+}
+
+func (c *CounterFunc) write(w *bufio.Writer) {
+	c.writeHeader(w)
+	values := c.f()
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		writeSample(w, c.name, c.labels, []string{k}, "", "", values[k])
+	}
+}
+
+func writeSample(w *bufio.Writer, name string, labels, values []string, extraLabel, extraValue string, v float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || extraLabel != "" {
+		w.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", l, escapeLabelValue(values[i]))
+		}
+		if extraLabel != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", extraLabel, escapeLabelValue(extraValue))
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return labelValueEscaper.Replace(s)
+}
@@ -0,0 +1,88 @@
+package metrics_test
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+
+	. "github.com/bosh-loki/loki-firehose-nozzle/metrics"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Registry", func() {
+	var registry *Registry
+
+	BeforeEach(func() {
+		registry = NewRegistry()
+	})
+
+	scrape := func() string {
+		rec := httptest.NewRecorder()
+		registry.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		Expect(rec.Header().Get("Content-Type")).To(HavePrefix("text/plain; version=0.0.4"))
+		body, err := ioutil.ReadAll(rec.Body)
+		Expect(err).ToNot(HaveOccurred())
+		return string(body)
+	}
+
+	It("exposes counters by label values", func() {
+		envelopes := NewCounterVec("envelopes_total", "Envelopes received.", "event_type")
+		registry.MustRegister(envelopes)
+		envelopes.WithLabelValues("LogMessage").Add(2)
+		envelopes.WithLabelValues("ContainerMetric").Inc()
+
+		Expect(scrape()).To(Equal(`# HELP envelopes_total Envelopes received.
+# TYPE envelopes_total counter
+envelopes_total{event_type="ContainerMetric"} 1
+envelopes_total{event_type="LogMessage"} 2
+`))
+	})
+
+	It("exposes histograms with cumulative buckets", func() {
+		vec, latency := NewHistogram("latency_seconds", "Latency.", []float64{1, 0.1})
+		registry.MustRegister(vec)
+		latency.Observe(0.05)
+		latency.Observe(0.5)
+		latency.Observe(3)
+
+		Expect(scrape()).To(Equal(`# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 3.55
+latency_seconds_count 3
+`))
+	})
+
+	It("reads gauges and external counters at scrape time", func() {
+		length := 0.0
+		registry.MustRegister(
+			NewGaugeFunc("queue_length", "Queued entries.", func() float64 { return length }),
+			NewCounterFunc("dropped_total", "Dropped entries.", "reason", func() map[string]float64 {
+				return map[string]float64{"queue_full": 3}
+			}),
+		)
+		length = 7
+
+		out := scrape()
+		Expect(out).To(ContainSubstring("queue_length 7\n"))
+		Expect(out).To(ContainSubstring(`dropped_total{reason="queue_full"} 3`))
+		Expect(out).To(MatchRegexp(`(?s)dropped_total.*queue_length`), "sorted by name")
+	})
+
+	It("escapes label values and help text", func() {
+		vec := NewCounterVec("lines_total", "Lines\nwith \\ escapes.", "line")
+		registry.MustRegister(vec)
+		vec.WithLabelValues("say \"hi\"\n").Inc()
+
+		out := scrape()
+		Expect(out).To(ContainSubstring(`# HELP lines_total Lines\nwith \\ escapes.`))
+		Expect(out).To(ContainSubstring(`lines_total{line="say \"hi\"\n"} 1`))
+	})
+
+	It("refuses duplicate names", func() {
+		registry.MustRegister(NewCounterVec("dup_total", "First."))
+		Expect(registry.Register(NewCounterVec("dup_total", "Second."))).ToNot(Succeed())
+	})
+})
@@ -0,0 +1,214 @@
+// Package multiline stitches log lines that belong together, such as the
+// lines of a stack trace, into a single Loki entry.
+package multiline
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bosh-loki/loki-firehose-nozzle/messages"
+	"github.com/bosh-loki/loki-firehose-nozzle/metrics"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// Defaults for unset Config fields.
+const (
+	DefaultFlushTimeout = time.Second
+	DefaultMaxLines     = 500
+)
+
+// Reasons an entry is flushed.
+const (
+	flushNext     = "next_entry"
+	flushTimeout  = "timeout"
+	flushMaxLines = "max_lines"
+	flushStop     = "stop"
+)
+
+var flushes = metrics.NewCounterVec(
+	"loki_nozzle_multiline_flushes_total",
+	"Stitched entries flushed, by reason: next_entry, timeout, max_lines or stop.",
+	"reason")
+
+func init() {
+	metrics.MustRegister(flushes)
+}
+
+// Config decides which log lines continue the entry before them. A line is
+// a continuation when it matches Continuation, or when Start is set and it
+// does not match Start. At least one of them must be set.
+type Config struct {
+	Start        string
+	Continuation string
+	// FlushTimeout is how long an entry waits for more lines; defaults to
+	// DefaultFlushTimeout.
+	FlushTimeout time.Duration
+	// MaxLines caps the lines of an entry; defaults to DefaultMaxLines.
+	MaxLines int
+}
+
+// Stitcher joins the continuation lines of log messages sharing an app,
+// source instance and message type. Other events pass through untouched.
+type Stitcher struct {
+	start        *regexp.Regexp
+	continuation *regexp.Regexp
+	flushTimeout time.Duration
+	maxLines     int
+
+	emit func(*messages.Event)
+
+	lock    sync.Mutex
+	pending map[string]*entry
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+// entry is a stitched log message waiting for more lines.
+type entry struct {
+	event *messages.Event
+	lines []string
+	last  time.Time
+}
+
+// New compiles cfg. It returns nil when neither regex is set.
+func New(cfg Config) (*Stitcher, error) {
+	if cfg.Start == "" && cfg.Continuation == "" {
+		return nil, nil
+	}
+	s := &Stitcher{
+		flushTimeout: cfg.FlushTimeout,
+		maxLines:     cfg.MaxLines,
+		pending:      map[string]*entry{},
+	}
+	var err error
+	if cfg.Start != "" {
+		if s.start, err = regexp.Compile(cfg.Start); err != nil {
+			return nil, fmt.Errorf("multiline start: %s", err)
+		}
+	}
+	if cfg.Continuation != "" {
+		if s.continuation, err = regexp.Compile(cfg.Continuation); err != nil {
+			return nil, fmt.Errorf("multiline continuation: %s", err)
+		}
+	}
+	if s.flushTimeout < 0 || s.maxLines < 0 {
+		return nil, errors.New("multiline flush timeout and max lines must not be negative")
+	}
+	if s.flushTimeout == 0 {
+		s.flushTimeout = DefaultFlushTimeout
+	}
+	if s.maxLines == 0 {
+		s.maxLines = DefaultMaxLines
+	}
+	return s, nil
+}
+
+// Start passes every finished entry to emit, which may be called from
+// another goroutine, and starts flushing entries that timed out.
+func (s *Stitcher) Start(emit func(*messages.Event)) {
+	s.emit = emit
+	s.quit = make(chan struct{})
+	s.done = make(chan struct{})
+	go s.run()
+}
+
+// Stop flushes every pending entry.
+func (s *Stitcher) Stop() {
+	close(s.quit)
+	<-s.done
+	s.flush(func(*entry) bool { return true }, flushStop)
+}
+
+func (s *Stitcher) run() {
+	defer close(s.done)
+	tick := s.flushTimeout / 4
+	if tick < 10*time.Millisecond {
+		tick = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.flush(func(p *entry) bool { return now.Sub(p.last) >= s.flushTimeout }, flushTimeout)
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// Add stitches event into the pending entry of its stream, emitting the
+// entries it completes.
+func (s *Stitcher) Add(event *messages.Event) {
+	if event.Labels["event_type"] != events.Envelope_LogMessage.String() {
+		s.emit(event)
+		return
+	}
+	key := strings.Join([]string{
+		event.Labels["cf_app_id"],
+		event.Labels["source_instance"],
+		event.Labels["message_type"],
+	}, "\xff")
+	now := time.Now()
+
+	var done []*messages.Event
+	var reason string
+	s.lock.Lock()
+	p, ok := s.pending[key]
+	switch {
+	case ok && s.continues(event.Msg) && len(p.lines) < s.maxLines:
+		p.lines = append(p.lines, event.Msg)
+		p.last = now
+	case ok:
+		reason = flushNext
+		if len(p.lines) >= s.maxLines && s.continues(event.Msg) {
+			reason = flushMaxLines
+		}
+		done = append(done, p.finish())
+		fallthrough
+	default:
+		s.pending[key] = &entry{event: event, lines: []string{event.Msg}, last: now}
+	}
+	s.lock.Unlock()
+
+	for _, e := range done {
+		flushes.WithLabelValues(reason).Inc()
+		s.emit(e)
+	}
+}
+
+func (s *Stitcher) continues(line string) bool {
+	if s.continuation != nil && s.continuation.MatchString(line) {
+		return true
+	}
+	return s.start != nil && !s.start.MatchString(line)
+}
+
+// flush emits and forgets the pending entries selected by due.
+func (s *Stitcher) flush(due func(*entry) bool, reason string) {
+	var done []*messages.Event
+	s.lock.Lock()
+	for key, p := range s.pending {
+		if due(p) {
+			done = append(done, p.finish())
+			delete(s.pending, key)
+		}
+	}
+	s.lock.Unlock()
+
+	for _, e := range done {
+		flushes.WithLabelValues(reason).Inc()
+		s.emit(e)
+	}
+}
+
+// finish returns the first event of p carrying every stitched line.
+func (p *entry) finish() *messages.Event {
+	p.event.Msg = strings.Join(p.lines, "\n")
+	return p.event
+}
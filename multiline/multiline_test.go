@@ -0,0 +1,121 @@
+package multiline_test
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bosh-loki/loki-firehose-nozzle/messages"
+	. "github.com/bosh-loki/loki-firehose-nozzle/multiline"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// collector records emitted lines.
+type collector struct {
+	lock  sync.Mutex
+	lines []string
+}
+
+func (c *collector) emit(e *messages.Event) {
+	c.lock.Lock()
+	c.lines = append(c.lines, e.Msg)
+	c.lock.Unlock()
+}
+
+func (c *collector) Lines() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]string(nil), c.lines...)
+}
+
+func logLine(instance, msg string) *messages.Event {
+	return &messages.Event{
+		Labels: messages.LabelSet{
+			"event_type":      "LogMessage",
+			"cf_app_id":       "app-guid",
+			"source_instance": instance,
+			"message_type":    "ERR",
+		},
+		Msg: msg,
+	}
+}
+
+var _ = Describe("Stitcher", func() {
+	var (
+		out      *collector
+		stitcher *Stitcher
+	)
+
+	start := func(cfg Config) {
+		var err error
+		stitcher, err = New(cfg)
+		Expect(err).ToNot(HaveOccurred())
+		out = &collector{}
+		stitcher.Start(out.emit)
+	}
+
+	It("joins lines that do not match the start pattern", func() {
+		start(Config{Start: `^\S`, FlushTimeout: time.Hour})
+		stitcher.Add(logLine("0", "Exception in thread main"))
+		stitcher.Add(logLine("0", "\tat Foo.bar(Foo.java:1)"))
+		stitcher.Add(logLine("0", "\tat Foo.main(Foo.java:9)"))
+		stitcher.Add(logLine("0", "next entry"))
+		Expect(out.Lines()).To(Equal([]string{"Exception in thread main\n\tat Foo.bar(Foo.java:1)\n\tat Foo.main(Foo.java:9)"}))
+
+		stitcher.Stop()
+		Expect(out.Lines()).To(HaveLen(2))
+		Expect(out.Lines()[1]).To(Equal("next entry"))
+	})
+
+	It("joins lines matching the continuation pattern", func() {
+		start(Config{Continuation: `^(\s|Caused by:)`, FlushTimeout: time.Hour})
+		stitcher.Add(logLine("0", "Traceback:"))
+		stitcher.Add(logLine("0", "  File x.py"))
+		stitcher.Add(logLine("0", "Caused by: boom"))
+		stitcher.Add(logLine("0", "done"))
+		stitcher.Stop()
+		Expect(out.Lines()).To(Equal([]string{"Traceback:\n  File x.py\nCaused by: boom", "done"}))
+	})
+
+	It("keeps instances apart", func() {
+		start(Config{Start: `^\S`, FlushTimeout: time.Hour})
+		stitcher.Add(logLine("0", "error on 0"))
+		stitcher.Add(logLine("1", "error on 1"))
+		stitcher.Add(logLine("0", " trace 0"))
+		stitcher.Add(logLine("1", " trace 1"))
+		stitcher.Stop()
+		Expect(out.Lines()).To(ConsistOf("error on 0\n trace 0", "error on 1\n trace 1"))
+	})
+
+	It("flushes after the timeout", func() {
+		start(Config{Start: `^\S`, FlushTimeout: 20 * time.Millisecond})
+		defer stitcher.Stop()
+		stitcher.Add(logLine("0", "error"))
+		stitcher.Add(logLine("0", " trace"))
+		Eventually(out.Lines).Should(Equal([]string{"error\n trace"}))
+	})
+
+	It("caps the lines of an entry", func() {
+		start(Config{Start: `^\S`, FlushTimeout: time.Hour, MaxLines: 2})
+		stitcher.Add(logLine("0", "error"))
+		stitcher.Add(logLine("0", " one"))
+		stitcher.Add(logLine("0", " two"))
+		stitcher.Stop()
+		Expect(out.Lines()).To(Equal([]string{"error\n one", " two"}))
+	})
+
+	It("passes other events through", func() {
+		start(Config{Start: `^\S`, FlushTimeout: time.Hour})
+		defer stitcher.Stop()
+		stitcher.Add(&messages.Event{Labels: messages.LabelSet{"event_type": "ValueMetric"}, Msg: " metric"})
+		Expect(out.Lines()).To(Equal([]string{" metric"}))
+	})
+
+	It("is disabled without patterns and rejects bad ones", func() {
+		s, err := New(Config{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(s).To(BeNil())
+		_, err = New(Config{Start: "("})
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,200 @@
+// Package relabel implements Prometheus-style relabel_configs for the label
+// sets of Loki streams.
+package relabel
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/bosh-loki/loki-firehose-nozzle/messages"
+)
+
+// Relabel actions.
+const (
+	// Replace sets TargetLabel to Replacement, expanded with the capture
+	// groups of Regex matched against the joined SourceLabels.
+	Replace = "replace"
+	// Keep drops entries whose joined SourceLabels do not match Regex.
+	Keep = "keep"
+	// Drop drops entries whose joined SourceLabels match Regex.
+	Drop = "drop"
+	// HashMod sets TargetLabel to the hash of the joined SourceLabels
+	// modulo Modulus.
+	HashMod = "hashmod"
+	// LabelMap copies every label whose name matches Regex to the name
+	// given by Replacement.
+	LabelMap = "labelmap"
+	// LabelDrop removes every label whose name matches Regex.
+	LabelDrop = "labeldrop"
+	// LabelKeep removes every label whose name does not match Regex.
+	LabelKeep = "labelkeep"
+)
+
+// Config is a single relabeling step. Empty fields take the same defaults
+// as in Prometheus.
+type Config struct {
+	SourceLabels []string `toml:"source_labels"`
+	// Separator joins the source label values; defaults to ";".
+	Separator string `toml:"separator"`
+	// Regex is anchored at both ends; defaults to "(.*)".
+	Regex       *string `toml:"regex"`
+	Modulus     uint64  `toml:"modulus"`
+	TargetLabel string  `toml:"target_label"`
+	// Replacement defaults to "$1".
+	Replacement *string `toml:"replacement"`
+	// Action defaults to Replace.
+	Action string `toml:"action"`
+}
+
+// rule is a Config with its defaults applied and its regex compiled.
+type rule struct {
+	sourceLabels []string
+	separator    string
+	regex        *regexp.Regexp
+	modulus      uint64
+	targetLabel  string
+	replacement  string
+	action       string
+}
+
+// Rules is a compiled list of relabeling steps, applied in order.
+type Rules []rule
+
+// Compile validates cfgs and compiles their regexes.
+func Compile(cfgs []Config) (Rules, error) {
+	rules := make(Rules, 0, len(cfgs))
+	for i, cfg := range cfgs {
+		r, err := compile(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("relabel config %d: %s", i, err)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func compile(cfg Config) (rule, error) {
+	r := rule{
+		sourceLabels: cfg.SourceLabels,
+		separator:    ";",
+		modulus:      cfg.Modulus,
+		targetLabel:  cfg.TargetLabel,
+		replacement:  "$1",
+		action:       strings.ToLower(cfg.Action),
+	}
+	if cfg.Separator != "" {
+		r.separator = cfg.Separator
+	}
+	if cfg.Replacement != nil {
+		r.replacement = *cfg.Replacement
+	}
+	if r.action == "" {
+		r.action = Replace
+	}
+	regex := "(.*)"
+	if cfg.Regex != nil {
+		regex = *cfg.Regex
+	}
+	var err error
+	if r.regex, err = regexp.Compile("^(?:" + regex + ")$"); err != nil {
+		return rule{}, fmt.Errorf("invalid regex %q: %s", regex, err)
+	}
+
+	switch r.action {
+	case Replace:
+		if r.targetLabel == "" {
+			return rule{}, fmt.Errorf("%s requires a target_label", r.action)
+		}
+	case HashMod:
+		if r.targetLabel == "" || r.modulus == 0 {
+			return rule{}, fmt.Errorf("%s requires a target_label and a non-zero modulus", r.action)
+		}
+	case Keep, Drop:
+		if len(r.sourceLabels) == 0 {
+			return rule{}, fmt.Errorf("%s requires source_labels", r.action)
+		}
+	case LabelMap, LabelDrop, LabelKeep:
+	default:
+		return rule{}, fmt.Errorf("unknown action %q", cfg.Action)
+	}
+	return r, nil
+}
+
+// Process applies the rules to ls. It returns nil if a rule drops the
+// entry. ls itself is never modified.
+func (rs Rules) Process(ls messages.LabelSet) messages.LabelSet {
+	if len(rs) == 0 {
+		return ls
+	}
+	out := make(messages.LabelSet, len(ls))
+	for k, v := range ls {
+		out[k] = v
+	}
+	for _, r := range rs {
+		if !r.apply(out) {
+			return nil
+		}
+	}
+	return out
+}
+
+// apply runs a single rule on ls in place and reports whether the entry is
+// kept.
+func (r rule) apply(ls messages.LabelSet) bool {
+	values := make([]string, 0, len(r.sourceLabels))
+	for _, name := range r.sourceLabels {
+		values = append(values, ls[name])
+	}
+	val := strings.Join(values, r.separator)
+
+	switch r.action {
+	case Keep:
+		return r.regex.MatchString(val)
+	case Drop:
+		return !r.regex.MatchString(val)
+	case Replace:
+		indexes := r.regex.FindStringSubmatchIndex(val)
+		if indexes == nil {
+			break
+		}
+		target := string(r.regex.ExpandString(nil, r.targetLabel, val, indexes))
+		res := string(r.regex.ExpandString(nil, r.replacement, val, indexes))
+		if target == "" {
+			break
+		}
+		if res == "" {
+			delete(ls, target)
+		} else {
+			ls[target] = res
+		}
+	case HashMod:
+		sum := md5.Sum([]byte(val))
+		ls[r.targetLabel] = fmt.Sprintf("%d", binary.BigEndian.Uint64(sum[8:])%r.modulus)
+	case LabelMap:
+		mapped := messages.LabelSet{}
+		for name, v := range ls {
+			if r.regex.MatchString(name) {
+				mapped[r.regex.ReplaceAllString(name, r.replacement)] = v
+			}
+		}
+		for name, v := range mapped {
+			ls[name] = v
+		}
+	case LabelDrop:
+		for name := range ls {
+			if r.regex.MatchString(name) {
+				delete(ls, name)
+			}
+		}
+	case LabelKeep:
+		for name := range ls {
+			if !r.regex.MatchString(name) {
+				delete(ls, name)
+			}
+		}
+	}
+	return true
+}
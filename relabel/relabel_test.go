@@ -0,0 +1,102 @@
+package relabel_test
+
+import (
+	"github.com/bosh-loki/loki-firehose-nozzle/messages"
+	. "github.com/bosh-loki/loki-firehose-nozzle/relabel"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func str(s string) *string {
+	return &s
+}
+
+var _ = Describe("Relabeling", func() {
+	var labels messages.LabelSet
+
+	BeforeEach(func() {
+		labels = messages.LabelSet{
+			"cf_app_name":     "billing-api",
+			"cf_space_name":   "prod",
+			"cf_org_name":     "payments",
+			"source_instance": "3",
+			"event_type":      "LogMessage",
+		}
+	})
+
+	process := func(cfgs ...Config) messages.LabelSet {
+		rules, err := Compile(cfgs)
+		Expect(err).ToNot(HaveOccurred())
+		return rules.Process(labels)
+	}
+
+	It("returns the labels unchanged without rules", func() {
+		Expect(process()).To(Equal(labels))
+	})
+
+	It("renames a label with replace and labeldrop", func() {
+		out := process(
+			Config{SourceLabels: []string{"cf_app_name"}, TargetLabel: "app"},
+			Config{Action: LabelDrop, Regex: str("cf_app_name|source_instance")},
+		)
+		Expect(out).To(HaveKeyWithValue("app", "billing-api"))
+		Expect(out).ToNot(HaveKey("cf_app_name"))
+		Expect(out).ToNot(HaveKey("source_instance"))
+		Expect(labels).To(HaveKey("cf_app_name"), "input is not modified")
+	})
+
+	It("expands capture groups", func() {
+		out := process(Config{
+			SourceLabels: []string{"cf_org_name", "cf_space_name"},
+			Separator:    "/",
+			Regex:        str("(.+)/(.+)"),
+			TargetLabel:  "tenant",
+			Replacement:  str("${1}-${2}"),
+		})
+		Expect(out).To(HaveKeyWithValue("tenant", "payments-prod"))
+	})
+
+	It("removes the target label when the replacement is empty", func() {
+		out := process(Config{SourceLabels: []string{"cf_space_name"}, Regex: str("prod"), TargetLabel: "cf_space_name", Replacement: str("")})
+		Expect(out).ToNot(HaveKey("cf_space_name"))
+	})
+
+	It("leaves the target alone when the regex does not match", func() {
+		out := process(Config{SourceLabels: []string{"cf_space_name"}, Regex: str("dev"), TargetLabel: "env", Replacement: str("development")})
+		Expect(out).ToNot(HaveKey("env"))
+	})
+
+	It("keeps and drops entries", func() {
+		Expect(process(Config{Action: Keep, SourceLabels: []string{"cf_org_name"}, Regex: str("pay.*")})).ToNot(BeNil())
+		Expect(process(Config{Action: Keep, SourceLabels: []string{"cf_org_name"}, Regex: str("other")})).To(BeNil())
+		Expect(process(Config{Action: Drop, SourceLabels: []string{"event_type"}, Regex: str("LogMessage")})).To(BeNil())
+	})
+
+	It("maps and keeps labels by name", func() {
+		out := process(
+			Config{Action: LabelMap, Regex: str("cf_(.+)_name"), Replacement: str("$1")},
+			Config{Action: LabelKeep, Regex: str("app|space|org")},
+		)
+		Expect(out).To(Equal(messages.LabelSet{"app": "billing-api", "space": "prod", "org": "payments"}))
+	})
+
+	It("hashes source labels into shards", func() {
+		cfg := Config{Action: HashMod, SourceLabels: []string{"cf_app_name"}, Modulus: 4, TargetLabel: "shard"}
+		first := process(cfg)["shard"]
+		Expect(first).To(MatchRegexp("^[0-3]$"))
+		Expect(process(cfg)["shard"]).To(Equal(first))
+	})
+
+	It("rejects invalid configs", func() {
+		for _, cfg := range []Config{
+			{Action: "rename"},
+			{Action: Replace},
+			{Action: HashMod, TargetLabel: "shard"},
+			{Action: Keep},
+			{Action: LabelDrop, Regex: str("(")},
+		} {
+			_, err := Compile([]Config{cfg})
+			Expect(err).To(HaveOccurred(), "%+v", cfg)
+		}
+	})
+})